@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/CoderCookE/goaround/internal/control"
+)
+
+const (
+	exitOK      = 0
+	exitFailed  = 1
+	exitUsage   = 2
+	tableFormat = "table"
+	jsonFormat  = "json"
+)
+
+const usage = `Usage: goaroundctl [flags] <command> [arguments]
+
+Commands:
+  list                              list backends
+  status                            show a summary of the pool
+  add [-weight n] <backend>...      add backends
+  remove <backend>...               remove backends
+  drain <backend>...                drain backends
+  weight <backend> <weight>         set the weight of a backend
+  maintenance on|off <backend>...   toggle maintenance
+  replace <backend>...              replace every backend
+  switch <set>                      make a backend set active, the current one drains
+  purge [path]...                   purge cached paths, or the whole cache
+  splits                            list route splits
+  split <split> <percent>           set the percentage of a split sent to its canary
+
+Flags:
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("goaroundctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	socket := flags.String("socket", control.DefaultSocketPath, "Path of the goaround control socket")
+	admin := flags.String("admin", "", "URL of the goaround admin API, used instead of the socket when set")
+	token := flags.String("token", "", "Admin API token, read from GOAROUND_ADMIN_TOKEN when empty")
+	output := flags.String("o", tableFormat, "Output format, table or json")
+
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if *output != tableFormat && *output != jsonFormat {
+		fmt.Fprintf(stderr, "unknown output format %q\n", *output)
+		return exitUsage
+	}
+
+	req, err := buildRequest(flags.Args())
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n\n", err.Error())
+		flags.Usage()
+		return exitUsage
+	}
+
+	var client control.Client
+	if *admin != "" {
+		if *token == "" {
+			*token = os.Getenv("GOAROUND_ADMIN_TOKEN")
+		}
+		client = control.NewAdminClient(*admin, *token)
+	} else {
+		client = control.NewSocketClient(*socket)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err.Error())
+		return exitFailed
+	}
+
+	if *output == jsonFormat {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(res); err != nil {
+			fmt.Fprintf(stderr, "error: %s\n", err.Error())
+			return exitFailed
+		}
+	} else if res.OK {
+		if err := printTable(stdout, req.Command, res.Result); err != nil {
+			fmt.Fprintf(stderr, "error: %s\n", err.Error())
+			return exitFailed
+		}
+	}
+
+	if !res.OK {
+		fmt.Fprintf(stderr, "error: %s\n", res.Error)
+		return exitFailed
+	}
+
+	return exitOK
+}
+
+func buildRequest(args []string) (*control.Request, error) {
+	if len(args) == 0 {
+		return nil, errors.New("missing command")
+	}
+
+	req := &control.Request{Version: control.Version, Command: args[0]}
+	args = args[1:]
+
+	switch req.Command {
+	case control.List, control.Status, control.Splits:
+		if len(args) > 0 {
+			return nil, fmt.Errorf("%s takes no arguments", req.Command)
+		}
+	case control.Add:
+		flags := flag.NewFlagSet(control.Add, flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		weight := flags.Int("weight", 1, "")
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		req.Weight = *weight
+		req.Backends = flags.Args()
+	case control.Remove, control.Drain, control.Replace:
+		req.Backends = args
+	case "weight":
+		if len(args) != 2 {
+			return nil, errors.New("weight requires a backend and a weight")
+		}
+		weight, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight %q", args[1])
+		}
+		req.Command = control.SetWeight
+		req.Backends = args[:1]
+		req.Weight = weight
+	case control.Maintenance:
+		if len(args) < 2 || (args[0] != "on" && args[0] != "off") {
+			return nil, errors.New("maintenance requires on or off and at least one backend")
+		}
+		req.Enabled = args[0] == "on"
+		req.Backends = args[1:]
+	case control.Purge:
+		req.Keys = args
+	case control.Switch:
+		if len(args) != 1 {
+			return nil, errors.New("switch requires a set")
+		}
+		req.Set = args[0]
+		return req, nil
+	case "split":
+		if len(args) != 2 {
+			return nil, errors.New("split requires a split and a percent")
+		}
+		percent, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percent %q", args[1])
+		}
+		req.Command = control.SetSplit
+		req.Split = args[0]
+		req.Percent = percent
+		return req, nil
+	default:
+		return nil, fmt.Errorf("unknown command %q", req.Command)
+	}
+
+	if len(req.Backends) == 0 && req.Command != control.List && req.Command != control.Status && req.Command != control.Purge && req.Command != control.Splits {
+		return nil, fmt.Errorf("%s requires at least one backend", req.Command)
+	}
+
+	return req, nil
+}
+
+func printTable(w io.Writer, command string, result interface{}) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	switch command {
+	case control.List:
+		var backends []control.BackendStatus
+		if err := convert(result, &backends); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(table, "BACKEND\tHEALTHY\tWEIGHT\tCONNECTIONS\tIN FLIGHT\tCIRCUIT\tSTATE\tSET")
+		for _, b := range backends {
+			fmt.Fprintf(table, "%s\t%t\t%d\t%d\t%d\t%s\t%s\t%s\n", b.Backend, b.Healthy, b.Weight, b.Connections, b.InFlight, b.Circuit, state(b), b.Set)
+		}
+	case control.Status:
+		status := control.PoolStatus{}
+		if err := convert(result, &status); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(table, "backends\t%d\n", status.Backends)
+		fmt.Fprintf(table, "healthy backends\t%d\n", status.HealthyBackends)
+		fmt.Fprintf(table, "draining backends\t%d\n", status.DrainingBackends)
+		fmt.Fprintf(table, "available connections\t%d\n", status.AvailableConnections)
+		fmt.Fprintf(table, "cache enabled\t%t\n", status.CacheEnabled)
+		if status.ActiveSet != "" {
+			fmt.Fprintf(table, "active set\t%s\n", status.ActiveSet)
+		}
+	case control.Splits:
+		var splits []control.SplitStatus
+		if err := convert(result, &splits); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(table, "SPLIT\tSTABLE\tCANARY\tPERCENT\tHEADER\tCOOKIE")
+		for _, s := range splits {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%v\t%s\t%s\n", s.Split, poolName(s.Stable), s.Canary, s.Percent, s.Header, s.Cookie)
+		}
+	default:
+		fmt.Fprintln(table, "ok")
+	}
+
+	return table.Flush()
+}
+
+func state(b control.BackendStatus) string {
+	switch {
+	case b.Drain != nil && b.Drain.Removing:
+		return fmt.Sprintf("removing, %.0fs left", b.Drain.Remaining)
+	case b.Draining:
+		return "draining"
+	case b.Maintenance:
+		return "maintenance"
+	case b.Standby:
+		return "standby"
+	default:
+		return "active"
+	}
+}
+
+func poolName(name string) string {
+	if name == "" {
+		return "default"
+	}
+
+	return name
+}
+
+// convert decodes a generic JSON result into its typed form.
+func convert(result interface{}, into interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, into)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CoderCookE/goaround/internal/assert"
+	"github.com/CoderCookE/goaround/internal/control"
+)
+
+func TestRun(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	var last *control.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last = &control.Request{}
+		assertion.Equal(json.NewDecoder(r.Body).Decode(last), nil)
+
+		res := &control.Response{Version: control.Version, OK: true}
+		switch {
+		case r.Header.Get("Authorization") != "Bearer secret":
+			res = &control.Response{Version: control.Version, Error: "invalid token"}
+		case last.Command == control.List:
+			res.Result = []control.BackendStatus{
+				{Backend: "http://localhost:9000", Healthy: true, Weight: 2, Circuit: control.CircuitClosed, Draining: true},
+				{Backend: "http://localhost:9001", Draining: true, Drain: &control.DrainStatus{Removing: true, Remaining: 12}},
+				{Backend: "http://localhost:9002", Healthy: true, Weight: 1, Set: "green", Standby: true},
+			}
+		case last.Command == control.Remove:
+			res = &control.Response{Version: control.Version, Error: "unknown backends: http://localhost:9001"}
+		}
+		assertion.Equal(json.NewEncoder(w).Encode(res), nil)
+	}))
+	defer server.Close()
+
+	ctl := func(args ...string) (int, string, string) {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := run(append([]string{"-admin", server.URL, "-token", "secret"}, args...), stdout, stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	t.Run("prints backends as a table", func(t *testing.T) {
+		code, stdout, _ := ctl("list")
+		assertion.Equal(code, 0)
+		assertion.StringContains(stdout, "BACKEND")
+		assertion.StringContains(stdout, "http://localhost:9000")
+		assertion.StringContains(stdout, "draining")
+		assertion.StringContains(stdout, "removing, 12s left")
+		assertion.StringContains(stdout, "standby")
+		assertion.StringContains(stdout, "green")
+	})
+
+	t.Run("prints JSON", func(t *testing.T) {
+		code, stdout, _ := ctl("-o", "json", "list")
+		assertion.Equal(code, 0)
+
+		res := &control.Response{}
+		assertion.Equal(json.Unmarshal([]byte(stdout), res), nil)
+		assertion.True(res.OK)
+	})
+
+	t.Run("builds requests from subcommands", func(t *testing.T) {
+		code, _, _ := ctl("add", "-weight", "3", "http://localhost:9001")
+		assertion.Equal(code, 0)
+		assertion.Equal(last.Command, control.Add)
+		assertion.Equal(last.Weight, 3)
+
+		code, _, _ = ctl("weight", "http://localhost:9001", "5")
+		assertion.Equal(code, 0)
+		assertion.Equal(last.Command, control.SetWeight)
+		assertion.Equal(last.Weight, 5)
+
+		code, _, _ = ctl("maintenance", "on", "http://localhost:9001")
+		assertion.Equal(code, 0)
+		assertion.True(last.Enabled)
+
+		code, _, _ = ctl("purge", "/assets/app.js")
+		assertion.Equal(code, 0)
+		assertion.Equal(last.Keys[0], "/assets/app.js")
+
+		code, _, _ = ctl("switch", "green")
+		assertion.Equal(code, 0)
+		assertion.Equal(last.Command, control.Switch)
+		assertion.Equal(last.Set, "green")
+
+		code, _, _ = ctl("split", "checkout", "12.5")
+		assertion.Equal(code, 0)
+		assertion.Equal(last.Command, control.SetSplit)
+		assertion.Equal(last.Split, "checkout")
+		assertion.Equal(last.Percent, 12.5)
+	})
+
+	t.Run("exits non-zero on failures", func(t *testing.T) {
+		code, _, stderr := ctl("remove", "http://localhost:9001")
+		assertion.Equal(code, 1)
+		assertion.StringContains(stderr, "unknown backends")
+
+		stdout, stderrBuf := &bytes.Buffer{}, &bytes.Buffer{}
+		code = run([]string{"-admin", server.URL, "-token", "wrong", "status"}, stdout, stderrBuf)
+		assertion.Equal(code, 1)
+		assertion.StringContains(stderrBuf.String(), "invalid token")
+	})
+
+	t.Run("exits with a usage error on bad arguments", func(t *testing.T) {
+		code, _, stderr := ctl("frobnicate")
+		assertion.Equal(code, 2)
+		assertion.StringContains(stderr, "unknown command")
+
+		code, _, _ = ctl("drain")
+		assertion.Equal(code, 2)
+
+		code, _, _ = ctl("split", "checkout", "half")
+		assertion.Equal(code, 2)
+
+		code, _, _ = ctl("-o", "yaml", "list")
+		assertion.Equal(code, 2)
+	})
+}
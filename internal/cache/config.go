@@ -0,0 +1,16 @@
+package cache
+
+import "time"
+
+type Config struct {
+	// Name is the pool's, it labels the cache's metrics
+	Name          string
+	MaxBytes      int64
+	MaxObjectSize int64
+	Counters      int64
+	TTL           time.Duration
+	DiskDir       string
+	DiskMaxBytes  int64
+	RemoteAddr    string
+	RemoteTimeout time.Duration
+}
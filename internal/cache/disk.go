@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskSuffix    = ".entry"
+	diskTmpSuffix = ".tmp"
+)
+
+type diskItem struct {
+	key  string
+	file string
+	size int64
+}
+
+// Disk is a size bounded least recently used entry store backed by a
+// directory, entries found in the directory are indexed on creation.
+type Disk struct {
+	sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	items    map[string]*list.Element
+}
+
+func NewDisk(dir string, maxBytes int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	d := &Disk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *Disk) load() error {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	// Oldest first so the most recently used entries end up at the front.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	d.Lock()
+	defer d.Unlock()
+
+	for _, info := range files {
+		name := info.Name()
+		path := filepath.Join(d.dir, name)
+
+		if strings.HasSuffix(name, diskTmpSuffix) {
+			_ = os.Remove(path)
+			continue
+		}
+
+		if info.IsDir() || !strings.HasSuffix(name, diskSuffix) {
+			continue
+		}
+
+		key, err := readKey(path)
+		if err != nil {
+			log.Printf("Removing unreadable cache file %s: %s", path, err.Error())
+			_ = os.Remove(path)
+			continue
+		}
+
+		d.items[key] = d.lru.PushFront(&diskItem{key: key, file: path, size: info.Size()})
+		d.size += info.Size()
+	}
+
+	d.evict()
+
+	return nil
+}
+
+func readKey(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var key string
+	err = gob.NewDecoder(f).Decode(&key)
+
+	return key, err
+}
+
+func (d *Disk) Get(key string) (*Entry, bool) {
+	d.Lock()
+	element, found := d.items[key]
+	if found {
+		d.lru.MoveToFront(element)
+	}
+	d.Unlock()
+
+	if !found {
+		return nil, false
+	}
+
+	item := element.Value.(*diskItem)
+	f, err := os.Open(item.file)
+	if err != nil {
+		d.Delete(key)
+		return nil, false
+	}
+	defer f.Close()
+
+	var storedKey string
+	entry := &Entry{}
+	decoder := gob.NewDecoder(f)
+	if err := decoder.Decode(&storedKey); err != nil {
+		d.Delete(key)
+		return nil, false
+	}
+
+	if err := decoder.Decode(entry); err != nil {
+		d.Delete(key)
+		return nil, false
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(item.file, now, now)
+
+	return entry, true
+}
+
+func (d *Disk) Contains(key string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	_, found := d.items[key]
+	return found
+}
+
+// Set writes the entry to a temporary file and moves it into place, least
+// recently used entries are removed until the directory fits in maxBytes.
+func (d *Disk) Set(entry *Entry) error {
+	file := d.fileName(entry.Key)
+
+	tmp, err := ioutil.TempFile(d.dir, filepath.Base(file)+"-*"+diskTmpSuffix)
+	if err != nil {
+		return err
+	}
+
+	encoder := gob.NewEncoder(tmp)
+	err = encoder.Encode(entry.Key)
+	if err == nil {
+		err = encoder.Encode(entry)
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if element, found := d.items[entry.Key]; found {
+		item := element.Value.(*diskItem)
+		d.size -= item.size
+		item.size = info.Size()
+		d.lru.MoveToFront(element)
+	} else {
+		d.items[entry.Key] = d.lru.PushFront(&diskItem{key: entry.Key, file: file, size: info.Size()})
+	}
+
+	d.size += info.Size()
+	d.evict()
+
+	return nil
+}
+
+func (d *Disk) Delete(key string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if element, found := d.items[key]; found {
+		d.remove(element)
+	}
+}
+
+func (d *Disk) Clear() {
+	d.Lock()
+	defer d.Unlock()
+
+	for d.lru.Len() > 0 {
+		d.remove(d.lru.Back())
+	}
+}
+
+// Usage returns the bytes and number of entries held on disk.
+func (d *Disk) Usage() (int64, int) {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.size, len(d.items)
+}
+
+func (d *Disk) evict() {
+	for d.maxBytes > 0 && d.size > d.maxBytes {
+		oldest := d.lru.Back()
+		if oldest == nil {
+			return
+		}
+
+		d.remove(oldest)
+	}
+}
+
+func (d *Disk) remove(element *list.Element) {
+	item := element.Value.(*diskItem)
+
+	if err := os.Remove(item.file); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing cache file %s: %s", item.file, err.Error())
+	}
+
+	d.lru.Remove(element)
+	delete(d.items, item.key)
+	d.size -= item.size
+}
+
+func (d *Disk) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+diskSuffix)
+}
+
+func (d *Disk) Close() {}
@@ -0,0 +1,232 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Entry struct {
+	Key        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Expires    time.Time
+}
+
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Headers describing the body of the stored response, a 304 must not replace them.
+var notModifiedSkip = map[string]struct{}{
+	"Content-Length":   {},
+	"Content-Encoding": {},
+	"Content-Range":    {},
+	"Content-Type":     {},
+}
+
+// Cacheable reports whether a response may be stored, only successful GET
+// responses without no-store or private directives are kept and event
+// streams are never buffered. Responses to requests with credentials are
+// only shared when marked public or given an s-maxage
+func Cacheable(res *http.Response) bool {
+	if res.Request == nil || res.Request.Method != http.MethodGet || res.StatusCode != http.StatusOK {
+		return false
+	}
+
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		return false
+	}
+
+	for _, directive := range []string{"no-store", "private"} {
+		if hasDirective(res.Header, directive) || hasDirective(res.Request.Header, directive) {
+			return false
+		}
+	}
+
+	if res.Request.Header.Get("Authorization") != "" {
+		return hasDirective(res.Header, "public") || hasDirective(res.Header, "s-maxage")
+	}
+
+	return true
+}
+
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// Revalidatable reports whether the entry has validators a backend can
+// answer with a 304 Not Modified
+func (e *Entry) Revalidatable() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// AddConditions makes the request conditional on the entry's validators
+func (e *Entry) AddConditions(r *http.Request) {
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+
+	if etag := e.Header.Get("ETag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+
+	if modified := e.Header.Get("Last-Modified"); modified != "" {
+		r.Header.Set("If-Modified-Since", modified)
+	}
+}
+
+// NotModified reports whether the conditional headers of a client request
+// match the entry, If-None-Match takes precedence over If-Modified-Since
+func (e *Entry) NotModified(r *http.Request) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, e.Header.Get("ETag"))
+	}
+
+	since := r.Header.Get("If-Modified-Since")
+	modified := e.Header.Get("Last-Modified")
+	if since == "" || modified == "" {
+		return false
+	}
+
+	sinceTime, err := http.ParseTime(since)
+	if err != nil {
+		return false
+	}
+
+	modifiedTime, err := http.ParseTime(modified)
+	if err != nil {
+		return false
+	}
+
+	return !modifiedTime.After(sinceTime)
+}
+
+// Write serves the entry, answering with a 304 when the client already holds it
+func (e *Entry) Write(w http.ResponseWriter, r *http.Request) error {
+	header := w.Header()
+	for k, v := range e.Header {
+		header[k] = v
+	}
+
+	if e.NotModified(r) {
+		for k := range notModifiedSkip {
+			header.Del(k)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.StatusCode)
+	_, err := w.Write(e.Body)
+
+	return err
+}
+
+// Size is the number of bytes held by the entry
+func (e *Entry) Size() int64 {
+	size := len(e.Key) + len(e.Body)
+	for k, values := range e.Header {
+		for _, v := range values {
+			size += len(k) + len(v)
+		}
+	}
+
+	return int64(size)
+}
+
+func expiry(header http.Header, now time.Time, ttl time.Duration) time.Time {
+	if hasDirective(header, "no-cache") {
+		return now
+	}
+
+	if age, ok := directiveSeconds(header, "s-maxage"); ok {
+		return now.Add(age)
+	}
+
+	if age, ok := directiveSeconds(header, "max-age"); ok {
+		return now.Add(age)
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return now
+		}
+		return t
+	}
+
+	return now.Add(ttl)
+}
+
+func directives(header http.Header) []string {
+	var all []string
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			all = append(all, strings.ToLower(strings.TrimSpace(directive)))
+		}
+	}
+
+	return all
+}
+
+func hasDirective(header http.Header, name string) bool {
+	for _, directive := range directives(header) {
+		if directive == name || strings.HasPrefix(directive, name+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func directiveSeconds(header http.Header, name string) (time.Duration, bool) {
+	for _, directive := range directives(header) {
+		if !strings.HasPrefix(directive, name+"=") {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(strings.Trim(directive[len(name)+1:], `"`))
+		if err != nil || seconds < 0 {
+			return 0, true
+		}
+
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	return 0, false
+}
+
+func etagMatches(match, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(match, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || weak(candidate) == weak(etag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func weak(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
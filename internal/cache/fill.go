@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/CoderCookE/goaround/internal/stats"
+)
+
+// fill tees a response body into a buffer while it is streamed to the
+// client, the entry is stored once the body has been read to the end.
+type fill struct {
+	io.ReadCloser
+	cache     *Cache
+	key       string
+	res       *http.Response
+	buf       bytes.Buffer
+	abandoned bool
+	stored    bool
+}
+
+// Fill wraps the response body so it is cached as the proxy copies it to the
+// client, caching is abandoned once the body grows past the max object size.
+func (c *Cache) Fill(key string, res *http.Response) {
+	if c.TooLarge(res.ContentLength) {
+		stats.CacheCounter.WithLabelValues(key, "too_large").Add(1)
+		return
+	}
+
+	res.Body = &fill{ReadCloser: res.Body, cache: c, key: key, res: res}
+}
+
+func (f *fill) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+
+	if n > 0 && !f.abandoned {
+		if f.cache.TooLarge(int64(f.buf.Len() + n)) {
+			stats.CacheCounter.WithLabelValues(f.key, "too_large").Add(1)
+			f.abandon()
+		} else {
+			f.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && !f.abandoned && !f.stored {
+		f.stored = true
+		f.cache.Set(f.cache.NewEntry(f.key, f.res, f.buf.Bytes()))
+	}
+
+	return n, err
+}
+
+// Close abandons bodies the client stopped reading before the end.
+func (f *fill) Close() error {
+	f.abandon()
+	return f.ReadCloser.Close()
+}
+
+func (f *fill) abandon() {
+	f.abandoned = true
+	f.buf = bytes.Buffer{}
+}
@@ -0,0 +1,344 @@
+package cache
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+
+	"github.com/CoderCookE/goaround/internal/stats"
+)
+
+const (
+	defaultMaxBytes = 1 << 30 // maximum cost of cache (1GB).
+	defaultCounters = 1e7     // number of keys to track frequency of (10M).
+	defaultTTL      = 5 * time.Minute
+	writeBuffer     = 1024
+)
+
+// Store is a cache tier beneath the in-memory ristretto cache.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(entry *Entry) error
+	Delete(key string)
+	Close()
+}
+
+type tier struct {
+	Store
+	name string
+}
+
+type write struct {
+	tier  *tier
+	entry *Entry
+}
+
+// Cache is an in-memory ristretto L1 in front of optional disk and remote
+// tiers, tiers are searched in order and written to in the background. The
+// disk tier only takes entries leaving memory, the shared remote tier takes
+// every entry.
+type Cache struct {
+	sync.RWMutex
+	name  string
+	store *ristretto.Cache
+	tiers []*tier
+	// closed stops queueing writes once Close closes the channel
+	closed bool
+	// purging is set while a purge clears memory, cleared entries aren't
+	// spilled
+	purging       int32
+	writes        chan write
+	written       chan bool
+	maxObjectSize int64
+	ttl           time.Duration
+}
+
+func New(c *Config) (*Cache, error) {
+	maxCost := c.MaxBytes
+	if maxCost <= 0 {
+		maxCost = defaultMaxBytes
+	}
+
+	numCounters := c.Counters
+	if numCounters <= 0 {
+		numCounters = defaultCounters
+	}
+
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+
+	// Objects larger than every tier are never kept, so stop buffering them.
+	// Objects larger than memory still spill to disk.
+	maxObjectSize := c.MaxObjectSize
+	if maxObjectSize <= 0 {
+		maxObjectSize = maxCost
+		if c.DiskDir != "" && c.DiskMaxBytes <= 0 {
+			maxObjectSize = math.MaxInt64
+		} else if c.DiskDir != "" && c.DiskMaxBytes > maxObjectSize {
+			maxObjectSize = c.DiskMaxBytes
+		}
+	}
+
+	cache := &Cache{
+		name:          c.Name,
+		maxObjectSize: maxObjectSize,
+		ttl:           ttl,
+	}
+
+	storeConfig := &ristretto.Config{
+		NumCounters: numCounters,
+		MaxCost:     maxCost,
+		BufferItems: 64, // number of keys per Get buffer.
+		Metrics:     true,
+		// costs are response sizes, not ristretto's bookkeeping
+		IgnoreInternalCost: true,
+		OnEvict:            cache.onEvict,
+		OnReject:           cache.onReject,
+	}
+
+	if c.DiskDir != "" {
+		disk, err := NewDisk(c.DiskDir, c.DiskMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		cache.tiers = append(cache.tiers, &tier{Store: disk, name: "disk"})
+	}
+
+	if c.RemoteAddr != "" {
+		remote := NewMemcached(c.RemoteAddr, c.Name, c.RemoteTimeout)
+		cache.tiers = append(cache.tiers, &tier{Store: remote, name: "remote"})
+	}
+
+	if len(cache.tiers) > 0 {
+		cache.writes = make(chan write, writeBuffer)
+		cache.written = make(chan bool)
+
+		go cache.writeTiers()
+	}
+
+	store, err := ristretto.NewCache(storeConfig)
+	if err != nil {
+		return nil, err
+	}
+	cache.store = store
+
+	return cache, nil
+}
+
+// Key returns the cache key a request is stored under
+func Key(r *http.Request) string {
+	return r.URL.Path
+}
+
+// Get looks the key up in memory and then in each tier, entries found in a
+// tier are promoted back into memory
+func (c *Cache) Get(key string) (*Entry, bool) {
+	value, found := c.store.Get(key)
+	defer c.reportMetrics()
+
+	if found {
+		return value.(*Entry), true
+	}
+
+	for _, t := range c.tiers {
+		entry, found := t.Get(key)
+		if found {
+			stats.CacheCounter.WithLabelValues(key, t.name+"_hit").Add(1)
+			c.store.Set(entry.Key, entry, entry.Size())
+			return entry, true
+		}
+	}
+
+	return nil, false
+}
+
+// Set stores the entry with a cost of its size in bytes, entries larger than
+// the configured max object size are not stored
+func (c *Cache) Set(entry *Entry) bool {
+	cost := entry.Size()
+	if c.TooLarge(cost) {
+		stats.CacheCounter.WithLabelValues(entry.Key, "too_large").Add(1)
+		return false
+	}
+
+	stored := c.store.Set(entry.Key, entry, cost)
+	for _, t := range c.tiers {
+		if _, spill := t.Store.(*Disk); !spill {
+			c.queueWrite(t, entry)
+		}
+	}
+	c.reportMetrics()
+
+	return stored
+}
+
+func (c *Cache) Delete(key string) {
+	c.store.Del(key)
+
+	for _, t := range c.tiers {
+		t.Delete(key)
+	}
+}
+
+// Purge deletes the given keys from every tier, without keys memory and
+// disk are cleared. A shared remote tier is never flushed as a whole.
+func (c *Cache) Purge(keys []string) {
+	for _, key := range keys {
+		c.Delete(key)
+	}
+
+	if len(keys) > 0 {
+		return
+	}
+
+	atomic.StoreInt32(&c.purging, 1)
+	c.store.Clear()
+	atomic.StoreInt32(&c.purging, 0)
+
+	for _, t := range c.tiers {
+		if disk, ok := t.Store.(*Disk); ok {
+			disk.Clear()
+		}
+	}
+	c.reportMetrics()
+}
+
+// Close stops the tier writer and releases every tier, the entries in
+// memory are spilled to disk first so a restart finds them.
+func (c *Cache) Close() {
+	c.store.Wait()
+	c.store.Close()
+
+	if c.writes != nil {
+		c.Lock()
+		c.closed = true
+		close(c.writes)
+		c.Unlock()
+
+		<-c.written
+	}
+
+	for _, t := range c.tiers {
+		t.Close()
+	}
+}
+
+func (c *Cache) onEvict(item *ristretto.Item) {
+	if atomic.LoadInt32(&c.purging) == 1 {
+		return
+	}
+
+	stats.CacheEvictionCounter.WithLabelValues(c.name, "evicted").Add(1)
+	c.spillItem(item)
+}
+
+func (c *Cache) onReject(item *ristretto.Item) {
+	stats.CacheEvictionCounter.WithLabelValues(c.name, "rejected").Add(1)
+	c.spillItem(item)
+}
+
+// spillItem writes entries leaving memory to the disk tier when it no
+// longer holds them
+func (c *Cache) spillItem(item *ristretto.Item) {
+	entry, ok := item.Value.(*Entry)
+	if !ok {
+		return
+	}
+
+	for _, t := range c.tiers {
+		disk, ok := t.Store.(*Disk)
+		if ok && !disk.Contains(entry.Key) {
+			c.queueWrite(t, entry)
+		}
+	}
+}
+
+// queueWrite hands the entry to the tier writer, writes are dropped
+// rather than blocking requests when the writer falls behind
+func (c *Cache) queueWrite(t *tier, entry *Entry) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.closed {
+		return
+	}
+
+	select {
+	case c.writes <- write{tier: t, entry: entry}:
+	default:
+		stats.CacheCounter.WithLabelValues(entry.Key, t.name+"_write_dropped").Add(1)
+	}
+}
+
+func (c *Cache) writeTiers() {
+	for w := range c.writes {
+		if err := w.tier.Set(w.entry); err != nil {
+			log.Printf("Error writing cache entry to %s: %s", w.tier.name, err.Error())
+		}
+	}
+
+	close(c.written)
+}
+
+// NewEntry builds an entry for a response, its freshness lifetime comes from
+// Cache-Control or Expires falling back to the configured ttl
+func (c *Cache) NewEntry(key string, res *http.Response, body []byte) *Entry {
+	header := res.Header.Clone()
+	removeHopHeaders(header)
+
+	return &Entry{
+		Key:        key,
+		StatusCode: res.StatusCode,
+		Header:     header,
+		Body:       body,
+		Expires:    expiry(header, time.Now(), c.ttl),
+	}
+}
+
+// Renew returns a copy of the entry updated with the headers of a
+// 304 Not Modified response and a new freshness lifetime
+func (c *Cache) Renew(entry *Entry, header http.Header) *Entry {
+	renewed := *entry
+	renewed.Header = entry.Header.Clone()
+
+	for k, v := range header {
+		if _, skip := notModifiedSkip[k]; skip {
+			continue
+		}
+		renewed.Header[k] = v
+	}
+	removeHopHeaders(renewed.Header)
+	renewed.Expires = expiry(renewed.Header, time.Now(), c.ttl)
+
+	return &renewed
+}
+
+func (c *Cache) TooLarge(size int64) bool {
+	return size > c.maxObjectSize
+}
+
+func (c *Cache) reportMetrics() {
+	metrics := c.store.Metrics
+	if metrics == nil {
+		return
+	}
+
+	stats.CacheUsageGauge.WithLabelValues(c.name, "bytes").Set(float64(metrics.CostAdded() - metrics.CostEvicted()))
+	stats.CacheUsageGauge.WithLabelValues(c.name, "entries").Set(float64(metrics.KeysAdded() - metrics.KeysEvicted()))
+
+	for _, t := range c.tiers {
+		if disk, ok := t.Store.(*Disk); ok {
+			bytes, entries := disk.Usage()
+			stats.CacheUsageGauge.WithLabelValues(c.name, "disk_bytes").Set(float64(bytes))
+			stats.CacheUsageGauge.WithLabelValues(c.name, "disk_entries").Set(float64(entries))
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CoderCookE/goaround/internal/assert"
+	"github.com/CoderCookE/goaround/internal/stats"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newResponse(header http.Header) *http.Response {
+	req := httptest.NewRequest("GET", "http://www.test.com/foo", nil)
+	return &http.Response{Request: req, StatusCode: http.StatusOK, Header: header}
+}
+
+func TestCache(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	t.Run("stores entries with their size as cost", func(t *testing.T) {
+		c, err := New(&Config{MaxBytes: 1 << 20, TTL: time.Minute})
+		assertion.Equal(err, nil)
+
+		entry := c.NewEntry("/foo", newResponse(http.Header{}), []byte("bar"))
+		assertion.True(c.Set(entry))
+		c.store.Wait()
+
+		cached, found := c.Get("/foo")
+		assertion.True(found)
+		assertion.Equal(string(cached.Body), "bar")
+		assertion.Equal(c.store.Metrics.CostAdded(), uint64(entry.Size()))
+	})
+
+	t.Run("reports usage and evictions", func(t *testing.T) {
+		c, err := New(&Config{MaxBytes: 64, MaxObjectSize: 1024, TTL: time.Minute})
+		assertion.Equal(err, nil)
+
+		rejected := testutil.ToFloat64(stats.CacheEvictionCounter.WithLabelValues("", "rejected"))
+
+		entry := c.NewEntry("/small", newResponse(http.Header{}), []byte("bar"))
+		assertion.True(c.Set(entry))
+		c.store.Wait()
+		c.Set(c.NewEntry("/large", newResponse(http.Header{}), []byte(strings.Repeat("a", 128))))
+		c.store.Wait()
+		c.reportMetrics()
+
+		assertion.Equal(testutil.ToFloat64(stats.CacheUsageGauge.WithLabelValues("", "bytes")), float64(entry.Size()))
+		assertion.Equal(testutil.ToFloat64(stats.CacheUsageGauge.WithLabelValues("", "entries")), 1.0)
+		assertion.Equal(testutil.ToFloat64(stats.CacheEvictionCounter.WithLabelValues("", "rejected")), rejected+1)
+
+		api, err := New(&Config{Name: "api", MaxBytes: 1 << 20, TTL: time.Minute})
+		assertion.Equal(err, nil)
+
+		assertion.True(api.Set(api.NewEntry("/a", newResponse(http.Header{}), []byte("a"))))
+		assertion.True(api.Set(api.NewEntry("/b", newResponse(http.Header{}), []byte("b"))))
+		api.store.Wait()
+		api.reportMetrics()
+
+		assertion.Equal(testutil.ToFloat64(stats.CacheUsageGauge.WithLabelValues("api", "entries")), 2.0)
+		assertion.Equal(testutil.ToFloat64(stats.CacheUsageGauge.WithLabelValues("", "entries")), 1.0)
+	})
+
+	t.Run("does not store entries larger than the max object size", func(t *testing.T) {
+		c, err := New(&Config{MaxObjectSize: 4, TTL: time.Minute})
+		assertion.Equal(err, nil)
+
+		entry := c.NewEntry("/foo", newResponse(http.Header{}), []byte("too large"))
+		assertion.False(c.Set(entry))
+	})
+
+	t.Run("renew merges headers and extends freshness", func(t *testing.T) {
+		c, err := New(&Config{TTL: time.Minute})
+		assertion.Equal(err, nil)
+
+		header := http.Header{}
+		header.Set("Cache-Control", "max-age=0")
+		header.Set("ETag", `"v1"`)
+		header.Set("Content-Type", "text/plain")
+		entry := c.NewEntry("/foo", newResponse(header), []byte("bar"))
+		assertion.False(entry.Fresh(time.Now()))
+
+		update := http.Header{}
+		update.Set("Cache-Control", "max-age=60")
+		update.Set("Content-Type", "text/html")
+		renewed := c.Renew(entry, update)
+
+		assertion.True(renewed.Fresh(time.Now()))
+		assertion.Equal(renewed.Header.Get("ETag"), `"v1"`)
+		assertion.Equal(renewed.Header.Get("Content-Type"), "text/plain")
+		assertion.Equal(entry.Header.Get("Cache-Control"), "max-age=0")
+	})
+}
+
+func TestFill(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	fillResponse := func(c *Cache, key, body string, contentLength int64) *http.Response {
+		res := newResponse(http.Header{})
+		res.Body = ioutil.NopCloser(strings.NewReader(body))
+		res.ContentLength = contentLength
+		c.Fill(key, res)
+
+		return res
+	}
+
+	t.Run("stores the body once it is streamed to the end", func(t *testing.T) {
+		c, err := New(&Config{MaxObjectSize: 1024})
+		assertion.Equal(err, nil)
+
+		res := fillResponse(c, "/stream", "streamed body", -1)
+		_, found := c.Get("/stream")
+		assertion.False(found)
+
+		body, err := ioutil.ReadAll(res.Body)
+		assertion.Equal(err, nil)
+		assertion.Equal(string(body), "streamed body")
+		c.store.Wait()
+
+		cached, found := c.Get("/stream")
+		assertion.True(found)
+		assertion.Equal(string(cached.Body), "streamed body")
+	})
+
+	t.Run("abandons bodies larger than the max object size", func(t *testing.T) {
+		c, err := New(&Config{MaxObjectSize: 8})
+		assertion.Equal(err, nil)
+
+		large := strings.Repeat("a", 64)
+		res := fillResponse(c, "/large", large, -1)
+		body, err := ioutil.ReadAll(res.Body)
+		assertion.Equal(err, nil)
+		assertion.Equal(string(body), large)
+
+		res = fillResponse(c, "/declared", large, int64(len(large)))
+		_, isFill := res.Body.(*fill)
+		assertion.False(isFill)
+		c.store.Wait()
+
+		_, found := c.Get("/large")
+		assertion.False(found)
+	})
+
+	t.Run("abandons bodies closed before the end", func(t *testing.T) {
+		c, err := New(&Config{MaxObjectSize: 1024})
+		assertion.Equal(err, nil)
+
+		res := fillResponse(c, "/partial", "partial body", -1)
+		_, err = res.Body.Read(make([]byte, 4))
+		assertion.Equal(err, nil)
+		assertion.Equal(res.Body.Close(), nil)
+		c.store.Wait()
+
+		_, found := c.Get("/partial")
+		assertion.False(found)
+	})
+}
+
+func TestEntry(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	header := http.Header{}
+	header.Set("ETag", `"v1"`)
+	header.Set("Last-Modified", modified.Format(http.TimeFormat))
+	entry := &Entry{Key: "/foo", StatusCode: http.StatusOK, Header: header, Body: []byte("bar")}
+
+	t.Run("cacheable only for successful GET responses", func(t *testing.T) {
+		assertion.True(Cacheable(newResponse(http.Header{})))
+
+		res := newResponse(http.Header{})
+		res.StatusCode = http.StatusInternalServerError
+		assertion.False(Cacheable(res))
+
+		noStore := http.Header{}
+		noStore.Set("Cache-Control", "no-store")
+		assertion.False(Cacheable(newResponse(noStore)))
+
+		private := http.Header{}
+		private.Set("Cache-Control", "private, max-age=60")
+		assertion.False(Cacheable(newResponse(private)))
+	})
+
+	t.Run("cacheable with credentials only when shared explicitly", func(t *testing.T) {
+		res := newResponse(http.Header{})
+		res.Request.Header.Set("Authorization", "Bearer secret")
+		assertion.False(Cacheable(res))
+
+		res.Header.Set("Cache-Control", "max-age=60")
+		assertion.False(Cacheable(res))
+
+		res.Header.Set("Cache-Control", "public, max-age=60")
+		assertion.True(Cacheable(res))
+
+		res.Header.Set("Cache-Control", "s-maxage=60")
+		assertion.True(Cacheable(res))
+
+		res.Header.Set("Cache-Control", "public, no-store")
+		assertion.False(Cacheable(res))
+	})
+
+	t.Run("expiry prefers max-age over Expires and ttl", func(t *testing.T) {
+		now := time.Now()
+		h := http.Header{}
+		h.Set("Expires", now.Add(time.Hour).UTC().Format(http.TimeFormat))
+		h.Set("Cache-Control", "public, max-age=10")
+		assertion.Equal(expiry(h, now, time.Minute), now.Add(10*time.Second))
+
+		h.Del("Cache-Control")
+		assertion.True(expiry(h, now, time.Minute).After(now.Add(59 * time.Minute)))
+
+		assertion.Equal(expiry(http.Header{}, now, time.Minute), now.Add(time.Minute))
+	})
+
+	t.Run("adds validators to revalidation requests", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://www.test.com/foo", nil)
+		entry.AddConditions(req)
+
+		assertion.True(entry.Revalidatable())
+		assertion.Equal(req.Header.Get("If-None-Match"), `"v1"`)
+		assertion.Equal(req.Header.Get("If-Modified-Since"), modified.Format(http.TimeFormat))
+	})
+
+	t.Run("answers matching client conditions with 304", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://www.test.com/foo", nil)
+		req.Header.Set("If-None-Match", `W/"v0", W/"v1"`)
+		recorder := httptest.NewRecorder()
+
+		err := entry.Write(recorder, req)
+		assertion.Equal(err, nil)
+		assertion.Equal(recorder.Code, http.StatusNotModified)
+		assertion.Equal(recorder.Body.String(), "")
+
+		req = httptest.NewRequest("GET", "http://www.test.com/foo", nil)
+		req.Header.Set("If-Modified-Since", modified.Add(-time.Hour).Format(http.TimeFormat))
+		recorder = httptest.NewRecorder()
+
+		err = entry.Write(recorder, req)
+		assertion.Equal(err, nil)
+		assertion.Equal(recorder.Code, http.StatusOK)
+		assertion.Equal(recorder.Body.String(), "bar")
+	})
+}
+
+func TestDisk(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	entry := func(key, body string) *Entry {
+		return &Entry{Key: key, StatusCode: http.StatusOK, Header: http.Header{}, Body: []byte(body)}
+	}
+
+	t.Run("stores and reloads entries", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "goaround-cache")
+		assertion.Equal(err, nil)
+		defer os.RemoveAll(dir)
+
+		disk, err := NewDisk(dir, 1<<20)
+		assertion.Equal(err, nil)
+		assertion.Equal(disk.Set(entry("/foo", "bar")), nil)
+
+		reloaded, err := NewDisk(dir, 1<<20)
+		assertion.Equal(err, nil)
+
+		cached, found := reloaded.Get("/foo")
+		assertion.True(found)
+		assertion.Equal(string(cached.Body), "bar")
+
+		_, entries := reloaded.Usage()
+		assertion.Equal(entries, 1)
+	})
+
+	t.Run("evicts least recently used entries past max bytes", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "goaround-cache")
+		assertion.Equal(err, nil)
+		defer os.RemoveAll(dir)
+
+		disk, err := NewDisk(dir, 0)
+		assertion.Equal(err, nil)
+		assertion.Equal(disk.Set(entry("/a", strings.Repeat("a", 512))), nil)
+		size, _ := disk.Usage()
+
+		disk.maxBytes = size*2 + size/2
+		assertion.Equal(disk.Set(entry("/b", strings.Repeat("b", 512))), nil)
+		_, found := disk.Get("/a")
+		assertion.True(found)
+
+		assertion.Equal(disk.Set(entry("/c", strings.Repeat("c", 512))), nil)
+		assertion.True(disk.Contains("/a"))
+		assertion.False(disk.Contains("/b"))
+		assertion.True(disk.Contains("/c"))
+
+		files, err := ioutil.ReadDir(dir)
+		assertion.Equal(err, nil)
+		assertion.Equal(len(files), 2)
+	})
+
+	t.Run("entries rejected from memory are served from disk", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "goaround-cache")
+		assertion.Equal(err, nil)
+		defer os.RemoveAll(dir)
+
+		c, err := New(&Config{MaxBytes: 1, MaxObjectSize: 1 << 20, DiskDir: dir, DiskMaxBytes: 1 << 20})
+		assertion.Equal(err, nil)
+
+		c.Set(entry("/foo", "bar"))
+		c.Close()
+
+		c, err = New(&Config{MaxBytes: 1, DiskDir: dir, DiskMaxBytes: 1 << 20})
+		assertion.Equal(err, nil)
+		defer c.Close()
+
+		cached, found := c.Get("/foo")
+		assertion.True(found)
+		assertion.Equal(string(cached.Body), "bar")
+	})
+
+	t.Run("stores objects larger than memory on disk", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "goaround-cache")
+		assertion.Equal(err, nil)
+		defer os.RemoveAll(dir)
+
+		c, err := New(&Config{MaxBytes: 64, DiskDir: dir, DiskMaxBytes: 1 << 20})
+		assertion.Equal(err, nil)
+		defer c.Close()
+
+		large := strings.Repeat("a", 4096)
+		assertion.False(c.TooLarge(int64(len(large))))
+		c.Set(entry("/large", large))
+		c.store.Wait()
+
+		disk := c.tiers[0].Store.(*Disk)
+		deadline := time.Now().Add(time.Second)
+		for !disk.Contains("/large") && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		cached, found := c.Get("/large")
+		assertion.True(found)
+		assertion.Equal(string(cached.Body), large)
+	})
+
+	t.Run("entries are spilled to disk once they leave memory", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "goaround-cache")
+		assertion.Equal(err, nil)
+		defer os.RemoveAll(dir)
+
+		c, err := New(&Config{MaxBytes: 1 << 20, DiskDir: dir, DiskMaxBytes: 1 << 20})
+		assertion.Equal(err, nil)
+		disk := c.tiers[0].Store.(*Disk)
+
+		assertion.True(c.Set(entry("/foo", "bar")))
+		c.store.Wait()
+		assertion.Equal(len(c.writes), 0)
+		assertion.False(disk.Contains("/foo"))
+
+		c.Close()
+		assertion.True(disk.Contains("/foo"))
+	})
+
+	t.Run("purged entries are not spilled", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "goaround-cache")
+		assertion.Equal(err, nil)
+		defer os.RemoveAll(dir)
+
+		c, err := New(&Config{MaxBytes: 1 << 20, DiskDir: dir, DiskMaxBytes: 1 << 20})
+		assertion.Equal(err, nil)
+		disk := c.tiers[0].Store.(*Disk)
+
+		assertion.True(c.Set(entry("/foo", "bar")))
+		c.store.Wait()
+		c.Purge(nil)
+		c.Close()
+		assertion.False(disk.Contains("/foo"))
+	})
+
+	t.Run("closes while entries are being set", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "goaround-cache")
+		assertion.Equal(err, nil)
+		defer os.RemoveAll(dir)
+
+		c, err := New(&Config{MaxBytes: 1, MaxObjectSize: 1 << 20, DiskDir: dir, DiskMaxBytes: 1 << 20})
+		assertion.Equal(err, nil)
+
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < 1000; i++ {
+				c.Set(entry(fmt.Sprintf("/%d", i), "bar"))
+			}
+			close(done)
+		}()
+
+		c.Close()
+		<-done
+	})
+}
+
+func fakeMemcached(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	values := make(map[string][]byte)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					fields := strings.Fields(line)
+					mu.Lock()
+					switch fields[0] {
+					case "get":
+						if value, ok := values[fields[1]]; ok {
+							fmt.Fprintf(conn, "VALUE %s 0 %d\r\n%s\r\n", fields[1], len(value), value)
+						}
+						fmt.Fprint(conn, "END\r\n")
+					case "set":
+						size, _ := strconv.Atoi(fields[4])
+						value := make([]byte, size+2)
+						_, _ = io.ReadFull(reader, value)
+						values[fields[1]] = value[:size]
+						fmt.Fprint(conn, "STORED\r\n")
+					case "delete":
+						if _, ok := values[fields[1]]; ok {
+							delete(values, fields[1])
+							fmt.Fprint(conn, "DELETED\r\n")
+						} else {
+							fmt.Fprint(conn, "NOT_FOUND\r\n")
+						}
+					}
+					mu.Unlock()
+				}
+			}(conn)
+		}
+	}()
+
+	return l
+}
+
+func TestMemcached(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	server := fakeMemcached(t)
+	defer server.Close()
+	addr := server.Addr().String()
+
+	t.Run("gets, sets and deletes entries", func(t *testing.T) {
+		remote := NewMemcached(addr, "", time.Second)
+		defer remote.Close()
+
+		_, found := remote.Get("/foo")
+		assertion.False(found)
+
+		err := remote.Set(&Entry{Key: "/foo", StatusCode: http.StatusOK, Header: http.Header{}, Body: []byte("bar")})
+		assertion.Equal(err, nil)
+
+		cached, found := remote.Get("/foo")
+		assertion.True(found)
+		assertion.Equal(string(cached.Body), "bar")
+
+		remote.Delete("/foo")
+		_, found = remote.Get("/foo")
+		assertion.False(found)
+	})
+
+	t.Run("shares entries between caches", func(t *testing.T) {
+		first, err := New(&Config{RemoteAddr: addr})
+		assertion.Equal(err, nil)
+
+		first.Set(first.NewEntry("/shared", newResponse(http.Header{}), []byte("bar")))
+		first.Close()
+
+		second, err := New(&Config{RemoteAddr: addr})
+		assertion.Equal(err, nil)
+		defer second.Close()
+
+		cached, found := second.Get("/shared")
+		assertion.True(found)
+		assertion.Equal(string(cached.Body), "bar")
+	})
+
+	t.Run("keeps the entries of pools sharing a server apart", func(t *testing.T) {
+		shop, err := New(&Config{Name: "shop", RemoteAddr: addr})
+		assertion.Equal(err, nil)
+
+		shop.Set(shop.NewEntry("/", newResponse(http.Header{}), []byte("shop")))
+		shop.Close()
+
+		blog, err := New(&Config{Name: "blog", RemoteAddr: addr})
+		assertion.Equal(err, nil)
+		defer blog.Close()
+
+		_, found := blog.Get("/")
+		assertion.False(found)
+
+		shop, err = New(&Config{Name: "shop", RemoteAddr: addr})
+		assertion.Equal(err, nil)
+		defer shop.Close()
+
+		cached, found := shop.Get("/")
+		assertion.True(found)
+		assertion.Equal(string(cached.Body), "shop")
+	})
+
+	t.Run("expires entries when they go stale", func(t *testing.T) {
+		now := time.Now()
+		exptime, fresh := expiration(now.Add(90*time.Second), now)
+		assertion.True(fresh)
+		assertion.Equal(exptime, int64(90))
+
+		later := now.Add(60 * 24 * time.Hour)
+		exptime, _ = expiration(later, now)
+		assertion.Equal(exptime, later.Unix())
+
+		_, fresh = expiration(now.Add(-time.Second), now)
+		assertion.False(fresh)
+
+		remote := NewMemcached(addr, "", time.Second)
+		defer remote.Close()
+
+		stale := &Entry{Key: "/stale", StatusCode: http.StatusOK, Header: http.Header{}, Body: []byte("bar"), Expires: now.Add(-time.Minute)}
+		assertion.Equal(remote.Set(stale), nil)
+		_, found := remote.Get("/stale")
+		assertion.False(found)
+	})
+
+	t.Run("misses when the server is unavailable", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assertion.Equal(err, nil)
+		unavailable := l.Addr().String()
+		l.Close()
+
+		remote := NewMemcached(unavailable, "", 100*time.Millisecond)
+		_, found := remote.Get("/foo")
+		assertion.False(found)
+	})
+}
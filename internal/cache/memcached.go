@@ -0,0 +1,277 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxRelativeExptime is the longest exptime memcached reads as seconds,
+	// longer ones must be unix times
+	maxRelativeExptime = 30 * 24 * 60 * 60
+
+	defaultRemoteTimeout = 250 * time.Millisecond
+	maxIdleRemoteConns   = 16
+	remoteKeyPrefix      = "goaround:"
+)
+
+type memcachedConn struct {
+	net.Conn
+	rw *bufio.ReadWriter
+}
+
+// Memcached is a Store shared between goaround instances, it speaks the
+// memcached text protocol so any memcached compatible server can back it.
+// Keys are prefixed with the pool's name, so pools sharing a server never
+// see each other's entries.
+type Memcached struct {
+	addr    string
+	prefix  string
+	timeout time.Duration
+	idle    chan *memcachedConn
+}
+
+func NewMemcached(addr, pool string, timeout time.Duration) *Memcached {
+	if timeout <= 0 {
+		timeout = defaultRemoteTimeout
+	}
+
+	prefix := remoteKeyPrefix
+	if pool != "" {
+		prefix += url.QueryEscape(pool) + ":"
+	}
+
+	return &Memcached{
+		addr:    addr,
+		prefix:  prefix,
+		timeout: timeout,
+		idle:    make(chan *memcachedConn, maxIdleRemoteConns),
+	}
+}
+
+func (m *Memcached) Get(key string) (*Entry, bool) {
+	var entry *Entry
+
+	err := m.do(func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "get %s\r\n", m.remoteKey(key)); err != nil {
+			return err
+		}
+
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+
+		line, err := readLine(rw)
+		if err != nil {
+			return err
+		}
+
+		if line == "END" {
+			return nil
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "VALUE" {
+			return fmt.Errorf("unexpected response: %q", line)
+		}
+
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return err
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rw, data); err != nil {
+			return err
+		}
+
+		if line, err = readLine(rw); err != nil {
+			return err
+		} else if line != "END" {
+			return fmt.Errorf("unexpected response: %q", line)
+		}
+
+		decoded := &Entry{}
+		if err := gob.NewDecoder(bytes.NewReader(data[:size])).Decode(decoded); err != nil {
+			return err
+		}
+
+		// Keys are hashed, make sure the entry is the one requested.
+		if decoded.Key == key {
+			entry = decoded
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("Error reading from remote cache %s: %s", m.addr, err.Error())
+		return nil, false
+	}
+
+	return entry, entry != nil
+}
+
+// Set stores the entry until it goes stale, entries that already are stale
+// aren't stored.
+func (m *Memcached) Set(entry *Entry) error {
+	exptime, fresh := expiration(entry.Expires, time.Now())
+	if !fresh {
+		return nil
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(entry); err != nil {
+		return err
+	}
+
+	return m.do(func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "set %s 0 %d %d\r\n", m.remoteKey(entry.Key), exptime, data.Len()); err != nil {
+			return err
+		}
+
+		if _, err := rw.Write(data.Bytes()); err != nil {
+			return err
+		}
+
+		if _, err := rw.WriteString("\r\n"); err != nil {
+			return err
+		}
+
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+
+		return expectLine(rw, "STORED")
+	})
+}
+
+func (m *Memcached) Delete(key string) {
+	err := m.do(func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "delete %s\r\n", m.remoteKey(key)); err != nil {
+			return err
+		}
+
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+
+		return expectLine(rw, "DELETED", "NOT_FOUND")
+	})
+
+	if err != nil {
+		log.Printf("Error deleting from remote cache %s: %s", m.addr, err.Error())
+	}
+}
+
+func (m *Memcached) Close() {
+	for {
+		select {
+		case conn := <-m.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// do runs a command on an idle connection, connections are only reused
+// when the command completed without error.
+func (m *Memcached) do(command func(rw *bufio.ReadWriter) error) error {
+	var conn *memcachedConn
+
+	select {
+	case conn = <-m.idle:
+	default:
+		c, err := net.DialTimeout("tcp", m.addr, m.timeout)
+		if err != nil {
+			return err
+		}
+
+		conn = &memcachedConn{
+			Conn: c,
+			rw:   bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c)),
+		}
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(m.timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	if err := command(conn.rw); err != nil {
+		conn.Close()
+		return err
+	}
+
+	select {
+	case m.idle <- conn:
+	default:
+		conn.Close()
+	}
+
+	return nil
+}
+
+func readLine(rw *bufio.ReadWriter) (string, error) {
+	line, err := rw.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func expectLine(rw *bufio.ReadWriter, expected ...string) error {
+	line, err := readLine(rw)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range expected {
+		if line == e {
+			return nil
+		}
+	}
+
+	return errors.New(line)
+}
+
+// remoteKey hashes cache keys, memcached keys are limited to 250 bytes
+// without whitespace or control characters.
+func (m *Memcached) remoteKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return m.prefix + hex.EncodeToString(sum[:])
+}
+
+// expiration returns the memcached exptime of an entry expiring at
+// expires, 0 when it never does. fresh is false once it has expired.
+func expiration(expires, now time.Time) (int64, bool) {
+	if expires.IsZero() {
+		return 0, true
+	}
+
+	ttl := expires.Sub(now)
+	if ttl <= 0 {
+		return 0, false
+	}
+
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds > maxRelativeExptime {
+		return expires.Unix(), true
+	}
+
+	return seconds, true
+}
@@ -0,0 +1,556 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/CoderCookE/goaround/internal/control"
+	"github.com/CoderCookE/goaround/internal/discovery"
+	"github.com/CoderCookE/goaround/internal/headers"
+	"github.com/CoderCookE/goaround/internal/healthcheck"
+	"github.com/CoderCookE/goaround/internal/pool"
+	"github.com/CoderCookE/goaround/internal/router"
+)
+
+// File is the declarative configuration of goaround. Settings missing from
+// a config file keep the values passed as flags.
+type File struct {
+	Listen       string                  `json:"listen"`
+	Metrics      string                  `json:"metrics"`
+	TLS          TLS                     `json:"tls"`
+	Backends     []Backend               `json:"backends"`
+	NumConns     int                     `json:"num_conns"`
+	MaxRetries   int                     `json:"max_retries"`
+	DrainTimeout Duration                `json:"drain_timeout"`
+	HealthCheck  HealthCheck             `json:"health_check"`
+	Cache        Cache                   `json:"cache"`
+	Control      Control                 `json:"control_socket"`
+	Admin        Admin                   `json:"admin"`
+	Forwarded    Forwarded               `json:"forwarded"`
+	Discovery    Discovery               `json:"discovery"`
+	State        State                   `json:"state"`
+	Pools        map[string]*VirtualPool `json:"pools,omitempty"`
+	Routes       []Route                 `json:"routes,omitempty"`
+	Splits       map[string]*Split       `json:"splits,omitempty"`
+	BlueGreen    *BlueGreen              `json:"blue_green,omitempty"`
+}
+
+type TLS struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type Backend = discovery.Backend
+
+// Forwarded lists the proxies in front of goaround, as CIDRs or addresses,
+// whose X-Forwarded-* and Forwarded headers are passed on to backends.
+type Forwarded struct {
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+}
+
+type HealthCheck struct {
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+}
+
+type Cache struct {
+	Enabled       bool     `json:"enabled"`
+	MaxBytes      int64    `json:"max_bytes"`
+	MaxObjectSize int64    `json:"max_object_size"`
+	Counters      int64    `json:"counters"`
+	TTL           Duration `json:"ttl"`
+	Dir           string   `json:"dir"`
+	DiskMaxBytes  int64    `json:"disk_max_bytes"`
+	Memcached     string   `json:"memcached"`
+	// MemcachedTimeout bounds every request to the memcached server
+	MemcachedTimeout Duration `json:"memcached_timeout"`
+}
+
+type Control struct {
+	Path      string   `json:"path"`
+	Mode      FileMode `json:"mode"`
+	UID       int      `json:"uid"`
+	GID       int      `json:"gid"`
+	AllowUIDs []int    `json:"allow_uids"`
+	AllowGIDs []int    `json:"allow_gids"`
+}
+
+// BlueGreen defines named backend sets of the default pool in place of
+// backends. Only the active set takes requests, the others are health
+// checked on standby until a switch.
+type BlueGreen struct {
+	Active string               `json:"active"`
+	Sets   map[string][]Backend `json:"sets"`
+}
+
+// VirtualPool serves requests for its hosts, ex: api.example.com or
+// *.example.com, from its own backends. Settings left out are taken from the
+// top level, the pool has no cache unless it sets one.
+type VirtualPool struct {
+	Hosts        []string    `json:"hosts"`
+	Backends     []Backend   `json:"backends"`
+	NumConns     int         `json:"num_conns,omitempty"`
+	MaxRetries   *int        `json:"max_retries,omitempty"`
+	DrainTimeout Duration    `json:"drain_timeout,omitempty"`
+	HealthCheck  HealthCheck `json:"health_check"`
+	Cache        *Cache      `json:"cache,omitempty"`
+}
+
+// Route sends matching requests to a pool, the default pool when Pool and
+// Split are empty.
+type Route struct {
+	Host          string            `json:"host,omitempty"`
+	PathPrefix    string            `json:"path_prefix,omitempty"`
+	PathRegex     string            `json:"path_regex,omitempty"`
+	Methods       []string          `json:"methods,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Query         map[string]string `json:"query,omitempty"`
+	StripPrefix   bool              `json:"strip_prefix,omitempty"`
+	ReplacePrefix string            `json:"replace_prefix,omitempty"`
+	Pool          string            `json:"pool,omitempty"`
+	Split         string            `json:"split,omitempty"`
+	Mirror        *Mirror           `json:"mirror,omitempty"`
+	// RequestHeaders change the headers sent to the backend,
+	// ResponseHeaders the ones sent back to the client
+	RequestHeaders  *headers.Rules `json:"request_headers,omitempty"`
+	ResponseHeaders *headers.Rules `json:"response_headers,omitempty"`
+	Rules           []Rule         `json:"rules,omitempty"`
+}
+
+// Rule redirects or rewrites the requests of a route, they are evaluated in
+// order. Path is a regex whose capture groups Redirect and Rewrite may use
+// as $1.
+type Rule struct {
+	Scheme   string `json:"scheme,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Redirect string `json:"redirect,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Rewrite  string `json:"rewrite,omitempty"`
+}
+
+// Mirror copies Percent of a route's requests to a shadow pool and discards
+// the responses. Settings left at zero use the router's defaults.
+type Mirror struct {
+	Pool         string   `json:"pool"`
+	Percent      float64  `json:"percent"`
+	MaxBodyBytes int64    `json:"max_body_bytes,omitempty"`
+	Timeout      Duration `json:"timeout,omitempty"`
+	MaxInFlight  int64    `json:"max_in_flight,omitempty"`
+}
+
+// Split sends Percent of a route's requests to the canary pool and the rest
+// to stable, the default pool when empty. The percent changes at runtime
+// through the control socket, Header and Cookie let clients force a pool.
+type Split struct {
+	Stable  string  `json:"stable,omitempty"`
+	Canary  string  `json:"canary"`
+	Percent float64 `json:"percent"`
+	Header  string  `json:"header,omitempty"`
+	Cookie  string  `json:"cookie,omitempty"`
+}
+
+// Discovery providers add the backends they find to the static ones.
+type Discovery struct {
+	DNS        *DNS           `json:"dns,omitempty"`
+	File       *DiscoveryFile `json:"file,omitempty"`
+	Consul     *Consul        `json:"consul,omitempty"`
+	Kubernetes *Kubernetes    `json:"kubernetes,omitempty"`
+}
+
+type DNS struct {
+	Name     string   `json:"name"`
+	SRV      bool     `json:"srv"`
+	Scheme   string   `json:"scheme"`
+	Port     int      `json:"port"`
+	Server   string   `json:"server"`
+	Interval Duration `json:"interval"`
+}
+
+type DiscoveryFile struct {
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval"`
+	Debounce Duration `json:"debounce"`
+}
+
+type Consul struct {
+	Addr       string   `json:"addr"`
+	Service    string   `json:"service"`
+	Tags       []string `json:"tags"`
+	Datacenter string   `json:"datacenter"`
+	Token      string   `json:"token,omitempty"`
+	Scheme     string   `json:"scheme"`
+	Wait       Duration `json:"wait"`
+}
+
+type Kubernetes struct {
+	Namespace  string `json:"namespace"`
+	Service    string `json:"service"`
+	Port       string `json:"port"`
+	Scheme     string `json:"scheme"`
+	Kubeconfig string `json:"kubeconfig"`
+}
+
+// State is where the runtime backend set is saved, Precedence is state or
+// flags.
+type State struct {
+	Path       string `json:"path"`
+	Precedence string `json:"precedence"`
+}
+
+type Admin struct {
+	Addr  string `json:"addr"`
+	Token string `json:"token,omitempty"`
+}
+
+// Duration is written as a string, ex: 30s
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", string(text))
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// FileMode is written as an octal string, ex: "0600"
+type FileMode os.FileMode
+
+func (m FileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%#o", uint32(m)))
+}
+
+func (m *FileMode) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		// YAML reads an unquoted 0600 as a number
+		var mode uint32
+		if err := json.Unmarshal(data, &mode); err != nil {
+			return fmt.Errorf("invalid file mode %s", string(data))
+		}
+
+		*m = FileMode(mode)
+		return nil
+	}
+
+	mode, err := strconv.ParseUint(text, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid octal file mode %q", text)
+	}
+
+	*m = FileMode(mode)
+	return nil
+}
+
+// Enabled reports whether the listener serves TLS.
+func (t TLS) Enabled() bool {
+	return t.Cert != "" && t.Key != ""
+}
+
+// Pool converts the file to the connection pool's settings.
+func (f *File) Pool() *pool.Config {
+	c := &pool.Config{
+		Backends:     []string{},
+		NumConns:     f.NumConns,
+		MaxRetries:   f.MaxRetries,
+		DrainTimeout: time.Duration(f.DrainTimeout),
+		HealthCheck: healthcheck.Config{
+			Path:     f.HealthCheck.Path,
+			Interval: time.Duration(f.HealthCheck.Interval),
+			Timeout:  time.Duration(f.HealthCheck.Timeout),
+		},
+		EnableCache:        f.Cache.Enabled,
+		CacheMaxBytes:      f.Cache.MaxBytes,
+		CacheMaxObjectSize: f.Cache.MaxObjectSize,
+		CacheCounters:      f.Cache.Counters,
+		CacheTTL:           time.Duration(f.Cache.TTL),
+		CacheDir:           f.Cache.Dir,
+		CacheDiskMaxBytes:  f.Cache.DiskMaxBytes,
+		CacheRemote:        f.Cache.Memcached,
+		CacheRemoteTimeout: time.Duration(f.Cache.MemcachedTimeout),
+		ControlSocket: &control.SocketConfig{
+			Path:      f.Control.Path,
+			Mode:      os.FileMode(f.Control.Mode),
+			UID:       f.Control.UID,
+			GID:       f.Control.GID,
+			AllowUIDs: f.Control.AllowUIDs,
+			AllowGIDs: f.Control.AllowGIDs,
+		},
+		StateFile: f.State.Path,
+	}
+
+	for _, b := range f.Backends {
+		c.Backends = append(c.Backends, b.URL)
+		addWeight(c, b)
+	}
+
+	if bg := f.BlueGreen; bg != nil {
+		c.ActiveSet = bg.Active
+		c.Sets = make(map[string][]string)
+		for set, backends := range bg.Sets {
+			for _, b := range backends {
+				c.Sets[set] = append(c.Sets[set], b.URL)
+				addWeight(c, b)
+			}
+		}
+		c.Backends = append(c.Backends, c.Sets[bg.Active]...)
+	}
+
+	return c
+}
+
+func addWeight(c *pool.Config, b Backend) {
+	if b.Weight > 0 {
+		if c.Weights == nil {
+			c.Weights = make(map[string]int)
+		}
+		c.Weights[b.URL] = b.Weight
+	}
+}
+
+// Router converts a route to the router's, the regexes must be valid.
+func (r Route) Router(h http.Handler) router.Route {
+	route := router.Route{
+		Host:            r.Host,
+		PathPrefix:      r.PathPrefix,
+		Methods:         append([]string(nil), r.Methods...),
+		Headers:         r.Headers,
+		Query:           r.Query,
+		StripPrefix:     r.StripPrefix,
+		ReplacePrefix:   r.ReplacePrefix,
+		RequestHeaders:  r.RequestHeaders,
+		ResponseHeaders: r.ResponseHeaders,
+		Handler:         h,
+	}
+
+	if r.PathRegex != "" {
+		route.PathRegex = regexp.MustCompile(r.PathRegex)
+	}
+
+	for _, rule := range r.Rules {
+		converted := router.Rule{
+			Scheme:   rule.Scheme,
+			Host:     rule.Host,
+			Redirect: rule.Redirect,
+			Status:   rule.Status,
+			Rewrite:  rule.Rewrite,
+		}
+		if rule.Path != "" {
+			converted.Path = regexp.MustCompile(rule.Path)
+		}
+		route.Rules = append(route.Rules, converted)
+	}
+
+	return route
+}
+
+// Router converts a split to the router's, the percent must be valid.
+func (s *Split) Router(name string, stable, canary http.Handler) *router.Split {
+	split := &router.Split{
+		Name:       name,
+		StablePool: s.Stable,
+		CanaryPool: s.Canary,
+		Stable:     stable,
+		Canary:     canary,
+		Header:     s.Header,
+		Cookie:     s.Cookie,
+	}
+
+	split.SetPercent(s.Percent)
+
+	return split
+}
+
+// Router wraps the route's handler in a mirror to the shadow.
+func (m *Mirror) Router(h, shadow http.Handler) *router.Mirror {
+	return &router.Mirror{
+		Pool:        m.Pool,
+		Handler:     h,
+		Shadow:      shadow,
+		Percent:     m.Percent,
+		MaxBody:     m.MaxBodyBytes,
+		Timeout:     time.Duration(m.Timeout),
+		MaxInFlight: m.MaxInFlight,
+	}
+}
+
+// SplitNames returns the names of the splits, sorted.
+func (f *File) SplitNames() []string {
+	names := make([]string, 0, len(f.Splits))
+	for name := range f.Splits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// PoolNames returns the names of the virtual host pools, sorted.
+func (f *File) PoolNames() []string {
+	names := make([]string, 0, len(f.Pools))
+	for name := range f.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// VirtualPool converts a virtual host pool to the connection pool's
+// settings. It has no control socket or state file, those belong to the
+// default pool.
+func (f *File) VirtualPool(name string) *pool.Config {
+	v := f.Pools[name]
+
+	settings := *f
+	settings.Backends = v.Backends
+	settings.Cache = Cache{}
+	settings.State = State{}
+	settings.BlueGreen = nil
+
+	if v.NumConns > 0 {
+		settings.NumConns = v.NumConns
+	}
+
+	if v.MaxRetries != nil {
+		settings.MaxRetries = *v.MaxRetries
+	}
+
+	if v.DrainTimeout > 0 {
+		settings.DrainTimeout = v.DrainTimeout
+	}
+
+	if v.HealthCheck.Path != "" {
+		settings.HealthCheck.Path = v.HealthCheck.Path
+	}
+
+	if v.HealthCheck.Interval > 0 {
+		settings.HealthCheck.Interval = v.HealthCheck.Interval
+	}
+
+	if v.HealthCheck.Timeout > 0 {
+		settings.HealthCheck.Timeout = v.HealthCheck.Timeout
+	}
+
+	if v.Cache != nil {
+		settings.Cache = v.cache(f.Cache)
+	}
+
+	c := settings.Pool()
+	c.Name = name
+	c.ControlSocket = nil
+
+	return c
+}
+
+// cache fills the sizes and TTL the pool's cache leaves out from the top
+// level, tiers are never shared.
+func (v *VirtualPool) cache(top Cache) Cache {
+	c := *v.Cache
+
+	if c.MaxBytes == 0 {
+		c.MaxBytes = top.MaxBytes
+	}
+
+	if c.Counters == 0 {
+		c.Counters = top.Counters
+	}
+
+	if c.TTL == 0 {
+		c.TTL = top.TTL
+	}
+
+	if c.Dir != "" && c.DiskMaxBytes == 0 {
+		c.DiskMaxBytes = top.DiskMaxBytes
+	}
+
+	if c.MemcachedTimeout == 0 {
+		c.MemcachedTimeout = top.MemcachedTimeout
+	}
+
+	return c
+}
+
+func (f *File) AdminConfig() *control.AdminConfig {
+	return &control.AdminConfig{
+		Addr:  f.Admin.Addr,
+		Token: f.Admin.Token,
+	}
+}
+
+// Providers returns the configured discovery providers.
+func (f *File) Providers() []discovery.Provider {
+	var providers []discovery.Provider
+
+	if dns := f.Discovery.DNS; dns != nil {
+		providers = append(providers, &discovery.DNS{
+			Name:     dns.Name,
+			SRV:      dns.SRV,
+			Scheme:   dns.Scheme,
+			Port:     dns.Port,
+			Server:   dns.Server,
+			Interval: time.Duration(dns.Interval),
+		})
+	}
+
+	if file := f.Discovery.File; file != nil {
+		providers = append(providers, &discovery.File{
+			Path:     file.Path,
+			Interval: time.Duration(file.Interval),
+			Debounce: time.Duration(file.Debounce),
+		})
+	}
+
+	if consul := f.Discovery.Consul; consul != nil {
+		providers = append(providers, &discovery.Consul{
+			Addr:       consul.Addr,
+			Service:    consul.Service,
+			Tags:       consul.Tags,
+			Datacenter: consul.Datacenter,
+			Token:      consul.Token,
+			Scheme:     consul.Scheme,
+			Wait:       time.Duration(consul.Wait),
+		})
+	}
+
+	if k := f.Discovery.Kubernetes; k != nil {
+		providers = append(providers, &discovery.Kubernetes{
+			Namespace:  k.Namespace,
+			Service:    k.Service,
+			Port:       k.Port,
+			Scheme:     k.Scheme,
+			Kubeconfig: k.Kubeconfig,
+		})
+	}
+
+	return providers
+}
+
+// Redacted returns a copy of the file that is safe to show, without the
+// admin and Consul tokens.
+func (f *File) Redacted() *File {
+	redacted := *f
+	redacted.Admin.Token = ""
+
+	if f.Discovery.Consul != nil {
+		consul := *f.Discovery.Consul
+		consul.Token = ""
+		redacted.Discovery.Consul = &consul
+	}
+
+	return &redacted
+}
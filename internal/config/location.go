@@ -0,0 +1,220 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	fieldSegment = regexp.MustCompile(`([^.\[\]]+)|\[(\d+)\]`)
+	yamlLine     = regexp.MustCompile(`^yaml: line (\d+): `)
+	unknownField = regexp.MustCompile(`^json: unknown field "(.+)"$`)
+	indexes      = regexp.MustCompile(`\[\d+\]`)
+)
+
+// decodeProblem turns a decoding error into a problem, with the location
+// of the offending setting when the format allows finding it.
+func decodeProblem(err error, source []byte, format string) Problem {
+	problem := Problem{Message: err.Error()}
+
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		if format == JSON {
+			problem.Line, problem.Column = position(source, e.Offset)
+		}
+		return problem
+	case *json.UnmarshalTypeError:
+		problem.Field = e.Field
+		problem.Message = "cannot use " + e.Value + " as " + e.Type.String()
+		if node := parseNode(source, format); node != nil && e.Field != "" {
+			if field, found := mismatched(node, "", e.Field, strings.Fields(e.Value)[0]); found != nil {
+				problem.Field = field
+				problem.Line, problem.Column = found.Line, found.Column
+				return problem
+			}
+		}
+		if format == JSON {
+			problem.Line, problem.Column = position(source, e.Offset)
+		}
+		return problem
+	}
+
+	if match := yamlLine.FindStringSubmatch(problem.Message); match != nil {
+		problem.Line, _ = strconv.Atoi(match[1])
+		problem.Message = strings.TrimPrefix(problem.Message, match[0])
+		return problem
+	}
+
+	if match := unknownField.FindStringSubmatch(problem.Message); match != nil {
+		problem.Field = match[1]
+		problem.Message = "unknown setting"
+		if node := parseNode(source, format); node != nil {
+			if key := findKey(node, match[1]); key != nil {
+				problem.Line, problem.Column = key.Line, key.Column
+			}
+		}
+		return problem
+	}
+
+	if problem.Field != "" {
+		if node := parseNode(source, format); node != nil {
+			if found := lookup(node, problem.Field); found != nil {
+				problem.Line, problem.Column = found.Line, found.Column
+			}
+		}
+	}
+
+	return problem
+}
+
+// locate sets the line and column of problems for settings present in the
+// source, settings that came from flags have no location.
+func locate(invalid *Invalid, source []byte, format string) {
+	node := parseNode(source, format)
+	if node == nil {
+		return
+	}
+
+	for i, p := range invalid.Problems {
+		if found := lookup(node, p.Field); found != nil {
+			invalid.Problems[i].Line = found.Line
+			invalid.Problems[i].Column = found.Column
+		}
+	}
+}
+
+// parseNode reads the source as YAML, which JSON is a subset of. TOML
+// sources have no locations.
+func parseNode(source []byte, format string) *yaml.Node {
+	if format != YAML && format != JSON {
+		return nil
+	}
+
+	node := &yaml.Node{}
+	if err := yaml.Unmarshal(source, node); err != nil || len(node.Content) == 0 {
+		return nil
+	}
+
+	return node.Content[0]
+}
+
+// lookup walks a field path such as backends[1].url and returns the
+// deepest node found along it.
+func lookup(node *yaml.Node, field string) *yaml.Node {
+	var found *yaml.Node
+
+	for _, segment := range fieldSegment.FindAllStringSubmatch(field, -1) {
+		var next *yaml.Node
+
+		if segment[2] != "" {
+			index, _ := strconv.Atoi(segment[2])
+			if node.Kind == yaml.SequenceNode && index < len(node.Content) {
+				next = node.Content[index]
+			}
+		} else if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == segment[1] {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		node, found = next, next
+	}
+
+	return found
+}
+
+// mismatched returns the path and node of the first setting ending in field
+// whose value is of the given JSON type. Errors from values decoded on their
+// own, such as backends, name the field without the path leading to it.
+func mismatched(node *yaml.Node, path, field, value string) (string, *yaml.Node) {
+	bare := indexes.ReplaceAllString(path, "")
+	if (bare == field || strings.HasSuffix(bare, "."+field)) && jsonType(node) == value {
+		return path, node
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+
+			if p, found := mismatched(node.Content[i+1], key, field, value); found != nil {
+				return p, found
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			if p, found := mismatched(item, path+"["+strconv.Itoa(i)+"]", field, value); found != nil {
+				return p, found
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// jsonType names a node's type the way JSON decoding errors do.
+func jsonType(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "object"
+	case yaml.SequenceNode:
+		return "array"
+	}
+
+	switch node.ShortTag() {
+	case "!!int", "!!float":
+		return "number"
+	case "!!bool":
+		return "bool"
+	case "!!null":
+		return "null"
+	default:
+		return "string"
+	}
+}
+
+// findKey returns the first mapping key with the given name.
+func findKey(node *yaml.Node, name string) *yaml.Node {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == name {
+				return node.Content[i]
+			}
+		}
+	}
+
+	for _, child := range node.Content {
+		if key := findKey(child, name); key != nil {
+			return key
+		}
+	}
+
+	return nil
+}
+
+func position(source []byte, offset int64) (line, column int) {
+	if offset > int64(len(source)) {
+		offset = int64(len(source))
+	}
+
+	before := source[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n')
+
+	return line, column
+}
@@ -0,0 +1,928 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/CoderCookE/goaround/internal/forwarded"
+	"github.com/CoderCookE/goaround/internal/router"
+	"github.com/CoderCookE/goaround/internal/state"
+)
+
+const (
+	JSON = "json"
+	YAML = "yaml"
+	TOML = "toml"
+)
+
+// WatchInterval is how often a config file is checked for changes.
+const WatchInterval = time.Second
+
+// Problem is a single invalid setting. Line and Column point at the
+// setting in the config file, they are 0 when it is not known.
+type Problem struct {
+	Field   string
+	Message string
+	Line    int
+	Column  int
+}
+
+func (p Problem) String() string {
+	problem := p.Message
+	if p.Field != "" {
+		problem = p.Field + ": " + problem
+	}
+
+	if p.Line > 0 {
+		problem = fmt.Sprintf("line %d, column %d: %s", p.Line, p.Column, problem)
+	}
+
+	return problem
+}
+
+// Invalid lists every problem found in a config file.
+type Invalid struct {
+	Problems []Problem
+}
+
+func (e *Invalid) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.String()
+	}
+
+	return strings.Join(problems, "; ")
+}
+
+func (e *Invalid) add(field, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Load reads and validates a config file on top of base, the format is
+// picked by the file's extension.
+func Load(path string, base *File) (*File, error) {
+	format, err := Format(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := Parse(data, format, base)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Validate(); err != nil {
+		if invalid, ok := err.(*Invalid); ok {
+			locate(invalid, data, format)
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Format returns the config format matching a file's extension.
+func Format(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return JSON, nil
+	case ".yaml", ".yml":
+		return YAML, nil
+	case ".toml":
+		return TOML, nil
+	default:
+		return "", fmt.Errorf("unknown config format %q, use .json, .yaml, .yml or .toml", filepath.Ext(path))
+	}
+}
+
+// Parse decodes a config in the given format on top of a copy of base.
+// Unknown settings are rejected so typos don't go unnoticed.
+func Parse(data []byte, format string, base *File) (*File, error) {
+	source := data
+	var err error
+
+	switch format {
+	case JSON:
+	case YAML:
+		var values interface{}
+		if err = yaml.Unmarshal(data, &values); err == nil {
+			data, err = json.Marshal(values)
+		}
+	case TOML:
+		values := make(map[string]interface{})
+		if _, err = toml.Decode(string(data), &values); err == nil {
+			data, err = json.Marshal(values)
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format %q", format)
+	}
+
+	if err != nil {
+		return nil, &Invalid{Problems: []Problem{decodeProblem(err, source, format)}}
+	}
+
+	f := &File{}
+	if base != nil {
+		defaults, err := json.Marshal(base)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := decode(defaults, f); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 || bytes.Equal(data, []byte("null")) {
+		return f, nil
+	}
+
+	if err := decode(data, f); err != nil {
+		return nil, &Invalid{Problems: []Problem{decodeProblem(err, source, format)}}
+	}
+
+	return f, nil
+}
+
+func decode(data []byte, f *File) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(f)
+}
+
+// Validate checks every setting and reports all problems at once.
+func (f *File) Validate() error {
+	invalid := &Invalid{}
+
+	checkAddr(invalid, "listen", f.Listen)
+	checkAddr(invalid, "metrics", f.Metrics)
+
+	if (f.TLS.Cert == "") != (f.TLS.Key == "") {
+		invalid.add("tls", "cert and key must be set together")
+	}
+
+	if f.TLS.Enabled() {
+		checkCertificate(invalid, f.TLS)
+	}
+
+	checkPorts(invalid, f)
+	checkBackends(invalid, "backends", f.Backends)
+
+	if f.NumConns < 1 {
+		invalid.add("num_conns", "must be at least 1")
+	}
+
+	if f.MaxRetries < 0 {
+		invalid.add("max_retries", "must not be negative")
+	}
+
+	if f.DrainTimeout < 0 {
+		invalid.add("drain_timeout", "must not be negative")
+	}
+
+	if f.HealthCheck.Path != "" && !strings.HasPrefix(f.HealthCheck.Path, "/") {
+		invalid.add("health_check.path", "must start with /")
+	}
+
+	if f.HealthCheck.Interval < 0 {
+		invalid.add("health_check.interval", "must not be negative")
+	}
+
+	if f.HealthCheck.Timeout < 0 {
+		invalid.add("health_check.timeout", "must not be negative")
+	}
+
+	if f.Cache.Enabled && f.Cache.MaxBytes <= 0 {
+		invalid.add("cache.max_bytes", "must be positive")
+	}
+
+	if f.Cache.MaxObjectSize < 0 {
+		invalid.add("cache.max_object_size", "must not be negative")
+	}
+
+	if f.Cache.Dir != "" && f.Cache.DiskMaxBytes <= 0 {
+		invalid.add("cache.disk_max_bytes", "must be positive")
+	}
+
+	if f.Cache.Memcached != "" {
+		checkAddr(invalid, "cache.memcached", f.Cache.Memcached)
+	}
+
+	if f.Cache.MemcachedTimeout < 0 {
+		invalid.add("cache.memcached_timeout", "must not be negative")
+	}
+
+	if f.Control.Path == "" {
+		invalid.add("control_socket.path", "must be set")
+	}
+
+	checkAddr(invalid, "admin.addr", f.Admin.Addr)
+
+	for i, proxy := range f.Forwarded.TrustedProxies {
+		if _, err := forwarded.Parse([]string{proxy}); err != nil {
+			invalid.add(fmt.Sprintf("forwarded.trusted_proxies[%d]", i), "%s", err.Error())
+		}
+	}
+
+	checkPools(invalid, f)
+	checkRoutes(invalid, f)
+	checkSplits(invalid, f)
+
+	if bg := f.BlueGreen; bg != nil {
+		checkBlueGreen(invalid, f, bg)
+	}
+
+	if f.State.Precedence != state.PreferState && f.State.Precedence != state.PreferFlags {
+		invalid.add("state.precedence", "must be %s or %s", state.PreferState, state.PreferFlags)
+	}
+
+	if dns := f.Discovery.DNS; dns != nil {
+		checkDNS(invalid, dns)
+	}
+
+	if file := f.Discovery.File; file != nil {
+		checkDiscoveryFile(invalid, file)
+	}
+
+	if consul := f.Discovery.Consul; consul != nil {
+		checkConsul(invalid, consul)
+	}
+
+	if k := f.Discovery.Kubernetes; k != nil {
+		checkKubernetes(invalid, k)
+	}
+
+	if len(invalid.Problems) > 0 {
+		return invalid
+	}
+
+	return nil
+}
+
+func checkBackends(invalid *Invalid, prefix string, backends []Backend) {
+	seen := make(map[string]bool)
+	for i, b := range backends {
+		field := fmt.Sprintf("%s[%d]", prefix, i)
+
+		if err := checkURL(b.URL); err != nil {
+			invalid.add(field+".url", err.Error())
+		}
+
+		if seen[b.URL] {
+			invalid.add(field+".url", "duplicate backend %s", b.URL)
+		}
+		seen[b.URL] = true
+
+		if b.Weight < 0 {
+			invalid.add(field+".weight", "must not be negative")
+		}
+	}
+}
+
+// checkPools makes sure every host is routed to one pool and that pools
+// don't share an on-disk cache.
+func checkPools(invalid *Invalid, f *File) {
+	hosts := make(map[string]string)
+	dirs := make(map[string]string)
+	if f.Cache.Dir != "" {
+		dirs[f.Cache.Dir] = "the default pool"
+	}
+
+	for _, name := range f.PoolNames() {
+		v := f.Pools[name]
+		field := "pools." + name
+
+		if v == nil {
+			invalid.add(field, "must not be empty")
+			continue
+		}
+
+		if len(v.Hosts) == 0 && !f.routed(name) {
+			invalid.add(field+".hosts", "must be set unless a route uses the pool")
+		}
+
+		for i, host := range v.Hosts {
+			pattern, err := router.Pattern(host)
+			if err != nil {
+				invalid.add(fmt.Sprintf("%s.hosts[%d]", field, i), err.Error())
+				continue
+			}
+
+			if other, ok := hosts[pattern]; ok {
+				invalid.add(fmt.Sprintf("%s.hosts[%d]", field, i), "duplicate host %s, also in pool %s", host, other)
+			}
+			hosts[pattern] = name
+		}
+
+		checkBackends(invalid, field+".backends", v.Backends)
+
+		if v.NumConns < 0 {
+			invalid.add(field+".num_conns", "must not be negative")
+		}
+
+		if v.MaxRetries != nil && *v.MaxRetries < 0 {
+			invalid.add(field+".max_retries", "must not be negative")
+		}
+
+		if v.DrainTimeout < 0 {
+			invalid.add(field+".drain_timeout", "must not be negative")
+		}
+
+		if v.HealthCheck.Path != "" && !strings.HasPrefix(v.HealthCheck.Path, "/") {
+			invalid.add(field+".health_check.path", "must start with /")
+		}
+
+		if v.HealthCheck.Interval < 0 || v.HealthCheck.Timeout < 0 {
+			invalid.add(field+".health_check", "interval and timeout must not be negative")
+		}
+
+		if v.Cache == nil {
+			continue
+		}
+
+		if v.Cache.MaxBytes < 0 || v.Cache.MaxObjectSize < 0 || v.Cache.DiskMaxBytes < 0 {
+			invalid.add(field+".cache", "sizes must not be negative")
+		}
+
+		if v.Cache.Memcached != "" {
+			checkAddr(invalid, field+".cache.memcached", v.Cache.Memcached)
+		}
+
+		if v.Cache.MemcachedTimeout < 0 {
+			invalid.add(field+".cache.memcached_timeout", "must not be negative")
+		}
+
+		if v.Cache.Dir != "" {
+			if other, ok := dirs[v.Cache.Dir]; ok {
+				invalid.add(field+".cache.dir", "already used by %s", other)
+			}
+			dirs[v.Cache.Dir] = "pool " + name
+		}
+	}
+}
+
+func (f *File) routed(pool string) bool {
+	for _, r := range f.Routes {
+		if r.Pool == pool || (r.Mirror != nil && r.Mirror.Pool == pool) {
+			return true
+		}
+	}
+
+	for _, s := range f.Splits {
+		if s != nil && (s.Stable == pool || s.Canary == pool) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRoutes makes sure every route can be added to the router and sends
+// requests to a configured pool.
+func checkRoutes(invalid *Invalid, f *File) {
+	for i, r := range f.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+
+		if r.Pool != "" && f.Pools[r.Pool] == nil {
+			invalid.add(field+".pool", "unknown pool %q", r.Pool)
+		}
+
+		if r.Split != "" && r.Pool != "" {
+			invalid.add(field, "pool and split can't be used together")
+		} else if r.Split != "" && f.Splits[r.Split] == nil {
+			invalid.add(field+".split", "unknown split %q", r.Split)
+		}
+
+		if m := r.Mirror; m != nil {
+			if m.Pool != "" && f.Pools[m.Pool] == nil {
+				invalid.add(field+".mirror.pool", "unknown pool %q", m.Pool)
+			} else if m.Pool == r.Pool && r.Split == "" {
+				invalid.add(field+".mirror.pool", "must not be the route's pool")
+			}
+
+			if m.Percent < 0 || m.Percent > 100 {
+				invalid.add(field+".mirror.percent", "must be between 0 and 100")
+			}
+
+			if m.MaxBodyBytes < 0 || m.Timeout < 0 || m.MaxInFlight < 0 {
+				invalid.add(field+".mirror", "max_body_bytes, timeout and max_in_flight must not be negative")
+			}
+		}
+
+		if r.RequestHeaders != nil {
+			if err := r.RequestHeaders.Check(); err != nil {
+				invalid.add(field+".request_headers", "%s", err.Error())
+			}
+		}
+
+		if r.ResponseHeaders != nil {
+			if err := r.ResponseHeaders.Check(); err != nil {
+				invalid.add(field+".response_headers", "%s", err.Error())
+			}
+		}
+
+		if r.PathRegex != "" {
+			if _, err := regexp.Compile(r.PathRegex); err != nil {
+				invalid.add(field+".path_regex", "%s", err.Error())
+				continue
+			}
+		}
+
+		compiles := true
+		for j, rule := range r.Rules {
+			if rule.Scheme != "" && rule.Scheme != "http" && rule.Scheme != "https" {
+				invalid.add(fmt.Sprintf("%s.rules[%d].scheme", field, j), "must be http or https")
+			}
+
+			if rule.Path != "" {
+				if _, err := regexp.Compile(rule.Path); err != nil {
+					invalid.add(fmt.Sprintf("%s.rules[%d].path", field, j), "%s", err.Error())
+					compiles = false
+				}
+			}
+		}
+
+		if !compiles {
+			continue
+		}
+
+		for j, method := range r.Methods {
+			if method == "" || strings.ContainsAny(method, " \t/") {
+				invalid.add(fmt.Sprintf("%s.methods[%d]", field, j), "invalid method %q", method)
+			}
+		}
+
+		if r.ReplacePrefix != "" && !strings.HasPrefix(r.ReplacePrefix, "/") {
+			invalid.add(field+".replace_prefix", "must start with /")
+		}
+
+		if err := router.New(nil).Route(r.Router(nil)); err != nil {
+			invalid.add(field, "%s", err.Error())
+		}
+	}
+}
+
+// checkSplits makes sure splits send requests to configured pools.
+func checkSplits(invalid *Invalid, f *File) {
+	for _, name := range f.SplitNames() {
+		s := f.Splits[name]
+		field := "splits." + name
+
+		if s == nil {
+			invalid.add(field, "must not be empty")
+			continue
+		}
+
+		if s.Canary == "" {
+			invalid.add(field+".canary", "must be set")
+		} else if f.Pools[s.Canary] == nil {
+			invalid.add(field+".canary", "unknown pool %q", s.Canary)
+		}
+
+		if s.Stable != "" && f.Pools[s.Stable] == nil {
+			invalid.add(field+".stable", "unknown pool %q", s.Stable)
+		}
+
+		if s.Canary != "" && s.Canary == s.Stable {
+			invalid.add(field+".canary", "must not be the stable pool")
+		}
+
+		if s.Percent < 0 || s.Percent > 100 {
+			invalid.add(field+".percent", "must be between 0 and 100")
+		}
+
+		if strings.ContainsAny(s.Header, " \t:") {
+			invalid.add(field+".header", "invalid header %q", s.Header)
+		}
+
+		if strings.ContainsAny(s.Cookie, " \t;=,") {
+			invalid.add(field+".cookie", "invalid cookie %q", s.Cookie)
+		}
+	}
+}
+
+// checkBlueGreen makes sure the active set exists and every backend is in
+// one set. Sets replace backends, discovery and the state file.
+func checkBlueGreen(invalid *Invalid, f *File, bg *BlueGreen) {
+	if len(f.Backends) > 0 {
+		invalid.add("backends", "can't be used with blue_green")
+	}
+
+	if len(f.Providers()) > 0 {
+		invalid.add("discovery", "can't be used with blue_green")
+	}
+
+	if f.State.Path != "" {
+		invalid.add("state.path", "can't be used with blue_green")
+	}
+
+	if len(bg.Sets) < 2 {
+		invalid.add("blue_green.sets", "must define at least two sets")
+	}
+
+	if _, ok := bg.Sets[bg.Active]; !ok {
+		invalid.add("blue_green.active", "unknown set %q", bg.Active)
+	}
+
+	names := make([]string, 0, len(bg.Sets))
+	for name := range bg.Sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	seen := make(map[string]string)
+	for _, name := range names {
+		field := "blue_green.sets." + name
+		if len(bg.Sets[name]) == 0 {
+			invalid.add(field, "must not be empty")
+		}
+
+		checkBackends(invalid, field, bg.Sets[name])
+
+		for i, b := range bg.Sets[name] {
+			if other, ok := seen[b.URL]; ok {
+				invalid.add(fmt.Sprintf("%s[%d]", field, i), "%s is already in set %s", b.URL, other)
+			}
+			seen[b.URL] = name
+		}
+	}
+}
+
+func checkAddr(invalid *Invalid, field, addr string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		invalid.add(field, "invalid address %q", addr)
+	}
+}
+
+func checkCertificate(invalid *Invalid, t TLS) {
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		invalid.add("tls.cert", "%s", err.Error())
+		return
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		invalid.add("tls.cert", "%s", err.Error())
+		return
+	}
+
+	if time.Now().After(leaf.NotAfter) {
+		invalid.add("tls.cert", "certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// checkPorts reports listeners that would bind the same port, the admin API
+// is only started when it has a token.
+func checkPorts(invalid *Invalid, f *File) {
+	listeners := []struct{ field, addr string }{
+		{"listen", f.Listen},
+		{"metrics", f.Metrics},
+	}
+
+	if f.Admin.Token != "" {
+		listeners = append(listeners, struct{ field, addr string }{"admin.addr", f.Admin.Addr})
+	}
+
+	for i, l := range listeners {
+		host, port, err := net.SplitHostPort(l.addr)
+		if err != nil || port == "0" {
+			continue
+		}
+
+		for _, other := range listeners[:i] {
+			otherHost, otherPort, err := net.SplitHostPort(other.addr)
+			if err != nil || otherPort != port {
+				continue
+			}
+
+			if host == otherHost || wildcard(host) || wildcard(otherHost) {
+				invalid.add(l.field, "port %s is already used by %s", port, other.field)
+			}
+		}
+	}
+}
+
+func wildcard(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
+func checkDNS(invalid *Invalid, dns *DNS) {
+	if dns.Name == "" {
+		invalid.add("discovery.dns.name", "must be set")
+	}
+
+	if dns.Scheme != "" && dns.Scheme != "http" && dns.Scheme != "https" {
+		invalid.add("discovery.dns.scheme", "must be http or https")
+	}
+
+	if dns.Port < 0 || dns.Port > 65535 {
+		invalid.add("discovery.dns.port", "invalid port %d", dns.Port)
+	}
+
+	if dns.Server != "" {
+		checkAddr(invalid, "discovery.dns.server", dns.Server)
+	}
+
+	if dns.Interval < 0 {
+		invalid.add("discovery.dns.interval", "must not be negative")
+	}
+}
+
+func checkDiscoveryFile(invalid *Invalid, file *DiscoveryFile) {
+	if file.Path == "" {
+		invalid.add("discovery.file.path", "must be set")
+	}
+
+	if file.Interval < 0 {
+		invalid.add("discovery.file.interval", "must not be negative")
+	}
+
+	if file.Debounce < 0 {
+		invalid.add("discovery.file.debounce", "must not be negative")
+	}
+}
+
+func checkConsul(invalid *Invalid, consul *Consul) {
+	if consul.Service == "" {
+		invalid.add("discovery.consul.service", "must be set")
+	}
+
+	if consul.Addr != "" {
+		if err := checkURL(consul.Addr); err != nil {
+			invalid.add("discovery.consul.addr", "invalid url %q", consul.Addr)
+		}
+	}
+
+	if consul.Scheme != "" && consul.Scheme != "http" && consul.Scheme != "https" {
+		invalid.add("discovery.consul.scheme", "must be http or https")
+	}
+
+	if consul.Wait < 0 {
+		invalid.add("discovery.consul.wait", "must not be negative")
+	}
+}
+
+func checkKubernetes(invalid *Invalid, k *Kubernetes) {
+	if k.Service == "" {
+		invalid.add("discovery.kubernetes.service", "must be set")
+	}
+
+	if k.Scheme != "" && k.Scheme != "http" && k.Scheme != "https" {
+		invalid.add("discovery.kubernetes.scheme", "must be http or https")
+	}
+
+	if k.Kubeconfig != "" {
+		if _, err := os.Stat(k.Kubeconfig); err != nil {
+			invalid.add("discovery.kubernetes.kubeconfig", "%s", err.Error())
+		}
+	}
+}
+
+func checkURL(backend string) error {
+	endpoint, err := url.ParseRequestURI(backend)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid backend url %q", backend)
+	}
+
+	return nil
+}
+
+// RestartOnly resets the settings that cannot change at runtime to their
+// running values and returns the names of those that differed.
+func (f *File) RestartOnly(running *File) []string {
+	var changed []string
+
+	if f.Listen != running.Listen {
+		changed = append(changed, "listen")
+		f.Listen = running.Listen
+	}
+
+	if f.Metrics != running.Metrics {
+		changed = append(changed, "metrics")
+		f.Metrics = running.Metrics
+	}
+
+	if f.NumConns != running.NumConns {
+		changed = append(changed, "num_conns")
+		f.NumConns = running.NumConns
+	}
+
+	if f.Cache != running.Cache {
+		changed = append(changed, "cache")
+		f.Cache = running.Cache
+	}
+
+	if !reflect.DeepEqual(f.Control, running.Control) {
+		changed = append(changed, "control_socket")
+		f.Control = running.Control
+	}
+
+	if f.Admin != running.Admin {
+		changed = append(changed, "admin")
+		f.Admin = running.Admin
+	}
+
+	if !reflect.DeepEqual(f.Forwarded, running.Forwarded) {
+		changed = append(changed, "forwarded")
+		f.Forwarded = running.Forwarded
+	}
+
+	if !reflect.DeepEqual(f.Discovery, running.Discovery) {
+		changed = append(changed, "discovery")
+		f.Discovery = running.Discovery
+	}
+
+	if f.State != running.State {
+		changed = append(changed, "state")
+		f.State = running.State
+	}
+
+	if f.TLS.Enabled() != running.TLS.Enabled() {
+		changed = append(changed, "tls")
+		f.TLS = running.TLS
+	}
+
+	changed = append(changed, f.restartOnlySplits(running)...)
+
+	// the active set is switched at runtime, the sets take a restart
+	if f.BlueGreen == nil || running.BlueGreen == nil {
+		if f.BlueGreen != running.BlueGreen {
+			changed = append(changed, "blue_green")
+			f.BlueGreen = running.BlueGreen
+		}
+	} else if !reflect.DeepEqual(f.BlueGreen.Sets, running.BlueGreen.Sets) {
+		changed = append(changed, "blue_green.sets")
+		f.BlueGreen.Sets = running.BlueGreen.Sets
+	}
+
+	changed = append(changed, f.restartOnlyPools(running)...)
+
+	// routes change at runtime, unless one needs a pool or split that only
+	// starts on restart
+	if !reflect.DeepEqual(f.Routes, running.Routes) && !f.routesRunning() {
+		changed = append(changed, "routes")
+		f.Routes = running.Routes
+	}
+
+	return changed
+}
+
+// routesRunning reports whether every pool and split the routes send
+// requests to is in the file.
+func (f *File) routesRunning() bool {
+	for _, route := range f.Routes {
+		if _, ok := f.Pools[route.Pool]; route.Pool != "" && !ok {
+			return false
+		}
+
+		if _, ok := f.Splits[route.Split]; route.Split != "" && !ok {
+			return false
+		}
+
+		if route.Mirror == nil || route.Mirror.Pool == "" {
+			continue
+		}
+
+		if _, ok := f.Pools[route.Mirror.Pool]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// restartOnlySplits keeps the running splits, only their percentages change
+// at runtime.
+func (f *File) restartOnlySplits(running *File) []string {
+	var changed []string
+
+	splits := make(map[string]*Split)
+	for _, name := range running.SplitNames() {
+		current := running.Splits[name]
+
+		s, ok := f.Splits[name]
+		if !ok || s == nil {
+			changed = append(changed, "splits."+name)
+			splits[name] = current
+			continue
+		}
+
+		kept := *current
+		kept.Percent = s.Percent
+		if *s != kept {
+			changed = append(changed, "splits."+name)
+		}
+		splits[name] = &kept
+	}
+
+	for _, name := range f.SplitNames() {
+		if _, ok := running.Splits[name]; !ok {
+			changed = append(changed, "splits."+name)
+		}
+	}
+
+	if len(splits) == 0 {
+		splits = nil
+	}
+	f.Splits = splits
+
+	return changed
+}
+
+// restartOnlyPools keeps the running set of pools, with their hosts,
+// connections and caches, other pool settings change at runtime.
+func (f *File) restartOnlyPools(running *File) []string {
+	var changed []string
+
+	pools := make(map[string]*VirtualPool)
+	for _, name := range running.PoolNames() {
+		current := running.Pools[name]
+
+		v, ok := f.Pools[name]
+		if !ok || v == nil {
+			changed = append(changed, "pools."+name)
+			pools[name] = current
+			continue
+		}
+
+		updated := *v
+		if !reflect.DeepEqual(updated.Hosts, current.Hosts) {
+			changed = append(changed, "pools."+name+".hosts")
+			updated.Hosts = current.Hosts
+		}
+
+		if updated.NumConns != current.NumConns {
+			changed = append(changed, "pools."+name+".num_conns")
+			updated.NumConns = current.NumConns
+		}
+
+		if !reflect.DeepEqual(updated.Cache, current.Cache) {
+			changed = append(changed, "pools."+name+".cache")
+			updated.Cache = current.Cache
+		}
+
+		pools[name] = &updated
+	}
+
+	for _, name := range f.PoolNames() {
+		if _, ok := running.Pools[name]; !ok {
+			changed = append(changed, "pools."+name)
+		}
+	}
+
+	if len(pools) == 0 {
+		pools = nil
+	}
+	f.Pools = pools
+
+	return changed
+}
+
+// Watch calls changed whenever the file's size or modification time
+// changes, until done is closed.
+func Watch(path string, interval time.Duration, done <-chan bool, changed func()) {
+	last, _ := os.Stat(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+
+			if last == nil || info.Size() != last.Size() || !info.ModTime().Equal(last.ModTime()) {
+				last = info
+				changed()
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,640 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CoderCookE/goaround/internal/assert"
+	"github.com/CoderCookE/goaround/internal/headers"
+)
+
+func base() *File {
+	return &File{
+		Listen:      ":3000",
+		Metrics:     ":8080",
+		NumConns:    3,
+		HealthCheck: HealthCheck{Path: "/health", Interval: Duration(10 * time.Second)},
+		Cache:       Cache{MaxBytes: 1 << 30, TTL: Duration(5 * time.Minute)},
+		Control:     Control{Path: "/tmp/goaround.sock", Mode: 0600, UID: -1, GID: -1},
+		Admin:       Admin{Addr: "127.0.0.1:8081", Token: "secret"},
+		State:       State{Precedence: "state"},
+	}
+}
+
+func TestParse(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	files := map[string]string{
+		JSON: `{
+  "listen": ":8443",
+  "backends": ["http://localhost:9000", {"url": "http://localhost:9001", "weight": 3}],
+  "drain_timeout": "45s",
+  "health_check": {"path": "/status"},
+  "cache": {"enabled": true, "ttl": "1m"},
+  "control_socket": {"mode": "0660"}
+}`,
+		YAML: `
+listen: ":8443"
+backends:
+  - http://localhost:9000
+  - url: http://localhost:9001
+    weight: 3
+drain_timeout: 45s
+health_check:
+  path: /status
+cache:
+  enabled: true
+  ttl: 1m
+control_socket:
+  mode: 0660
+`,
+		TOML: `
+listen = ":8443"
+drain_timeout = "45s"
+backends = ["http://localhost:9000"]
+
+[health_check]
+path = "/status"
+
+[cache]
+enabled = true
+ttl = "1m"
+
+[control_socket]
+mode = "0660"
+`,
+	}
+
+	for format, data := range files {
+		format, data := format, data
+
+		t.Run("reads "+format+" on top of the defaults", func(t *testing.T) {
+			f, err := Parse([]byte(data), format, base())
+			assertion.Equal(err, nil)
+			assertion.Equal(f.Listen, ":8443")
+			assertion.Equal(f.Metrics, ":8080")
+			assertion.Equal(f.Backends[0].URL, "http://localhost:9000")
+			assertion.Equal(f.DrainTimeout, Duration(45*time.Second))
+			assertion.Equal(f.HealthCheck.Path, "/status")
+			assertion.Equal(f.HealthCheck.Interval, Duration(10*time.Second))
+			assertion.True(f.Cache.Enabled)
+			assertion.Equal(f.Cache.TTL, Duration(time.Minute))
+			assertion.Equal(f.Cache.MaxBytes, int64(1<<30))
+			assertion.Equal(f.Control.Mode, FileMode(0660))
+			assertion.Equal(f.Control.UID, -1)
+			assertion.Equal(f.Validate(), nil)
+
+			if format != TOML {
+				assertion.Equal(f.Backends[1].Weight, 3)
+				assertion.Equal(f.Pool().Weights["http://localhost:9001"], 3)
+			}
+		})
+	}
+
+	t.Run("does not change the defaults", func(t *testing.T) {
+		defaults := base()
+		defaults.Backends = []Backend{{URL: "http://localhost:7000"}}
+
+		_, err := Parse([]byte(`{"backends": ["http://localhost:9000"]}`), JSON, defaults)
+		assertion.Equal(err, nil)
+		assertion.Equal(defaults.Backends[0].URL, "http://localhost:7000")
+	})
+
+	t.Run("rejects unknown settings", func(t *testing.T) {
+		_, err := Parse([]byte("bakends:\n  - http://localhost:9000\n"), YAML, base())
+		assertion.Equal(err.Error(), "line 1, column 1: bakends: unknown setting")
+
+		_, err = Parse([]byte(`{"drain_timeout": "soon"}`), JSON, base())
+		assertion.StringContains(err.Error(), `invalid duration "soon"`)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	t.Run("reports every problem", func(t *testing.T) {
+		f := base()
+		f.Listen = "3000"
+		f.TLS.Cert = "cert.pem"
+		f.Backends = []Backend{{URL: "localhost:9000"}, {URL: "http://localhost:9001", Weight: -1}, {URL: "http://localhost:9001"}}
+		f.NumConns = 0
+
+		err := f.Validate()
+		problems := err.(*Invalid).Problems
+		assertion.Equal(len(problems), 6)
+		assertion.StringContains(err.Error(), `listen: invalid address "3000"`)
+		assertion.StringContains(err.Error(), "tls: cert and key must be set together")
+		assertion.StringContains(err.Error(), `backends[0].url: invalid backend url "localhost:9000"`)
+		assertion.StringContains(err.Error(), "backends[1].weight: must not be negative")
+		assertion.StringContains(err.Error(), "backends[2].url: duplicate backend http://localhost:9001")
+		assertion.StringContains(err.Error(), "num_conns: must be at least 1")
+	})
+
+	t.Run("checks virtual host pools", func(t *testing.T) {
+		retries := -1
+		f := base()
+		f.Cache.Dir = "/var/cache/goaround"
+		f.Cache.DiskMaxBytes = 10 << 30
+		f.Pools = map[string]*VirtualPool{
+			"api": {Hosts: []string{"api.example.com", "*.example.com"}, Backends: []Backend{{URL: "localhost:9000"}}},
+			"web": {Hosts: []string{"API.example.com", "www.*.com"}, MaxRetries: &retries, Cache: &Cache{Dir: "/var/cache/goaround"}},
+			"old": {},
+		}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 6)
+		assertion.StringContains(err.Error(), `pools.api.backends[0].url: invalid backend url "localhost:9000"`)
+		assertion.StringContains(err.Error(), "pools.old.hosts: must be set")
+		assertion.StringContains(err.Error(), "pools.web.hosts[0]: duplicate host API.example.com, also in pool api")
+		assertion.StringContains(err.Error(), `pools.web.hosts[1]: invalid host "www.*.com"`)
+		assertion.StringContains(err.Error(), "pools.web.max_retries: must not be negative")
+		assertion.StringContains(err.Error(), "pools.web.cache.dir: already used by the default pool")
+	})
+
+	t.Run("checks routes", func(t *testing.T) {
+		f := base()
+		f.Pools = map[string]*VirtualPool{"users": {Backends: []Backend{{URL: "http://localhost:9000"}}}}
+		f.Routes = []Route{
+			{PathPrefix: "/api/users", StripPrefix: true, Pool: "users"},
+			{PathRegex: "^/api/(users", Pool: "orders"},
+			{PathRegex: "^/v[0-9]+/", ReplacePrefix: "v2", Methods: []string{"GET POST"}},
+			{Host: "*.*.example.com"},
+		}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 6)
+		assertion.StringContains(err.Error(), `routes[1].pool: unknown pool "orders"`)
+		assertion.StringContains(err.Error(), "routes[1].path_regex: error parsing regexp: missing closing ): `^/api/(users`")
+		assertion.StringContains(err.Error(), `routes[2].methods[0]: invalid method "GET POST"`)
+		assertion.StringContains(err.Error(), "routes[2].replace_prefix: must start with /")
+		assertion.StringContains(err.Error(), "routes[2]: strip and replace prefix require a path prefix")
+		assertion.StringContains(err.Error(), `routes[3]: invalid host "*.*.example.com"`)
+
+		f.Routes = f.Routes[:1]
+		assertion.Equal(f.Validate(), nil)
+	})
+
+	t.Run("checks splits", func(t *testing.T) {
+		f := base()
+		f.Pools = map[string]*VirtualPool{"canary": {Backends: []Backend{{URL: "http://localhost:9000"}}}}
+		f.Splits = map[string]*Split{
+			"checkout": {Canary: "canary", Percent: 10, Header: "X-Canary", Cookie: "canary"},
+			"search":   {Stable: "search", Percent: 120, Cookie: "a=b"},
+			"orders":   {Stable: "canary", Canary: "canary"},
+		}
+		f.Routes = []Route{
+			{PathPrefix: "/checkout", Split: "checkout"},
+			{PathPrefix: "/cart", Split: "cart"},
+			{PathPrefix: "/orders", Split: "orders", Pool: "canary"},
+		}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 7)
+		assertion.StringContains(err.Error(), `routes[1].split: unknown split "cart"`)
+		assertion.StringContains(err.Error(), "routes[2]: pool and split can't be used together")
+		assertion.StringContains(err.Error(), "splits.orders.canary: must not be the stable pool")
+		assertion.StringContains(err.Error(), "splits.search.canary: must be set")
+		assertion.StringContains(err.Error(), `splits.search.stable: unknown pool "search"`)
+		assertion.StringContains(err.Error(), "splits.search.percent: must be between 0 and 100")
+		assertion.StringContains(err.Error(), `splits.search.cookie: invalid cookie "a=b"`)
+
+		delete(f.Splits, "search")
+		delete(f.Splits, "orders")
+		f.Routes = f.Routes[:1]
+		assertion.Equal(f.Validate(), nil)
+	})
+
+	t.Run("checks mirrors", func(t *testing.T) {
+		f := base()
+		f.Pools = map[string]*VirtualPool{"shadow": {Backends: []Backend{{URL: "http://localhost:9000"}}}}
+		f.Routes = []Route{
+			{PathPrefix: "/orders", Mirror: &Mirror{Pool: "shadow", Percent: 10, Timeout: Duration(time.Second)}},
+			{PathPrefix: "/search", Mirror: &Mirror{Pool: "search", Percent: 150}},
+			{PathPrefix: "/cart", Pool: "shadow", Mirror: &Mirror{Pool: "shadow", MaxInFlight: -1}},
+		}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 4)
+		assertion.StringContains(err.Error(), `routes[1].mirror.pool: unknown pool "search"`)
+		assertion.StringContains(err.Error(), "routes[1].mirror.percent: must be between 0 and 100")
+		assertion.StringContains(err.Error(), "routes[2].mirror.pool: must not be the route's pool")
+		assertion.StringContains(err.Error(), "routes[2].mirror: max_body_bytes, timeout and max_in_flight must not be negative")
+
+		f.Routes = f.Routes[:1]
+		assertion.Equal(f.Validate(), nil)
+	})
+
+	t.Run("checks header rules", func(t *testing.T) {
+		f := base()
+		f.Routes = []Route{
+			{PathPrefix: "/shop", RequestHeaders: &headers.Rules{Set: map[string]string{"X-Forwarded-Proto": "{scheme}"}}, ResponseHeaders: &headers.Rules{Remove: []string{"Server"}}},
+			{PathPrefix: "/orders", RequestHeaders: &headers.Rules{Add: map[string]string{"X-Client": "{client}"}}},
+			{PathPrefix: "/cart", ResponseHeaders: &headers.Rules{Set: map[string]string{"X Backend": "{backend}"}}},
+		}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 2)
+		assertion.StringContains(err.Error(), "routes[1].request_headers: X-Client: unknown variable {client}")
+		assertion.StringContains(err.Error(), `routes[2].response_headers: invalid header "X Backend"`)
+
+		f.Routes = f.Routes[:1]
+		assertion.Equal(f.Validate(), nil)
+	})
+
+	t.Run("checks rewrite rules", func(t *testing.T) {
+		f := base()
+		f.Routes = []Route{
+			{Host: "www.example.com", Rules: []Rule{{Redirect: "https://example.com{path}", Status: 301}}},
+			{PathPrefix: "/blog", Rules: []Rule{{Path: `^/blog/(\d+)$`, Redirect: "/posts/$1", Status: 308}, {Path: "^/blog/(.*)$", Rewrite: "/articles/$1"}}},
+			{Rules: []Rule{{Scheme: "ftp", Path: "^/(", Redirect: "/"}}},
+			{Rules: []Rule{{Redirect: "/new", Status: 200}}},
+		}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 3)
+		assertion.StringContains(err.Error(), "routes[2].rules[0].scheme: must be http or https")
+		assertion.StringContains(err.Error(), "routes[2].rules[0].path: error parsing regexp")
+		assertion.StringContains(err.Error(), "routes[3]: rules[0]: invalid status 200, must be 301, 302, 307 or 308")
+
+		f.Routes = f.Routes[:2]
+		assertion.Equal(f.Validate(), nil)
+	})
+
+	t.Run("checks blue green sets", func(t *testing.T) {
+		f := base()
+		f.Backends = []Backend{{URL: "http://localhost:9000"}}
+		f.State.Path = "/var/lib/goaround/state.json"
+		f.BlueGreen = &BlueGreen{
+			Active: "red",
+			Sets: map[string][]Backend{
+				"blue":  {{URL: "http://localhost:9001"}},
+				"green": {{URL: "http://localhost:9001"}, {URL: "localhost:9002"}},
+			},
+		}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 5)
+		assertion.StringContains(err.Error(), "backends: can't be used with blue_green")
+		assertion.StringContains(err.Error(), "state.path: can't be used with blue_green")
+		assertion.StringContains(err.Error(), `blue_green.active: unknown set "red"`)
+		assertion.StringContains(err.Error(), "blue_green.sets.green[0]: http://localhost:9001 is already in set blue")
+		assertion.StringContains(err.Error(), `blue_green.sets.green[1].url: invalid backend url "localhost:9002"`)
+
+		f.Backends = nil
+		f.State.Path = ""
+		f.BlueGreen = &BlueGreen{
+			Active: "green",
+			Sets: map[string][]Backend{
+				"blue":  {{URL: "http://localhost:9001"}},
+				"green": {{URL: "http://localhost:9002", Weight: 2}},
+			},
+		}
+		assertion.Equal(f.Validate(), nil)
+
+		c := f.Pool()
+		assertion.Equal(c.ActiveSet, "green")
+		assertion.Equal(strings.Join(c.Backends, ","), "http://localhost:9002")
+		assertion.Equal(c.Sets["blue"][0], "http://localhost:9001")
+		assertion.Equal(c.Weights["http://localhost:9002"], 2)
+
+		f.Pools = map[string]*VirtualPool{"api": {Hosts: []string{"api.example.com"}}}
+		assertion.True(f.VirtualPool("api").Sets == nil)
+	})
+
+	t.Run("checks state precedence", func(t *testing.T) {
+		f := base()
+		f.State = State{Path: "/var/lib/goaround/state.json", Precedence: "file"}
+
+		err := f.Validate()
+		assertion.Equal(err.Error(), "state.precedence: must be state or flags")
+	})
+
+	t.Run("checks trusted proxies", func(t *testing.T) {
+		f := base()
+		f.Forwarded = Forwarded{TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1", "10.0.0.0/40", "lb.local"}}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 2)
+		assertion.StringContains(err.Error(), `forwarded.trusted_proxies[2]: invalid CIDR "10.0.0.0/40"`)
+		assertion.StringContains(err.Error(), `forwarded.trusted_proxies[3]: invalid address "lb.local"`)
+
+		f.Forwarded.TrustedProxies = f.Forwarded.TrustedProxies[:2]
+		assertion.Equal(f.Validate(), nil)
+	})
+
+	t.Run("checks dns discovery", func(t *testing.T) {
+		f := base()
+		f.Discovery.DNS = &DNS{Scheme: "ftp", Server: "127.0.0.1"}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 3)
+		assertion.StringContains(err.Error(), "discovery.dns.name: must be set")
+		assertion.StringContains(err.Error(), "discovery.dns.scheme: must be http or https")
+		assertion.StringContains(err.Error(), `discovery.dns.server: invalid address "127.0.0.1"`)
+
+		f.Discovery.DNS = &DNS{Name: "_http._tcp.backend.service", SRV: true}
+		assertion.Equal(f.Validate(), nil)
+		assertion.Equal(f.Providers()[0].String(), "dns srv _http._tcp.backend.service")
+	})
+
+	t.Run("checks file discovery", func(t *testing.T) {
+		f := base()
+		f.Discovery.File = &DiscoveryFile{Debounce: Duration(-time.Second)}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 2)
+		assertion.StringContains(err.Error(), "discovery.file.path: must be set")
+		assertion.StringContains(err.Error(), "discovery.file.debounce: must not be negative")
+
+		f.Discovery.File.Path = "/etc/goaround/backends.d"
+		f.Discovery.File.Debounce = 0
+		assertion.Equal(f.Validate(), nil)
+		assertion.Equal(f.Providers()[0].String(), "file /etc/goaround/backends.d")
+	})
+
+	t.Run("checks consul discovery", func(t *testing.T) {
+		f := base()
+		f.Discovery.Consul = &Consul{Addr: "127.0.0.1:8500", Wait: Duration(-time.Second)}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 3)
+		assertion.StringContains(err.Error(), "discovery.consul.service: must be set")
+		assertion.StringContains(err.Error(), `discovery.consul.addr: invalid url "127.0.0.1:8500"`)
+		assertion.StringContains(err.Error(), "discovery.consul.wait: must not be negative")
+
+		f.Discovery.Consul = &Consul{Addr: "http://127.0.0.1:8500", Service: "web", Token: "secret"}
+		assertion.Equal(f.Validate(), nil)
+		assertion.Equal(f.Providers()[0].String(), "consul web")
+		assertion.Equal(f.Redacted().Discovery.Consul.Token, "")
+		assertion.Equal(f.Discovery.Consul.Token, "secret")
+	})
+
+	t.Run("checks kubernetes discovery", func(t *testing.T) {
+		f := base()
+		f.Discovery.Kubernetes = &Kubernetes{Kubeconfig: "missing-kubeconfig"}
+
+		err := f.Validate()
+		assertion.Equal(len(err.(*Invalid).Problems), 2)
+		assertion.StringContains(err.Error(), "discovery.kubernetes.service: must be set")
+		assertion.StringContains(err.Error(), "discovery.kubernetes.kubeconfig: stat missing-kubeconfig: no such file or directory")
+
+		f.Discovery.Kubernetes = &Kubernetes{Service: "web", Port: "http"}
+		assertion.Equal(f.Validate(), nil)
+		assertion.Equal(f.Providers()[0].String(), "kubernetes web")
+	})
+}
+
+func TestLoad(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	t.Run("picks the format by extension", func(t *testing.T) {
+		path := filepath.Join(dir, "goaround.yml")
+		assertion.Equal(ioutil.WriteFile(path, []byte("num_conns: 5\n"), 0600), nil)
+
+		f, err := Load(path, base())
+		assertion.Equal(err, nil)
+		assertion.Equal(f.NumConns, 5)
+
+		_, err = Load(filepath.Join(dir, "goaround.ini"), base())
+		assertion.StringContains(err.Error(), "unknown config format")
+	})
+
+	t.Run("validates the file", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.json")
+		assertion.Equal(ioutil.WriteFile(path, []byte(`{"num_conns": 0}`), 0600), nil)
+
+		_, err := Load(path, base())
+		assertion.Equal(err.Error(), "line 1, column 15: num_conns: must be at least 1")
+	})
+
+	t.Run("locates problems in the file", func(t *testing.T) {
+		path := filepath.Join(dir, "located.json")
+		data := `{
+  "backends": [
+    "http://localhost:9000",
+    {"url": "http://localhost:9001", "weight": -2}
+  ],
+  "cache": {"enabled": true, "max_bytes": 0}
+}`
+		assertion.Equal(ioutil.WriteFile(path, []byte(data), 0600), nil)
+
+		_, err := Load(path, base())
+		problems := err.(*Invalid).Problems
+		assertion.Equal(len(problems), 2)
+		assertion.Equal(problems[0].String(), "line 4, column 48: backends[1].weight: must not be negative")
+		assertion.Equal(problems[1].String(), "line 6, column 43: cache.max_bytes: must be positive")
+
+		path = filepath.Join(dir, "types.json")
+		data = `{
+  "backends": [
+    "http://localhost:9000",
+    {"url": 9001}
+  ]
+}`
+		assertion.Equal(ioutil.WriteFile(path, []byte(data), 0600), nil)
+
+		_, err = Load(path, base())
+		assertion.Equal(err.Error(), "line 4, column 13: backends[1].url: cannot use number as string")
+
+		path = filepath.Join(dir, "types.yaml")
+		assertion.Equal(ioutil.WriteFile(path, []byte("backends:\n  - url: http://localhost:9000\n  - url: 9001\n"), 0600), nil)
+
+		_, err = Load(path, base())
+		assertion.Equal(err.Error(), "line 3, column 10: backends[1].url: cannot use number as string")
+
+		path = filepath.Join(dir, "syntax.yaml")
+		assertion.Equal(ioutil.WriteFile(path, []byte("backends:\n  - [\n"), 0600), nil)
+
+		_, err = Load(path, base())
+		assertion.Equal(err.(*Invalid).Problems[0].Line, 2)
+	})
+}
+
+func TestVirtualPool(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	retries := 0
+	f := base()
+	f.MaxRetries = 2
+	f.State.Path = "/var/lib/goaround/state.json"
+	f.Cache.Enabled = true
+	f.Cache.MemcachedTimeout = Duration(time.Second)
+	f.Pools = map[string]*VirtualPool{
+		"api": {
+			Hosts:       []string{"api.example.com"},
+			Backends:    []Backend{{URL: "http://localhost:9000", Weight: 2}},
+			MaxRetries:  &retries,
+			HealthCheck: HealthCheck{Path: "/ready"},
+		},
+		"web": {
+			Hosts:    []string{"www.example.com"},
+			NumConns: 5,
+			Cache:    &Cache{Enabled: true, MaxBytes: 1 << 20},
+		},
+	}
+
+	t.Run("inherits settings left out", func(t *testing.T) {
+		api := f.VirtualPool("api")
+		assertion.Equal(api.Name, "api")
+		assertion.Equal(api.Backends[0], "http://localhost:9000")
+		assertion.Equal(api.Weights["http://localhost:9000"], 2)
+		assertion.Equal(api.MaxRetries, 0)
+		assertion.Equal(api.NumConns, 3)
+		assertion.Equal(api.HealthCheck.Path, "/ready")
+		assertion.Equal(api.HealthCheck.Interval, 10*time.Second)
+		assertion.False(api.EnableCache)
+		assertion.True(api.ControlSocket == nil)
+		assertion.Equal(api.StateFile, "")
+	})
+
+	t.Run("has its own cache", func(t *testing.T) {
+		web := f.VirtualPool("web")
+		assertion.Equal(web.MaxRetries, 2)
+		assertion.Equal(web.NumConns, 5)
+		assertion.True(web.EnableCache)
+		assertion.Equal(web.CacheMaxBytes, int64(1<<20))
+		assertion.Equal(web.CacheTTL, 5*time.Minute)
+		assertion.Equal(web.CacheRemoteTimeout, time.Second)
+	})
+}
+
+func TestRestartOnly(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	running := base()
+	updated := base()
+	updated.Listen = ":4000"
+	updated.Cache.Enabled = true
+	updated.MaxRetries = 2
+	updated.Forwarded.TrustedProxies = []string{"10.0.0.0/8"}
+
+	changed := updated.RestartOnly(running)
+	assertion.Equal(len(changed), 3)
+	assertion.Equal(changed[0], "listen")
+	assertion.Equal(changed[1], "cache")
+	assertion.Equal(changed[2], "forwarded")
+	assertion.Equal(updated.Listen, ":3000")
+	assertion.False(updated.Cache.Enabled)
+	assertion.Equal(len(updated.Forwarded.TrustedProxies), 0)
+	assertion.Equal(updated.MaxRetries, 2)
+
+	t.Run("keeps the running pools and hosts", func(t *testing.T) {
+		running := base()
+		running.Pools = map[string]*VirtualPool{
+			"api": {Hosts: []string{"api.example.com"}},
+			"web": {Hosts: []string{"www.example.com"}},
+		}
+
+		updated := base()
+		updated.Pools = map[string]*VirtualPool{
+			"api":  {Hosts: []string{"*.example.com"}, Backends: []Backend{{URL: "http://localhost:9000"}}},
+			"blog": {Hosts: []string{"blog.example.com"}},
+		}
+
+		changed := updated.RestartOnly(running)
+		assertion.Equal(strings.Join(changed, ","), "pools.api.hosts,pools.web,pools.blog")
+		assertion.Equal(len(updated.Pools), 2)
+		assertion.Equal(updated.Pools["api"].Hosts[0], "api.example.com")
+		assertion.Equal(len(updated.Pools["api"].Backends), 1)
+		assertion.Equal(updated.Pools["web"].Hosts[0], "www.example.com")
+	})
+
+	t.Run("changes routes to running pools", func(t *testing.T) {
+		running := base()
+		running.Pools = map[string]*VirtualPool{"api": {Hosts: []string{"api.example.com"}}}
+		running.Routes = []Route{{PathPrefix: "/api", Pool: "api"}}
+
+		updated := base()
+		updated.Pools = map[string]*VirtualPool{"api": {Hosts: []string{"api.example.com"}}}
+		updated.Routes = []Route{{PathPrefix: "/v2", Pool: "api", Rules: []Rule{{Path: "^/v2/(.*)$", Rewrite: "/$1"}}}}
+
+		changed := updated.RestartOnly(running)
+		assertion.Equal(len(changed), 0)
+		assertion.Equal(updated.Routes[0].PathPrefix, "/v2")
+
+		updated = base()
+		updated.Pools = map[string]*VirtualPool{
+			"api":  {Hosts: []string{"api.example.com"}},
+			"blog": {Hosts: []string{"blog.example.com"}},
+		}
+		updated.Routes = []Route{{PathPrefix: "/blog", Pool: "blog"}}
+
+		changed = updated.RestartOnly(running)
+		assertion.Equal(strings.Join(changed, ","), "pools.blog,routes")
+		assertion.Equal(updated.Routes[0].PathPrefix, "/api")
+	})
+
+	t.Run("only changes the active blue green set", func(t *testing.T) {
+		running := base()
+		running.BlueGreen = &BlueGreen{Active: "blue", Sets: map[string][]Backend{"blue": {{URL: "http://localhost:9001"}}}}
+
+		updated := base()
+		updated.BlueGreen = &BlueGreen{Active: "green", Sets: map[string][]Backend{"green": {{URL: "http://localhost:9002"}}}}
+
+		changed := updated.RestartOnly(running)
+		assertion.Equal(strings.Join(changed, ","), "blue_green.sets")
+		assertion.Equal(updated.BlueGreen.Active, "green")
+		assertion.Equal(updated.BlueGreen.Sets["blue"][0].URL, "http://localhost:9001")
+
+		updated = base()
+		changed = updated.RestartOnly(running)
+		assertion.Equal(strings.Join(changed, ","), "blue_green")
+		assertion.Equal(updated.BlueGreen.Active, "blue")
+	})
+
+	t.Run("only changes the percent of splits", func(t *testing.T) {
+		running := base()
+		running.Splits = map[string]*Split{
+			"checkout": {Canary: "canary", Percent: 10},
+			"search":   {Canary: "canary", Percent: 10},
+		}
+
+		updated := base()
+		updated.Splits = map[string]*Split{
+			"checkout": {Canary: "canary", Percent: 20},
+			"search":   {Canary: "next", Percent: 30},
+		}
+
+		changed := updated.RestartOnly(running)
+		assertion.Equal(strings.Join(changed, ","), "splits.search")
+		assertion.Equal(updated.Splits["checkout"].Percent, 20.0)
+		assertion.Equal(updated.Splits["search"].Canary, "canary")
+		assertion.Equal(updated.Splits["search"].Percent, 30.0)
+	})
+}
+
+func TestWatch(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "goaround.json")
+	assertion.Equal(ioutil.WriteFile(path, []byte(`{}`), 0600), nil)
+
+	changed := make(chan bool, 1)
+	done := make(chan bool)
+	defer close(done)
+
+	go Watch(path, 10*time.Millisecond, done, func() {
+		changed <- true
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	assertion.Equal(ioutil.WriteFile(path, []byte(`{"num_conns": 4}`), 0600), nil)
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change was not noticed")
+	}
+}
@@ -22,7 +22,10 @@ type Connection struct {
 	Messages chan Message
 	Backend  string
 	sync.RWMutex
-	proxy *httputil.ReverseProxy
+	proxy       *httputil.ReverseProxy
+	draining    bool
+	maintenance bool
+	inFlight    bool
 }
 
 func NewConnection(proxy *httputil.ReverseProxy, backend string, startup *sync.WaitGroup) *Connection {
@@ -42,14 +45,61 @@ func (c *Connection) Get() (*httputil.ReverseProxy, error) {
 	c.Lock()
 	defer c.Unlock()
 
+	if c.draining {
+		return nil, errors.New("Draining Node")
+	}
+
+	if c.maintenance {
+		return nil, errors.New("Node In Maintenance")
+	}
+
 	health := c.healthy
 	if health && !c.Shut {
+		c.inFlight = true
 		return c.proxy, nil
 	}
 
 	return nil, errors.New("Unhealthy Node")
 }
 
+// Drain stops the connection from taking new requests.
+func (c *Connection) Drain() {
+	c.Lock()
+	c.draining = true
+	c.Unlock()
+}
+
+// Release marks the request handed out by Get as finished.
+func (c *Connection) Release() {
+	c.Lock()
+	c.inFlight = false
+	c.Unlock()
+}
+
+func (c *Connection) InFlight() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.inFlight
+}
+
+// SetMaintenance stops or resumes handing out the connection, unlike
+// draining the connection stays in the pool.
+func (c *Connection) SetMaintenance(enabled bool) {
+	c.Lock()
+	c.maintenance = enabled
+	c.Unlock()
+}
+
+// Retired reports whether the connection was shut down or drained and
+// should no longer be returned to the pool.
+func (c *Connection) Retired() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.Shut || c.draining
+}
+
 func (c *Connection) healthCheck() {
 	for msg := range c.Messages {
 		c.Lock()
@@ -0,0 +1,210 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/CoderCookE/goaround/internal/gracefulserver"
+)
+
+const DefaultAdminAddr = "127.0.0.1:8081"
+
+const maxAdminBody = 1 << 20
+
+type AdminConfig struct {
+	Addr  string
+	Token string
+}
+
+type admin struct {
+	handler  Handler
+	token    string
+	settings interface{}
+}
+
+// NewAdmin serves the control commands over HTTP, every request must carry
+// the token as a bearer token. Settings are returned as the effective config.
+func NewAdmin(h Handler, token string, settings interface{}) http.Handler {
+	a := &admin{handler: h, token: token, settings: settings}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backends", a.backends)
+	mux.HandleFunc("/backends/drain", a.command(Drain))
+	mux.HandleFunc("/backends/maintenance", a.command(Maintenance))
+	mux.HandleFunc("/backends/weight", a.command(SetWeight))
+	mux.HandleFunc("/backends/replace", a.command(Replace))
+	mux.HandleFunc("/sets/switch", a.command(Switch))
+	mux.HandleFunc("/cache/purge", a.command(Purge))
+	mux.HandleFunc("/splits", a.splits)
+	mux.HandleFunc("/status", a.read(Status))
+	mux.HandleFunc("/config", a.config)
+	mux.HandleFunc("/command", a.raw)
+
+	return a.authenticate(mux)
+}
+
+// StartAdmin runs the admin API until the process is terminated, it is not
+// started without a token.
+func StartAdmin(c *AdminConfig, h Handler, settings interface{}) {
+	if c.Token == "" {
+		log.Printf("Admin API disabled, no token configured")
+		return
+	}
+
+	server := &http.Server{
+		Addr:         c.Addr,
+		Handler:      NewAdmin(h, c.Token, settings),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	graceful := gracefulserver.New(server)
+	log.Printf("Starting admin server on %s", c.Addr)
+	err := graceful.ListenAndServe()
+	if err != nil {
+		log.Printf("Error starting admin server: %s", err.Error())
+	}
+}
+
+func (a *admin) authenticate(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + a.token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			log.Printf("Refused admin request from %s", r.RemoteAddr)
+			writeHTTPResponse(w, http.StatusUnauthorized, errorResponse(errors.New("unauthorized")))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admin) backends(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.read(List)(w, r)
+	case http.MethodPost:
+		a.command(Add)(w, r)
+	case http.MethodDelete:
+		if backends, ok := r.URL.Query()["backend"]; ok {
+			a.dispatch(w, r, &Request{Version: Version, Command: Remove, Backends: backends})
+			return
+		}
+		a.command(Remove)(w, r)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func (a *admin) splits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.read(Splits)(w, r)
+	case http.MethodPost, http.MethodPut:
+		a.command(SetSplit)(w, r)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// command runs the named command with backends, weight and enabled taken
+// from the JSON request body.
+func (a *admin) command(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			methodNotAllowed(w)
+			return
+		}
+
+		req, err := decodeRequest(r)
+		if err != nil {
+			writeHTTPResponse(w, http.StatusBadRequest, errorResponse(err))
+			return
+		}
+
+		req.Version = Version
+		req.Command = name
+		a.dispatch(w, r, req)
+	}
+}
+
+func (a *admin) read(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w)
+			return
+		}
+
+		a.dispatch(w, r, &Request{Version: Version, Command: name})
+	}
+}
+
+// raw accepts the same JSON commands as the control socket.
+func (a *admin) raw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+
+	req, err := decodeRequest(r)
+	if err != nil {
+		writeHTTPResponse(w, http.StatusBadRequest, errorResponse(err))
+		return
+	}
+
+	a.dispatch(w, r, req)
+}
+
+func (a *admin) config(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	writeHTTPResponse(w, http.StatusOK, &Response{Version: Version, OK: true, Result: a.settings})
+}
+
+func (a *admin) dispatch(w http.ResponseWriter, r *http.Request, req *Request) {
+	res := Dispatch(a.handler, req)
+	if req.Command != List && req.Command != Status && req.Command != Splits {
+		logCommand(r.RemoteAddr, req, res)
+	}
+
+	status := http.StatusOK
+	if !res.OK {
+		status = http.StatusBadRequest
+	}
+
+	writeHTTPResponse(w, status, res)
+}
+
+func decodeRequest(r *http.Request) (*Request, error) {
+	req := &Request{}
+	err := json.NewDecoder(io.LimitReader(r.Body, maxAdminBody)).Decode(req)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %s", err.Error())
+	}
+
+	return req, nil
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	writeHTTPResponse(w, http.StatusMethodNotAllowed, errorResponse(errors.New("method not allowed")))
+}
+
+func writeHTTPResponse(w http.ResponseWriter, status int, res *Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("Error writing admin response: %s", err.Error())
+	}
+}
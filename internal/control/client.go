@@ -0,0 +1,99 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const clientTimeout = 30 * time.Second
+
+// Client sends a command to a running goaround and returns its response.
+type Client interface {
+	Do(req *Request) (*Response, error)
+}
+
+type socketClient struct {
+	path string
+}
+
+type adminClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewSocketClient talks to the control socket at path.
+func NewSocketClient(path string) Client {
+	return &socketClient{path: path}
+}
+
+// NewAdminClient talks to the admin API at url, ex: http://127.0.0.1:8081
+func NewAdminClient(url, token string) Client {
+	return &adminClient{
+		url:    strings.TrimRight(url, "/"),
+		token:  token,
+		client: &http.Client{Timeout: clientTimeout},
+	}
+}
+
+func (c *socketClient) Do(req *Request) (*Response, error) {
+	conn, err := net.DialTimeout("unix", c.path, clientTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(clientTimeout)); err != nil {
+		return nil, err
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %s", err.Error())
+	}
+
+	res := &Response{}
+	if err := json.Unmarshal(line, res); err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err.Error())
+	}
+
+	return res, nil
+}
+
+func (c *adminClient) Do(req *Request) (*Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, c.url+"/command", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+c.token)
+
+	httpRes, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpRes.Body.Close()
+
+	res := &Response{}
+	if err := json.NewDecoder(httpRes.Body).Decode(res); err != nil {
+		return nil, fmt.Errorf("invalid response, status %d: %s", httpRes.StatusCode, err.Error())
+	}
+
+	return res, nil
+}
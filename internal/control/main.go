@@ -0,0 +1,312 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const Version = 1
+
+// maxLine is the longest command Handle reads, a replace with thousands of
+// backends still fits.
+const maxLine = 1 << 20
+
+const (
+	Add         = "add"
+	Remove      = "remove"
+	SetWeight   = "set-weight"
+	Drain       = "drain"
+	Maintenance = "maintenance"
+	Purge       = "purge"
+	List        = "list"
+	Status      = "status"
+	Replace     = "replace"
+	Switch      = "switch"
+	SetSplit    = "set-split"
+	Splits      = "splits"
+)
+
+// Circuit states, a backend's circuit opens while its health check fails.
+const (
+	CircuitClosed = "closed"
+	CircuitOpen   = "open"
+)
+
+type Request struct {
+	Version  int      `json:"version"`
+	Command  string   `json:"command"`
+	Backends []string `json:"backends,omitempty"`
+	Weight   int      `json:"weight,omitempty"`
+	Enabled  bool     `json:"enabled,omitempty"`
+	Keys     []string `json:"keys,omitempty"`
+	Set      string   `json:"set,omitempty"`
+	Split    string   `json:"split,omitempty"`
+	Percent  float64  `json:"percent,omitempty"`
+}
+
+type Response struct {
+	Version int         `json:"version"`
+	OK      bool        `json:"ok"`
+	Error   string      `json:"error,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+}
+
+type BackendStatus struct {
+	Backend     string       `json:"backend"`
+	Healthy     bool         `json:"healthy"`
+	Weight      int          `json:"weight"`
+	Connections int          `json:"connections"`
+	InFlight    int          `json:"in_flight"`
+	Circuit     string       `json:"circuit"`
+	Draining    bool         `json:"draining"`
+	Maintenance bool         `json:"maintenance"`
+	Drain       *DrainStatus `json:"drain,omitempty"`
+	Set         string       `json:"set,omitempty"`
+	Standby     bool         `json:"standby,omitempty"`
+}
+
+// DrainStatus reports the progress of a draining backend. Removed backends
+// keep draining until their requests finish or the drain timeout passes.
+type DrainStatus struct {
+	Started   time.Time `json:"started"`
+	Removing  bool      `json:"removing"`
+	Remaining float64   `json:"remaining_seconds,omitempty"`
+}
+
+type PoolStatus struct {
+	Backends             int    `json:"backends"`
+	HealthyBackends      int    `json:"healthy_backends"`
+	DrainingBackends     int    `json:"draining_backends"`
+	AvailableConnections int    `json:"available_connections"`
+	CacheEnabled         bool   `json:"cache_enabled"`
+	ActiveSet            string `json:"active_set,omitempty"`
+}
+
+// SplitStatus reports the share of a route split's traffic going to its
+// canary, an empty pool is the default pool.
+type SplitStatus struct {
+	Split   string  `json:"split"`
+	Stable  string  `json:"stable"`
+	Canary  string  `json:"canary"`
+	Percent float64 `json:"percent"`
+	Header  string  `json:"header,omitempty"`
+	Cookie  string  `json:"cookie,omitempty"`
+}
+
+// Handler applies control commands, it is implemented by the connection pool.
+type Handler interface {
+	Add(backends []string, weight int) error
+	Remove(backends []string) error
+	SetWeight(backend string, weight int) error
+	Drain(backends []string) error
+	Maintenance(backends []string, enabled bool) error
+	Replace(backends []string) error
+	Switch(set string) error
+	Purge(keys []string) error
+	List() []BackendStatus
+	Status() PoolStatus
+}
+
+// Splitter changes the canary percentage of route splits, handlers that
+// implement it also accept the split commands.
+type Splitter interface {
+	SetSplit(name string, percent float64) error
+	Splits() []SplitStatus
+}
+
+// Serve accepts connections until the listener is closed, peers outside
+// the socket's allow lists are refused.
+func Serve(l net.Listener, h Handler, c *SocketConfig) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			creds := peer(conn)
+			if !c.allowed(creds) {
+				log.Printf("Refused control connection from %s", creds)
+				writeResponse(json.NewEncoder(conn), errorResponse(errors.New("permission denied")))
+				return
+			}
+
+			Handle(conn, h, creds.String())
+		}()
+	}
+}
+
+// Handle reads one command per line and writes one JSON response per line.
+// The legacy comma separated list of backends must be prefixed with replace,
+// other lines that are not JSON are refused so a typo can't replace every
+// backend. A line longer than maxLine, or a failed read, is answered with an
+// error and ends the connection.
+func Handle(rw io.ReadWriter, h Handler, caller string) {
+	scanner := bufio.NewScanner(rw)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLine)
+	encoder := json.NewEncoder(rw)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		req := &Request{}
+		switch {
+		case strings.HasPrefix(line, "{"):
+			if err := json.Unmarshal([]byte(line), req); err != nil {
+				log.Printf("Invalid control command from %s: %s", caller, err.Error())
+				writeResponse(encoder, errorResponse(fmt.Errorf("invalid request: %s", err.Error())))
+				continue
+			}
+		case strings.HasPrefix(line, Replace+" "):
+			backends := strings.TrimSpace(strings.TrimPrefix(line, Replace+" "))
+			req = &Request{Version: Version, Command: Replace, Backends: strings.Split(backends, ",")}
+		default:
+			log.Printf("Invalid control command from %s: %q", caller, line)
+			writeResponse(encoder, errorResponse(errors.New("invalid request: send a JSON command, or replace followed by a comma separated list of backends")))
+			continue
+		}
+
+		res := Dispatch(h, req)
+		logCommand(caller, req, res)
+		writeResponse(encoder, res)
+	}
+
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			err = fmt.Errorf("longer than %d bytes", maxLine)
+		}
+
+		log.Printf("Invalid control command from %s: %s", caller, err.Error())
+		writeResponse(encoder, errorResponse(fmt.Errorf("invalid request: %s", err.Error())))
+	}
+}
+
+func logCommand(caller string, req *Request, res *Response) {
+	target := fmt.Sprint(req.Backends)
+	if req.Split != "" {
+		target = fmt.Sprintf("%s %v%%", req.Split, req.Percent)
+	}
+
+	if req.Set != "" {
+		target = req.Set
+	}
+
+	if res.OK {
+		log.Printf("Control command %s %s from %s succeeded", req.Command, target, caller)
+	} else {
+		log.Printf("Control command %s %s from %s failed: %s", req.Command, target, caller, res.Error)
+	}
+}
+
+func writeResponse(encoder *json.Encoder, res *Response) {
+	if err := encoder.Encode(res); err != nil {
+		log.Printf("Error writing control response: %s", err.Error())
+	}
+}
+
+// Dispatch runs a single command against the handler.
+func Dispatch(h Handler, req *Request) *Response {
+	if req.Version != Version {
+		return errorResponse(fmt.Errorf("unsupported version %d, expected %d", req.Version, Version))
+	}
+
+	var result interface{}
+	var err error
+
+	switch req.Command {
+	case Add:
+		err = requireBackends(req)
+		if err == nil {
+			err = h.Add(req.Backends, req.Weight)
+		}
+	case Remove:
+		err = requireBackends(req)
+		if err == nil {
+			err = h.Remove(req.Backends)
+		}
+	case SetWeight:
+		if len(req.Backends) != 1 {
+			err = fmt.Errorf("%s requires exactly one backend", req.Command)
+		} else {
+			err = h.SetWeight(req.Backends[0], req.Weight)
+		}
+	case Drain:
+		err = requireBackends(req)
+		if err == nil {
+			err = h.Drain(req.Backends)
+		}
+	case Maintenance:
+		err = requireBackends(req)
+		if err == nil {
+			err = h.Maintenance(req.Backends, req.Enabled)
+		}
+	case Replace:
+		err = requireBackends(req)
+		if err == nil {
+			err = h.Replace(req.Backends)
+		}
+	case Switch:
+		if req.Set == "" {
+			err = fmt.Errorf("%s requires a set", req.Command)
+		} else {
+			err = h.Switch(req.Set)
+		}
+	case Purge:
+		err = h.Purge(req.Keys)
+	case List:
+		result = h.List()
+	case Status:
+		result = h.Status()
+	case SetSplit, Splits:
+		result, err = dispatchSplit(h, req)
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return &Response{Version: Version, OK: true, Result: result}
+}
+
+func dispatchSplit(h Handler, req *Request) (interface{}, error) {
+	s, ok := h.(Splitter)
+	if !ok {
+		return nil, errors.New("splits are not supported")
+	}
+
+	if req.Command == Splits {
+		return s.Splits(), nil
+	}
+
+	if req.Split == "" {
+		return nil, fmt.Errorf("%s requires a split", req.Command)
+	}
+
+	return nil, s.SetSplit(req.Split, req.Percent)
+}
+
+func requireBackends(req *Request) error {
+	if len(req.Backends) == 0 {
+		return fmt.Errorf("%s requires at least one backend", req.Command)
+	}
+
+	return nil
+}
+
+func errorResponse(err error) *Response {
+	return &Response{Version: Version, OK: false, Error: err.Error()}
+}
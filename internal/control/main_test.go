@@ -0,0 +1,477 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/CoderCookE/goaround/internal/assert"
+)
+
+type fakeHandler struct {
+	commands []string
+	backends []string
+	weight   int
+}
+
+func (f *fakeHandler) Add(backends []string, weight int) error {
+	f.commands = append(f.commands, Add)
+	f.backends = backends
+	f.weight = weight
+	return nil
+}
+
+func (f *fakeHandler) Remove(backends []string) error {
+	return errors.New("unknown backends: " + strings.Join(backends, ", "))
+}
+
+func (f *fakeHandler) SetWeight(backend string, weight int) error {
+	f.commands = append(f.commands, SetWeight)
+	f.backends = []string{backend}
+	f.weight = weight
+	return nil
+}
+
+func (f *fakeHandler) Drain(backends []string) error {
+	f.commands = append(f.commands, Drain)
+	return nil
+}
+
+func (f *fakeHandler) Maintenance(backends []string, enabled bool) error {
+	f.commands = append(f.commands, Maintenance)
+	f.backends = backends
+	return nil
+}
+
+func (f *fakeHandler) Replace(backends []string) error {
+	f.commands = append(f.commands, Replace)
+	f.backends = backends
+	return nil
+}
+
+func (f *fakeHandler) Switch(set string) error {
+	if set != "green" {
+		return errors.New("unknown set " + set)
+	}
+
+	f.commands = append(f.commands, Switch)
+	return nil
+}
+
+func (f *fakeHandler) Purge(keys []string) error {
+	f.commands = append(f.commands, Purge)
+	return nil
+}
+
+func (f *fakeHandler) List() []BackendStatus {
+	return []BackendStatus{{Backend: "http://localhost:9000", Healthy: true, Weight: 1}}
+}
+
+func (f *fakeHandler) Status() PoolStatus {
+	return PoolStatus{Backends: 1, HealthyBackends: 1}
+}
+
+type fakeSplitter struct {
+	*fakeHandler
+	percent float64
+}
+
+func (f *fakeSplitter) SetSplit(name string, percent float64) error {
+	if name != "checkout" {
+		return errors.New("unknown split " + name)
+	}
+
+	f.percent = percent
+	return nil
+}
+
+func (f *fakeSplitter) Splits() []SplitStatus {
+	return []SplitStatus{{Split: "checkout", Canary: "canary", Percent: f.percent}}
+}
+
+func TestDispatch(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	t.Run("runs commands against the handler", func(t *testing.T) {
+		handler := &fakeHandler{}
+		res := Dispatch(handler, &Request{Version: Version, Command: Add, Backends: []string{"http://localhost:9000"}, Weight: 2})
+
+		assertion.True(res.OK)
+		assertion.Equal(handler.commands[0], Add)
+		assertion.Equal(handler.weight, 2)
+	})
+
+	t.Run("returns handler errors", func(t *testing.T) {
+		res := Dispatch(&fakeHandler{}, &Request{Version: Version, Command: Remove, Backends: []string{"http://localhost:9000"}})
+
+		assertion.False(res.OK)
+		assertion.Equal(res.Error, "unknown backends: http://localhost:9000")
+	})
+
+	t.Run("rejects unsupported versions and commands", func(t *testing.T) {
+		res := Dispatch(&fakeHandler{}, &Request{Version: 2, Command: List})
+		assertion.False(res.OK)
+		assertion.StringContains(res.Error, "unsupported version")
+
+		res = Dispatch(&fakeHandler{}, &Request{Version: Version, Command: "ad"})
+		assertion.False(res.OK)
+		assertion.Equal(res.Error, `unknown command "ad"`)
+	})
+
+	t.Run("switches sets", func(t *testing.T) {
+		handler := &fakeHandler{}
+		res := Dispatch(handler, &Request{Version: Version, Command: Switch, Set: "green"})
+		assertion.True(res.OK)
+		assertion.Equal(handler.commands[0], Switch)
+
+		res = Dispatch(handler, &Request{Version: Version, Command: Switch})
+		assertion.False(res.OK)
+		assertion.Equal(res.Error, "switch requires a set")
+	})
+
+	t.Run("changes splits of handlers that support them", func(t *testing.T) {
+		handler := &fakeSplitter{fakeHandler: &fakeHandler{}}
+		res := Dispatch(handler, &Request{Version: Version, Command: SetSplit, Split: "checkout", Percent: 25})
+		assertion.True(res.OK)
+		assertion.Equal(handler.percent, 25.0)
+
+		res = Dispatch(handler, &Request{Version: Version, Command: Splits})
+		assertion.True(res.OK)
+		assertion.Equal(res.Result.([]SplitStatus)[0].Percent, 25.0)
+
+		res = Dispatch(handler, &Request{Version: Version, Command: SetSplit, Percent: 25})
+		assertion.False(res.OK)
+		assertion.Equal(res.Error, "set-split requires a split")
+
+		res = Dispatch(&fakeHandler{}, &Request{Version: Version, Command: Splits})
+		assertion.False(res.OK)
+		assertion.Equal(res.Error, "splits are not supported")
+	})
+
+	t.Run("requires backends for commands changing the pool", func(t *testing.T) {
+		handler := &fakeHandler{}
+		for _, command := range []string{Add, Remove, Drain, Replace} {
+			res := Dispatch(handler, &Request{Version: Version, Command: command})
+			assertion.False(res.OK)
+		}
+
+		res := Dispatch(handler, &Request{Version: Version, Command: SetWeight, Backends: []string{"a", "b"}, Weight: 2})
+		assertion.False(res.OK)
+		assertion.Equal(len(handler.commands), 0)
+	})
+}
+
+func TestHandle(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	t.Run("replies to each line with a JSON response", func(t *testing.T) {
+		handler := &fakeHandler{}
+		client, server := net.Pipe()
+		defer client.Close()
+
+		go func() {
+			defer server.Close()
+			Handle(server, handler, "test")
+		}()
+
+		reader := bufio.NewReader(client)
+		send := func(line string) *Response {
+			_, err := client.Write([]byte(line + "\n"))
+			assertion.Equal(err, nil)
+
+			reply, err := reader.ReadBytes('\n')
+			assertion.Equal(err, nil)
+
+			res := &Response{}
+			assertion.Equal(json.Unmarshal(reply, res), nil)
+			return res
+		}
+
+		res := send(`{"version":1,"command":"list"}`)
+		assertion.True(res.OK)
+		assertion.Equal(res.Result.([]interface{})[0].(map[string]interface{})["backend"], "http://localhost:9000")
+
+		res = send(`{"version":1,"command":`)
+		assertion.False(res.OK)
+		assertion.StringContains(res.Error, "invalid request")
+
+		res = send("http://localhost:9000,http://localhost:9001")
+		assertion.False(res.OK)
+		assertion.StringContains(res.Error, "invalid request")
+		assertion.Equal(len(handler.commands), 0)
+
+		res = send("replace http://localhost:9000,http://localhost:9001")
+		assertion.True(res.OK)
+		assertion.Equal(handler.commands[0], Replace)
+		assertion.Equal(len(handler.backends), 2)
+	})
+
+	t.Run("refuses lines longer than the limit", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		go func() {
+			defer server.Close()
+			Handle(server, &fakeHandler{}, "test")
+		}()
+
+		go client.Write([]byte("replace " + strings.Repeat("x", maxLine) + "\n"))
+
+		reply, err := bufio.NewReader(client).ReadBytes('\n')
+		assertion.Equal(err, nil)
+
+		res := &Response{}
+		assertion.Equal(json.Unmarshal(reply, res), nil)
+		assertion.False(res.OK)
+		assertion.StringContains(res.Error, "longer than 1048576 bytes")
+	})
+}
+
+func TestListen(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	t.Run("creates the socket with the configured mode", func(t *testing.T) {
+		path := filepath.Join(dir, "mode.sock")
+		l, err := Listen(&SocketConfig{Path: path, Mode: 0660, UID: -1, GID: -1})
+		assertion.Equal(err, nil)
+		defer l.Close()
+
+		info, err := os.Stat(path)
+		assertion.Equal(err, nil)
+		assertion.Equal(info.Mode().Perm(), os.FileMode(0660))
+	})
+
+	t.Run("never exposes the socket with another mode", func(t *testing.T) {
+		path := filepath.Join(dir, "window.sock")
+		done := make(chan struct{})
+		seen := make(chan os.FileMode, 1)
+		go func() {
+			defer close(seen)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				info, err := os.Stat(path)
+				if err == nil && info.Mode().Perm() != 0600 {
+					seen <- info.Mode().Perm()
+					return
+				}
+			}
+		}()
+
+		for i := 0; i < 500; i++ {
+			l, err := Listen(&SocketConfig{Path: path, Mode: 0600, UID: -1, GID: -1})
+			assertion.Equal(err, nil)
+
+			info, err := os.Stat(path)
+			assertion.Equal(err, nil)
+			assertion.Equal(info.Mode().Perm(), os.FileMode(0600))
+			l.Close()
+		}
+		close(done)
+
+		mode, exposed := <-seen
+		assertion.False(exposed)
+		assertion.Equal(mode, os.FileMode(0))
+
+		_, err := os.Stat(path)
+		assertion.True(os.IsNotExist(err))
+
+		entries, err := ioutil.ReadDir(dir)
+		assertion.Equal(err, nil)
+		for _, entry := range entries {
+			assertion.False(strings.HasPrefix(entry.Name(), ".goaround-"))
+		}
+	})
+
+	t.Run("refuses a socket in use by another instance", func(t *testing.T) {
+		path := filepath.Join(dir, "inuse.sock")
+		l, err := Listen(&SocketConfig{Path: path, Mode: 0600, UID: -1, GID: -1})
+		assertion.Equal(err, nil)
+		defer l.Close()
+
+		_, err = Listen(&SocketConfig{Path: path, Mode: 0600, UID: -1, GID: -1})
+		assertion.StringContains(err.Error(), "in use by another instance")
+	})
+
+	t.Run("replaces stale sockets but not other files", func(t *testing.T) {
+		path := filepath.Join(dir, "stale.sock")
+		l, err := net.Listen("unix", path)
+		assertion.Equal(err, nil)
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+
+		l, err = Listen(&SocketConfig{Path: path, Mode: 0600, UID: -1, GID: -1})
+		assertion.Equal(err, nil)
+		l.Close()
+
+		path = filepath.Join(dir, "regular")
+		assertion.Equal(ioutil.WriteFile(path, []byte("keep"), 0600), nil)
+		_, err = Listen(&SocketConfig{Path: path, Mode: 0600, UID: -1, GID: -1})
+		assertion.StringContains(err.Error(), "is not a socket")
+	})
+}
+
+func TestServe(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	send := func(config *SocketConfig) *Response {
+		l, err := Listen(config)
+		assertion.Equal(err, nil)
+		defer l.Close()
+
+		go func() {
+			_ = Serve(l, &fakeHandler{}, config)
+		}()
+
+		conn, err := net.Dial("unix", config.Path)
+		assertion.Equal(err, nil)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(`{"version":1,"command":"status"}` + "\n"))
+		assertion.Equal(err, nil)
+
+		res := &Response{}
+		assertion.Equal(json.NewDecoder(conn).Decode(res), nil)
+		return res
+	}
+
+	t.Run("accepts peers in the allow list", func(t *testing.T) {
+		res := send(&SocketConfig{Path: filepath.Join(dir, "allowed.sock"), Mode: 0600, UID: -1, GID: -1, AllowUIDs: []int{os.Getuid()}})
+		assertion.True(res.OK)
+	})
+
+	t.Run("refuses peers outside the allow list", func(t *testing.T) {
+		res := send(&SocketConfig{Path: filepath.Join(dir, "refused.sock"), Mode: 0600, UID: -1, GID: -1, AllowUIDs: []int{os.Getuid() + 1}})
+		assertion.False(res.OK)
+		assertion.Equal(res.Error, "permission denied")
+	})
+}
+
+func TestAdmin(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	handler := &fakeHandler{}
+	server := httptest.NewServer(NewAdmin(handler, "secret", map[string]int{"num_conns": 3}))
+	defer server.Close()
+
+	call := func(method, path, token, body string) (int, *Response) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		assertion.Equal(err, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		httpRes, err := http.DefaultClient.Do(req)
+		assertion.Equal(err, nil)
+		defer httpRes.Body.Close()
+
+		res := &Response{}
+		assertion.Equal(json.NewDecoder(httpRes.Body).Decode(res), nil)
+		return httpRes.StatusCode, res
+	}
+
+	t.Run("requires the token", func(t *testing.T) {
+		status, res := call("GET", "/backends", "", "")
+		assertion.Equal(status, http.StatusUnauthorized)
+		assertion.False(res.OK)
+
+		status, _ = call("GET", "/backends", "wrong", "")
+		assertion.Equal(status, http.StatusUnauthorized)
+	})
+
+	t.Run("lists backends and status", func(t *testing.T) {
+		status, res := call("GET", "/backends", "secret", "")
+		assertion.Equal(status, http.StatusOK)
+		assertion.Equal(res.Result.([]interface{})[0].(map[string]interface{})["backend"], "http://localhost:9000")
+
+		status, res = call("GET", "/status", "secret", "")
+		assertion.Equal(status, http.StatusOK)
+		assertion.Equal(res.Result.(map[string]interface{})["backends"], float64(1))
+	})
+
+	t.Run("changes backends", func(t *testing.T) {
+		status, _ := call("POST", "/backends", "secret", `{"backends":["http://localhost:9001"],"weight":3}`)
+		assertion.Equal(status, http.StatusOK)
+		assertion.Equal(handler.weight, 3)
+
+		status, _ = call("POST", "/backends/maintenance", "secret", `{"backends":["http://localhost:9001"],"enabled":true}`)
+		assertion.Equal(status, http.StatusOK)
+		assertion.Equal(handler.commands[len(handler.commands)-1], Maintenance)
+
+		status, res := call("DELETE", "/backends?backend=http://localhost:9001", "secret", "")
+		assertion.Equal(status, http.StatusBadRequest)
+		assertion.Equal(res.Error, "unknown backends: http://localhost:9001")
+
+		status, _ = call("POST", "/status", "secret", "")
+		assertion.Equal(status, http.StatusMethodNotAllowed)
+	})
+
+	t.Run("shows the effective config", func(t *testing.T) {
+		status, res := call("GET", "/config", "secret", "")
+		assertion.Equal(status, http.StatusOK)
+		assertion.Equal(res.Result.(map[string]interface{})["num_conns"], float64(3))
+	})
+}
+
+func TestClient(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	t.Run("sends commands over the socket", func(t *testing.T) {
+		config := &SocketConfig{Path: filepath.Join(dir, "client.sock"), Mode: 0600, UID: -1, GID: -1}
+		l, err := Listen(config)
+		assertion.Equal(err, nil)
+		defer l.Close()
+
+		handler := &fakeHandler{}
+		go func() {
+			_ = Serve(l, handler, config)
+		}()
+
+		res, err := NewSocketClient(config.Path).Do(&Request{Version: Version, Command: Purge, Keys: []string{"/assets/app.js"}})
+		assertion.Equal(err, nil)
+		assertion.True(res.OK)
+		assertion.Equal(handler.commands[0], Purge)
+	})
+
+	t.Run("sends commands to the admin API", func(t *testing.T) {
+		server := httptest.NewServer(NewAdmin(&fakeHandler{}, "secret", nil))
+		defer server.Close()
+
+		res, err := NewAdminClient(server.URL+"/", "secret").Do(&Request{Version: Version, Command: Status})
+		assertion.Equal(err, nil)
+		assertion.True(res.OK)
+
+		res, err = NewAdminClient(server.URL, "wrong").Do(&Request{Version: Version, Command: Status})
+		assertion.Equal(err, nil)
+		assertion.False(res.OK)
+	})
+
+	t.Run("fails when nothing is listening", func(t *testing.T) {
+		_, err := NewSocketClient(filepath.Join(dir, "missing.sock")).Do(&Request{Version: Version, Command: List})
+		assertion.NotEqual(err, nil)
+	})
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package control
+
+import (
+	"errors"
+	"net"
+)
+
+const peerCredentialsSupported = false
+
+func peerCredentials(conn *net.UnixConn) (*Credentials, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
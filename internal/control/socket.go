@@ -0,0 +1,171 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const DefaultSocketPath = "/tmp/goaround.sock"
+
+type SocketConfig struct {
+	Path      string      `json:"path"`
+	Mode      os.FileMode `json:"mode"`
+	UID       int         `json:"uid"`
+	GID       int         `json:"gid"`
+	AllowUIDs []int       `json:"allow_uids"`
+	AllowGIDs []int       `json:"allow_gids"`
+}
+
+// Credentials of the process on the other end of the control socket.
+type Credentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+func (c *Credentials) String() string {
+	if c == nil {
+		return "unknown peer"
+	}
+
+	return fmt.Sprintf("pid=%d uid=%d gid=%d", c.PID, c.UID, c.GID)
+}
+
+// Listen creates the control socket in a private directory, sets its mode
+// and owner there and only then renames it into place, so it is never
+// reachable with umask permissions. A socket still answered by another
+// instance is never replaced, stale ones left behind by a crash are removed.
+func Listen(c *SocketConfig) (net.Listener, error) {
+	if c.restricted() && !peerCredentialsSupported {
+		return nil, errors.New("peer credential checks are not supported on this platform")
+	}
+
+	if err := removeStale(c.Path); err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(c.Path), ".goaround-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setup(l, tmp, c); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &socketListener{Listener: l, path: c.Path}, nil
+}
+
+func setup(l net.Listener, tmp string, c *SocketConfig) error {
+	if err := os.Chmod(tmp, c.Mode); err != nil {
+		return err
+	}
+
+	if c.UID >= 0 || c.GID >= 0 {
+		if err := os.Chown(tmp, c.UID, c.GID); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, c.Path); err != nil {
+		return err
+	}
+
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	return nil
+}
+
+// socketListener removes the renamed socket on close, the listener itself
+// only knows the path it was created at.
+type socketListener struct {
+	net.Listener
+	path string
+}
+
+func (l *socketListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another instance", path)
+	}
+
+	return os.Remove(path)
+}
+
+func (c *SocketConfig) restricted() bool {
+	return c != nil && (len(c.AllowUIDs) > 0 || len(c.AllowGIDs) > 0)
+}
+
+// allowed reports whether the peer may send commands, without allow lists
+// anyone able to open the socket is allowed.
+func (c *SocketConfig) allowed(creds *Credentials) bool {
+	if !c.restricted() {
+		return true
+	}
+
+	if creds == nil {
+		return false
+	}
+
+	for _, uid := range c.AllowUIDs {
+		if uint32(uid) == creds.UID {
+			return true
+		}
+	}
+
+	for _, gid := range c.AllowGIDs {
+		if uint32(gid) == creds.GID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func peer(conn net.Conn) *Credentials {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+
+	creds, err := peerCredentials(unixConn)
+	if err != nil {
+		log.Printf("Error reading control socket peer credentials: %s", err.Error())
+		return nil
+	}
+
+	return creds
+}
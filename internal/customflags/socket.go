@@ -0,0 +1,43 @@
+package customflags
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type FileMode os.FileMode
+
+func (m *FileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid octal file mode: %s", value)
+	}
+
+	*m = FileMode(mode)
+	return nil
+}
+
+func (m *FileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+type IDs []int
+
+func (i *IDs) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || id < 0 {
+			return fmt.Errorf("invalid id: %s", field)
+		}
+
+		*i = append(*i, id)
+	}
+
+	return nil
+}
+
+func (i *IDs) String() string {
+	return fmt.Sprintf("%d", *i)
+}
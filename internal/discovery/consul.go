@@ -0,0 +1,210 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	consulAddr  = "http://127.0.0.1:8500"
+	consulWait  = 5 * time.Minute
+	consulRetry = 5 * time.Second
+)
+
+// Consul follows the passing instances of a service with blocking queries
+// to the health API, so changes are seen as soon as Consul has them.
+type Consul struct {
+	// Addr of the Consul HTTP API, defaults to http://127.0.0.1:8500
+	Addr    string
+	Service string
+	// Tags instances must all have
+	Tags       []string
+	Datacenter string
+	Token      string
+	// Scheme of the backends, defaults to http
+	Scheme string
+	// Wait is how long a blocking query waits for a change, defaults to 5m
+	Wait time.Duration
+}
+
+type consulEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+	}
+}
+
+func (c *Consul) String() string {
+	return "consul " + c.Service
+}
+
+func (c *Consul) Run(done <-chan bool, update func([]Backend)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	var index uint64
+	for {
+		backends, next, err := c.Query(ctx, index)
+
+		var wait time.Duration
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Printf("Error querying consul for %s: %s", c.Service, err.Error())
+			wait = consulRetry
+		} else {
+			// the index going backwards means Consul's state was reset,
+			// without an index queries can't block so they are spaced out
+			if next < index {
+				next = 0
+			}
+			if next == 0 {
+				wait = consulRetry
+			}
+			index = next
+
+			if len(backends) == 0 {
+				log.Printf("No passing instances of %s in consul, removing its backends", c.Service)
+			}
+			update(backends)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return
+		}
+	}
+}
+
+// Query returns the passing instances, blocking until the service changes
+// when index is the index of the previous query.
+func (c *Consul) Query(ctx context.Context, index uint64) ([]Backend, uint64, error) {
+	addr := c.Addr
+	if addr == "" {
+		addr = consulAddr
+	}
+
+	wait := c.Wait
+	if wait <= 0 {
+		wait = consulWait
+	}
+
+	query := url.Values{}
+	query.Set("passing", "true")
+	for _, tag := range c.Tags {
+		query.Add("tag", tag)
+	}
+	if c.Datacenter != "" {
+		query.Set("dc", c.Datacenter)
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", wait.String())
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/health/service/%s?%s", addr, url.PathEscape(c.Service), query.Encode())
+
+	// Consul adds up to wait/16 of jitter to blocking queries
+	ctx, cancel := context.WithTimeout(ctx, wait+wait/16+10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	var backends []Backend
+	for _, entry := range entries {
+		if !hasTags(entry.Service.Tags, c.Tags) {
+			continue
+		}
+
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+
+		metadata := map[string]string{"node": entry.Node.Node}
+		for k, v := range entry.Service.Meta {
+			metadata[k] = v
+		}
+
+		backends = append(backends, Backend{
+			URL:      c.url(host, entry.Service.Port),
+			Metadata: metadata,
+		})
+	}
+
+	return backends, next, nil
+}
+
+func (c *Consul) url(host string, port int) string {
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// hasTags reports whether every wanted tag is set, older Consul versions
+// only filter by the first tag of a query.
+func hasTags(tags, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, tag := range tags {
+			if tag == w {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
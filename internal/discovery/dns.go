@@ -0,0 +1,449 @@
+package discovery
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTimeout    = 5 * time.Second
+	dnsRetry      = 5 * time.Second
+	minTTL        = time.Second
+	maxTTL        = time.Hour
+	defaultServer = "127.0.0.1:53"
+)
+
+var (
+	resolvConf = "/etc/resolv.conf"
+
+	errNoSuchHost = errors.New("no such host")
+)
+
+// DNS expands a hostname to one backend per A and AAAA record, or an SRV
+// name to one backend per address of its targets. Names are completed with
+// the search domains in /etc/resolv.conf the way the system resolver does.
+type DNS struct {
+	Name   string
+	SRV    bool
+	Scheme string
+	// Port of backends found by A and AAAA records, SRV records carry their own
+	Port int
+	// Server is the host:port of the DNS server, read from /etc/resolv.conf when empty
+	Server string
+	// Interval between lookups, the records' TTL is used when it is 0
+	Interval time.Duration
+}
+
+func (d *DNS) String() string {
+	if d.SRV {
+		return "dns srv " + d.Name
+	}
+
+	return "dns " + d.Name
+}
+
+func (d *DNS) Run(done <-chan bool, update func([]Backend)) {
+	for {
+		backends, ttl, err := d.Resolve()
+
+		wait := d.Interval
+		if err != nil {
+			log.Printf("Error resolving %s: %s", d.Name, err.Error())
+			if wait <= 0 || wait > dnsRetry {
+				wait = dnsRetry
+			}
+		} else {
+			update(backends)
+			if wait <= 0 {
+				wait = ttl
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return
+		}
+	}
+}
+
+// Resolve looks up the backends and how long the answer may be cached. Each
+// name the search domains give is tried in turn until one has records, a name
+// that does not exist or has no records is an empty set rather than an error,
+// checked again after dnsRetry.
+func (d *DNS) Resolve() ([]Backend, time.Duration, error) {
+	conf := readResolvConf(resolvConf)
+	if d.Server != "" {
+		conf.server = d.Server
+	}
+
+	var failure error
+	exists := false
+	for _, name := range conf.names(d.Name) {
+		r := &resolver{server: conf.server, ttl: maxTTL}
+
+		var backends []Backend
+		var err error
+		if d.SRV {
+			backends, err = d.resolveSRV(r, name)
+		} else {
+			backends, err = d.resolveHost(r, name)
+		}
+
+		switch {
+		case err == nil && len(backends) > 0:
+			return backends, r.ttl, nil
+		case err == nil:
+			exists = true
+		case err != errNoSuchHost && failure == nil:
+			failure = err
+		}
+	}
+
+	if failure != nil {
+		return nil, 0, failure
+	}
+
+	if exists {
+		log.Printf("No records for %s", d.Name)
+	} else {
+		log.Printf("No such host %s", d.Name)
+	}
+
+	return nil, dnsRetry, nil
+}
+
+func (d *DNS) resolveHost(r *resolver, name string) ([]Backend, error) {
+	ips, err := r.addresses(name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	backends := make([]Backend, len(ips))
+	for i, ip := range ips {
+		backends[i] = Backend{URL: d.url(ip, d.Port)}
+	}
+
+	return backends, nil
+}
+
+// resolveSRV only uses the targets with the lowest priority, others are
+// fallbacks.
+func (d *DNS) resolveSRV(r *resolver, name string) ([]Backend, error) {
+	answers, additionals, err := r.query(name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*dnsmessage.SRVResource
+	for _, answer := range answers {
+		srv, ok := answer.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+
+		if len(targets) > 0 && srv.Priority > targets[0].Priority {
+			continue
+		}
+
+		if len(targets) > 0 && srv.Priority < targets[0].Priority {
+			targets = targets[:0]
+		}
+
+		targets = append(targets, srv)
+	}
+
+	var backends []Backend
+	for _, target := range targets {
+		ips, err := r.addresses(target.Target.String(), additionals)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range ips {
+			backends = append(backends, Backend{URL: d.url(ip, int(target.Port))})
+		}
+	}
+
+	return backends, nil
+}
+
+func (d *DNS) url(ip net.IP, port int) string {
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	host := ip.String()
+	if port > 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+
+	return scheme + "://" + host
+}
+
+// resolver sends queries to one server and keeps the lowest TTL it saw.
+type resolver struct {
+	server string
+	ttl    time.Duration
+}
+
+// addresses returns the A and AAAA records of a name, records already in
+// known are used without a query. A failed query only fails the lookup when
+// the other one found no addresses either.
+func (r *resolver) addresses(name string, known []dnsmessage.Resource) ([]net.IP, error) {
+	if ips := r.collect(name, known); len(ips) > 0 {
+		return ips, nil
+	}
+
+	var ips []net.IP
+	var failed error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, _, err := r.query(name, qtype)
+		if err != nil {
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+
+		ips = append(ips, r.collect("", answers)...)
+	}
+
+	if len(ips) == 0 {
+		return nil, failed
+	}
+
+	if failed != nil && failed != errNoSuchHost {
+		log.Printf("Using the addresses found for %s, error resolving the others: %s", name, failed.Error())
+	}
+
+	return ips, nil
+}
+
+// collect returns the addresses in records, only those for name when it is
+// set.
+func (r *resolver) collect(name string, records []dnsmessage.Resource) []net.IP {
+	var ips []net.IP
+
+	for _, record := range records {
+		if name != "" && !strings.EqualFold(record.Header.Name.String(), fqdn(name)) {
+			continue
+		}
+
+		switch body := record.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+
+		r.observe(record.Header.TTL)
+	}
+
+	return ips
+}
+
+func (r *resolver) observe(ttl uint32) {
+	d := time.Duration(ttl) * time.Second
+	if d < minTTL {
+		d = minTTL
+	}
+
+	if d < r.ttl {
+		r.ttl = d
+	}
+}
+
+func (r *resolver) query(name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, []dnsmessage.Resource, error) {
+	qname, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	packed, err := request.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := r.exchange("udp", packed)
+	if err == nil && response.Header.Truncated {
+		response, err = r.exchange("tcp", packed)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if response.Header.ID != request.Header.ID {
+		return nil, nil, errors.New("response id does not match the query")
+	}
+
+	switch response.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil, errNoSuchHost
+	default:
+		return nil, nil, fmt.Errorf("lookup %s failed: %s", name, response.Header.RCode.String())
+	}
+
+	for _, answer := range response.Answers {
+		if answer.Header.Type == qtype {
+			r.observe(answer.Header.TTL)
+		}
+	}
+
+	return response.Answers, response.Additionals, nil
+}
+
+// exchange sends a query, over tcp messages are prefixed with their length.
+func (r *resolver) exchange(network string, packed []byte) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, r.server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(dnsTimeout)); err != nil {
+		return nil, err
+	}
+
+	var reply []byte
+	if network == "tcp" {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(packed)))
+		if _, err := conn.Write(append(length, packed...)); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+
+		reply = make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+
+		reply = make([]byte, 65535)
+		n, err := conn.Read(reply)
+		if err != nil {
+			return nil, err
+		}
+		reply = reply[:n]
+	}
+
+	response := &dnsmessage.Message{}
+	if err := response.Unpack(reply); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+
+	return name + "."
+}
+
+// dnsConfig is the part of /etc/resolv.conf lookups use.
+type dnsConfig struct {
+	server string
+	search []string
+	ndots  int
+}
+
+// readResolvConf returns the first nameserver, the search domains and
+// ndots, the last search or domain line wins.
+func readResolvConf(path string) *dnsConfig {
+	conf := &dnsConfig{server: defaultServer, ndots: 1}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return conf
+	}
+	defer f.Close()
+
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			if !found {
+				conf.server = net.JoinHostPort(fields[1], "53")
+				found = true
+			}
+		case "domain":
+			conf.search = fields[1:2]
+		case "search":
+			conf.search = fields[1:]
+		case "options":
+			for _, option := range fields[1:] {
+				if !strings.HasPrefix(option, "ndots:") {
+					continue
+				}
+
+				if n, err := strconv.Atoi(strings.TrimPrefix(option, "ndots:")); err == nil && n >= 0 {
+					conf.ndots = n
+				}
+			}
+		}
+	}
+
+	return conf
+}
+
+// names returns the names to look up in order. Names with fewer dots than
+// ndots are tried with the search domains first, others as they are first,
+// and names ending in a dot only as they are.
+func (c *dnsConfig) names(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+
+	names := make([]string, 0, len(c.search)+1)
+	for _, domain := range c.search {
+		names = append(names, name+"."+strings.Trim(domain, "."))
+	}
+
+	if strings.Count(name, ".") >= c.ndots {
+		return append([]string{name}, names...)
+	}
+
+	return append(names, name)
+}
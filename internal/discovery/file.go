@@ -0,0 +1,241 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	fileInterval = time.Second
+	fileDebounce = time.Second
+)
+
+// File reads backends from a JSON or YAML file, or from every such file in
+// a directory. A file either lists backends or has them under a backends
+// key, each written as a url or as an object with a weight and metadata.
+type File struct {
+	Path string
+	// Interval between checks for changes, defaults to 1s
+	Interval time.Duration
+	// Debounce is how long files must stay unchanged before they are read,
+	// so a file being written is not read half way, defaults to 1s
+	Debounce time.Duration
+}
+
+func (f *File) String() string {
+	return "file " + f.Path
+}
+
+// Run reads the files once they settle after every change. Files that fail
+// to read or validate are logged and keep the current backends until they
+// change again.
+func (f *File) Run(done <-chan bool, update func([]Backend)) {
+	interval := f.Interval
+	if interval <= 0 {
+		interval = fileInterval
+	}
+
+	debounce := f.Debounce
+	if debounce <= 0 {
+		debounce = fileDebounce
+	}
+
+	f.load(update)
+	last := f.snapshot()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var changed time.Time
+	for {
+		select {
+		case <-ticker.C:
+			current := f.snapshot()
+			if current != last {
+				last = current
+				changed = time.Now()
+				continue
+			}
+
+			if !changed.IsZero() && time.Since(changed) >= debounce {
+				changed = time.Time{}
+				f.load(update)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (f *File) load(update func([]Backend)) {
+	backends, err := f.Read()
+	if err != nil {
+		log.Printf("Error reading backends from %s: %s", f.Path, err.Error())
+		return
+	}
+
+	update(backends)
+}
+
+// Read returns the validated backends of every file, files listing no
+// backends are valid and leave the pool with none.
+func (f *File) Read() ([]Backend, error) {
+	paths, err := f.files()
+	if err != nil {
+		return nil, err
+	}
+
+	var backends []Backend
+	seen := make(map[string]string)
+	for _, path := range paths {
+		found, err := readBackends(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+
+		for i, b := range found {
+			field := fmt.Sprintf("%s: backends[%d]", path, i)
+
+			if err := checkURL(b.URL); err != nil {
+				return nil, fmt.Errorf("%s.url: %s", field, err.Error())
+			}
+
+			if b.Weight < 0 {
+				return nil, fmt.Errorf("%s.weight: must not be negative", field)
+			}
+
+			if other, ok := seen[b.URL]; ok {
+				return nil, fmt.Errorf("%s.url: duplicate backend %s, also in %s", field, b.URL, other)
+			}
+			seen[b.URL] = path
+
+			backends = append(backends, b)
+		}
+	}
+
+	return backends, nil
+}
+
+// files returns the path itself, or the JSON and YAML files of a directory
+// sorted by name. Hidden files are skipped as editors and config
+// management write temporary files that way.
+func (f *File) files() ([]string, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{f.Path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || format(name) == "" {
+			continue
+		}
+
+		paths = append(paths, filepath.Join(f.Path, name))
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// snapshot describes the size and modification time of every file, it
+// changes whenever a file is written, added or removed.
+func (f *File) snapshot() string {
+	paths, err := f.files()
+	if err != nil {
+		return err.Error()
+	}
+
+	var snapshot strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		fmt.Fprintf(&snapshot, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return snapshot.String()
+}
+
+func format(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	default:
+		return ""
+	}
+}
+
+func readBackends(path string) ([]Backend, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if format(path) == "yaml" {
+		var values interface{}
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+
+		if data, err = json.Marshal(values); err != nil {
+			return nil, err
+		}
+	}
+
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var backends []Backend
+		if err := json.Unmarshal(data, &backends); err != nil {
+			return nil, err
+		}
+
+		return backends, nil
+	}
+
+	file := struct {
+		Backends []Backend `json:"backends"`
+	}{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, err
+	}
+
+	return file.Backends, nil
+}
+
+func checkURL(backend string) error {
+	endpoint, err := url.ParseRequestURI(backend)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid backend url %q", backend)
+	}
+
+	return nil
+}
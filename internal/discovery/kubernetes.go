@@ -0,0 +1,572 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	kubernetesRetry        = 5 * time.Second
+	kubernetesWatchTimeout = 5 * time.Minute
+)
+
+// serviceAccountDir holds the credentials of pods, a var so tests can
+// point it elsewhere.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// errExpired is returned when the resource version of a watch is too old
+// and the slices must be listed again.
+var errExpired = errors.New("resource version expired")
+
+// Kubernetes watches the EndpointSlices of a service. Ready endpoints are
+// backends, terminating endpoints drain and unready ones are left out.
+type Kubernetes struct {
+	// Namespace of the service, defaults to the namespace of the
+	// credentials or default
+	Namespace string
+	Service   string
+	// Port is the name or number of the slices' port, defaults to their first
+	Port string
+	// Scheme of the backends, defaults to http
+	Scheme string
+	// Kubeconfig is read for credentials, in-cluster credentials are used
+	// when it is empty
+	Kubeconfig string
+}
+
+type kubernetesClient struct {
+	server    string
+	namespace string
+	token     string
+	tokenFile string
+	http      *http.Client
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	AddressType string `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready       *bool `json:"ready"`
+			Terminating bool  `json:"terminating"`
+		} `json:"conditions"`
+		NodeName  string `json:"nodeName"`
+		Zone      string `json:"zone"`
+		TargetRef struct {
+			Name string `json:"name"`
+		} `json:"targetRef"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (k *Kubernetes) String() string {
+	return "kubernetes " + k.Service
+}
+
+func (k *Kubernetes) Run(done <-chan bool, update func([]Backend)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	for {
+		err := k.watch(ctx, update)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("Error watching endpoint slices of %s: %s", k.Service, err.Error())
+
+		select {
+		case <-time.After(kubernetesRetry):
+		case <-done:
+			return
+		}
+	}
+}
+
+// watch lists the service's slices and follows their changes until an
+// error other than a closed watch.
+func (k *Kubernetes) watch(ctx context.Context, update func([]Backend)) error {
+	client, err := k.client()
+	if err != nil {
+		return err
+	}
+	defer client.http.CloseIdleConnections()
+
+	slices, version, err := k.list(ctx, client)
+	if err != nil {
+		return err
+	}
+	k.report(slices, update)
+
+	for {
+		version, err = k.follow(ctx, client, slices, version, update)
+		if err == errExpired {
+			if slices, version, err = k.list(ctx, client); err != nil {
+				return err
+			}
+			k.report(slices, update)
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (k *Kubernetes) list(ctx context.Context, client *kubernetesClient) (map[string]*endpointSlice, string, error) {
+	resp, err := client.get(ctx, k.path(client, nil))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	list := struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*endpointSlice `json:"items"`
+	}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+
+	slices := make(map[string]*endpointSlice)
+	for _, slice := range list.Items {
+		slices[slice.Metadata.Name] = slice
+	}
+
+	return slices, list.Metadata.ResourceVersion, nil
+}
+
+// follow applies watch events to slices and returns the last resource
+// version once the API server closes the watch.
+func (k *Kubernetes) follow(ctx context.Context, client *kubernetesClient, slices map[string]*endpointSlice, version string, update func([]Backend)) (string, error) {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("resourceVersion", version)
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("timeoutSeconds", strconv.Itoa(int(kubernetesWatchTimeout.Seconds())))
+
+	resp, err := client.get(ctx, k.path(client, query))
+	if err != nil {
+		return version, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := &watchEvent{}
+		if err := decoder.Decode(event); err != nil {
+			if ctx.Err() != nil {
+				return version, ctx.Err()
+			}
+
+			// the API server ends watches after timeoutSeconds
+			return version, nil
+		}
+
+		if event.Type == "ERROR" {
+			status := struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}{}
+			_ = json.Unmarshal(event.Object, &status)
+
+			if status.Code == http.StatusGone {
+				return version, errExpired
+			}
+
+			return version, fmt.Errorf("watch failed: %s", status.Message)
+		}
+
+		slice := &endpointSlice{}
+		if err := json.Unmarshal(event.Object, slice); err != nil {
+			return version, err
+		}
+		version = slice.Metadata.ResourceVersion
+
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			slices[slice.Metadata.Name] = slice
+		case "DELETED":
+			delete(slices, slice.Metadata.Name)
+		default:
+			continue
+		}
+
+		k.report(slices, update)
+	}
+}
+
+func (k *Kubernetes) report(slices map[string]*endpointSlice, update func([]Backend)) {
+	backends := k.backends(slices)
+
+	ready := 0
+	for _, b := range backends {
+		if !b.Draining {
+			ready++
+		}
+	}
+
+	if ready == 0 {
+		log.Printf("No ready endpoints for %s, removing its backends", k.Service)
+	}
+
+	update(backends)
+}
+
+// backends returns one backend per address of ready and terminating
+// endpoints, on the port picked from each slice.
+func (k *Kubernetes) backends(slices map[string]*endpointSlice) []Backend {
+	names := make([]string, 0, len(slices))
+	for name := range slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var backends []Backend
+	for _, name := range names {
+		slice := slices[name]
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			continue
+		}
+
+		port, ok := k.port(slice)
+		if !ok {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// a missing ready condition means ready
+			ready := endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+			terminating := endpoint.Conditions.Terminating
+			if !ready && !terminating {
+				continue
+			}
+
+			for _, address := range endpoint.Addresses {
+				backends = append(backends, Backend{
+					URL:      k.url(address, port),
+					Draining: terminating,
+					Metadata: map[string]string{
+						"pod":  endpoint.TargetRef.Name,
+						"node": endpoint.NodeName,
+						"zone": endpoint.Zone,
+					},
+				})
+			}
+		}
+	}
+
+	return backends
+}
+
+func (k *Kubernetes) port(slice *endpointSlice) (int, bool) {
+	for _, p := range slice.Ports {
+		if k.Port == "" || k.Port == p.Name || k.Port == strconv.Itoa(p.Port) {
+			return p.Port, true
+		}
+	}
+
+	return 0, false
+}
+
+func (k *Kubernetes) url(address string, port int) string {
+	scheme := k.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	return scheme + "://" + net.JoinHostPort(address, strconv.Itoa(port))
+}
+
+func (k *Kubernetes) path(client *kubernetesClient, query url.Values) string {
+	namespace := k.Namespace
+	if namespace == "" {
+		namespace = client.namespace
+	}
+
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("labelSelector", "kubernetes.io/service-name="+k.Service)
+
+	return fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s", url.PathEscape(namespace), query.Encode())
+}
+
+// client reads the credentials on every watch so rotated certificates are
+// picked up.
+func (k *Kubernetes) client() (*kubernetesClient, error) {
+	if k.Kubeconfig != "" {
+		return kubeconfigClient(k.Kubeconfig)
+	}
+
+	return inClusterClient()
+}
+
+func (c *kubernetesClient) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.server, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// service account tokens are rotated, so they are read for each request
+	token := c.token
+	if c.tokenFile != "" {
+		data, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errExpired
+		}
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+func inClusterClient() (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster, set a kubeconfig")
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := caConfig(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := "default"
+	if data, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	return &kubernetesClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		namespace: namespace,
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		http:      newKubernetesHTTP(tlsConfig),
+	}, nil
+}
+
+// kubeconfig holds the parts of a kubeconfig used to reach the API server.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// kubeconfigClient uses the current context of a kubeconfig, with token or
+// client certificate credentials.
+func kubeconfigClient(path string) (*kubernetesClient, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &kubeconfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	dir := filepath.Dir(path)
+	client := &kubernetesClient{namespace: "default"}
+	tlsConfig := &tls.Config{}
+
+	var clusterName, userName string
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			if c.Context.Namespace != "" {
+				client.namespace = c.Context.Namespace
+			}
+		}
+	}
+
+	if clusterName == "" {
+		return nil, fmt.Errorf("%s: context %q not found", path, config.CurrentContext)
+	}
+
+	for _, c := range config.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+
+		client.server = c.Cluster.Server
+
+		ca, err := readData(dir, c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, err
+		}
+
+		if ca != nil {
+			if tlsConfig, err = caConfig(ca); err != nil {
+				return nil, err
+			}
+		}
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+	}
+
+	if client.server == "" {
+		return nil, fmt.Errorf("%s: cluster %q not found", path, clusterName)
+	}
+
+	for _, u := range config.Users {
+		if u.Name != userName {
+			continue
+		}
+
+		client.token = u.User.Token
+		if u.User.TokenFile != "" {
+			client.tokenFile = resolve(dir, u.User.TokenFile)
+		}
+
+		cert, err := readData(dir, u.User.ClientCertificateData, u.User.ClientCertificate)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := readData(dir, u.User.ClientKeyData, u.User.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	client.http = newKubernetesHTTP(tlsConfig)
+
+	return client, nil
+}
+
+func caConfig(ca []byte) (*tls.Config, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in certificate authority")
+	}
+
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// readData returns base64 encoded data, or the content of a file relative
+// to the kubeconfig.
+func readData(dir, data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	if file != "" {
+		return ioutil.ReadFile(resolve(dir, file))
+	}
+
+	return nil, nil
+}
+
+func resolve(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(dir, path)
+}
+
+// newKubernetesHTTP has no timeout as watches stay open, each request is
+// bounded by the watch's timeoutSeconds instead.
+func newKubernetesHTTP(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,165 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Backend is written either as a url or as an object with a weight and
+// metadata. Draining backends get no new requests, they are only kept while
+// they were already part of the pool.
+type Backend struct {
+	URL      string            `json:"url"`
+	Weight   int               `json:"weight,omitempty"`
+	Draining bool              `json:"draining,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (b *Backend) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		*b = Backend{}
+		return json.Unmarshal(data, &b.URL)
+	}
+
+	type plain Backend
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+// Provider finds backends and reports the full set each time it is looked
+// up. Lookups that fail are not reported, so an outage of the provider
+// keeps the current backends.
+type Provider interface {
+	String() string
+	Run(done <-chan bool, update func([]Backend))
+}
+
+// Pool is kept in sync with the discovered backends.
+type Pool interface {
+	Sync(backends []string, weights map[string]int) error
+	Drain(backends []string) error
+}
+
+// Discoverer merges static backends with the latest set of every provider
+// and syncs the pool whenever the result changes.
+type Discoverer struct {
+	sync.Mutex
+	pool   Pool
+	static []Backend
+	found  map[string][]Backend
+	synced []Backend
+}
+
+func New(p Pool, static []Backend) *Discoverer {
+	return &Discoverer{
+		pool:   p,
+		static: static,
+		found:  make(map[string][]Backend),
+	}
+}
+
+// Start runs the provider until done is closed.
+func (d *Discoverer) Start(provider Provider, done <-chan bool) {
+	go provider.Run(done, func(backends []Backend) {
+		d.update(provider.String(), backends)
+	})
+}
+
+// SetStatic replaces the backends that are always part of the pool.
+func (d *Discoverer) SetStatic(static []Backend) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.static = static
+	d.sync()
+}
+
+func (d *Discoverer) update(provider string, backends []Backend) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.found[provider] = backends
+	d.sync()
+}
+
+func (d *Discoverer) sync() {
+	merged := merge(d.static, d.found, d.synced)
+	if reflect.DeepEqual(merged, d.synced) {
+		return
+	}
+
+	urls := make([]string, len(merged))
+	weights := make(map[string]int)
+	var draining []string
+	for i, b := range merged {
+		urls[i] = b.URL
+		if b.Weight > 0 {
+			weights[b.URL] = b.Weight
+		}
+
+		if b.Draining {
+			draining = append(draining, b.URL)
+		}
+	}
+
+	if err := d.pool.Sync(urls, weights); err != nil {
+		log.Printf("Error syncing discovered backends: %s", err.Error())
+		return
+	}
+
+	if len(draining) > 0 {
+		if err := d.pool.Drain(draining); err != nil {
+			log.Printf("Error draining discovered backends: %s", err.Error())
+		}
+	}
+
+	log.Printf("Synced %d discovered backends", len(merged))
+	d.synced = merged
+}
+
+// merge returns every backend once, sorted by url. Static backends win
+// over discovered ones with the same url, draining backends are dropped
+// unless they were synced before.
+func merge(static []Backend, found map[string][]Backend, synced []Backend) []Backend {
+	seen := make(map[string]bool)
+	merged := []Backend{}
+
+	known := make(map[string]bool)
+	for _, b := range synced {
+		known[b.URL] = true
+	}
+
+	add := func(backends []Backend) {
+		for _, b := range backends {
+			if b.Draining && !known[b.URL] {
+				continue
+			}
+
+			if !seen[b.URL] {
+				seen[b.URL] = true
+				merged = append(merged, b)
+			}
+		}
+	}
+
+	add(static)
+
+	providers := make([]string, 0, len(found))
+	for name := range found {
+		providers = append(providers, name)
+	}
+	sort.Strings(providers)
+
+	for _, name := range providers {
+		add(found[name])
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].URL < merged[j].URL
+	})
+
+	return merged
+}
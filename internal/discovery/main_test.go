@@ -0,0 +1,766 @@
+package discovery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/CoderCookE/goaround/internal/assert"
+)
+
+type fakePool struct {
+	sync.Mutex
+	backends []string
+	weights  map[string]int
+	drained  []string
+	syncs    int
+	err      error
+}
+
+func (f *fakePool) Sync(backends []string, weights map[string]int) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	f.backends = backends
+	f.weights = weights
+	f.syncs++
+	return nil
+}
+
+func (f *fakePool) Drain(backends []string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.drained = backends
+	return nil
+}
+
+func (f *fakePool) draining() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.drained
+}
+
+func (f *fakePool) current() []string {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.backends
+}
+
+// dnsStub answers queries from a set of records that tests can change.
+type dnsStub struct {
+	sync.Mutex
+	conn    net.PacketConn
+	records map[dnsmessage.Type][]dnsmessage.Resource
+	failing map[dnsmessage.Type]bool
+	queries int
+}
+
+func newDNSStub(t *testing.T) *dnsStub {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &dnsStub{conn: conn, records: make(map[dnsmessage.Type][]dnsmessage.Resource), failing: make(map[dnsmessage.Type]bool)}
+	go stub.serve()
+
+	return stub
+}
+
+func (s *dnsStub) set(qtype dnsmessage.Type, records ...dnsmessage.Resource) {
+	s.Lock()
+	s.records[qtype] = records
+	s.Unlock()
+}
+
+func (s *dnsStub) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		query := &dnsmessage.Message{}
+		if err := query.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		s.Lock()
+		s.queries++
+		question := query.Questions[0]
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.Header.ID, Response: true},
+			Questions: query.Questions,
+		}
+
+		for _, record := range s.records[question.Type] {
+			if record.Header.Name == question.Name {
+				response.Answers = append(response.Answers, record)
+			}
+		}
+
+		if question.Type == dnsmessage.TypeSRV {
+			response.Additionals = s.records[dnsmessage.TypeA]
+		}
+
+		if len(response.Answers) == 0 && strings.HasPrefix(question.Name.String(), "missing") {
+			response.Header.RCode = dnsmessage.RCodeNameError
+		}
+
+		if s.failing[question.Type] {
+			response.Answers = nil
+			response.Header.RCode = dnsmessage.RCodeServerFailure
+		}
+		s.Unlock()
+
+		packed, err := response.Pack()
+		if err == nil {
+			_, _ = s.conn.WriteTo(packed, addr)
+		}
+	}
+}
+
+func a(name string, ttl uint32, ip string) dnsmessage.Resource {
+	resource := &dnsmessage.AResource{}
+	copy(resource.A[:], net.ParseIP(ip).To4())
+
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   resource,
+	}
+}
+
+func aaaa(name string, ttl uint32, ip string) dnsmessage.Resource {
+	resource := &dnsmessage.AAAAResource{}
+	copy(resource.AAAA[:], net.ParseIP(ip).To16())
+
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   resource,
+	}
+}
+
+func srv(name string, ttl uint32, priority, port uint16, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.SRVResource{Priority: priority, Port: port, Target: dnsmessage.MustNewName(target)},
+	}
+}
+
+func TestDiscoverer(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	t.Run("merges static and discovered backends", func(t *testing.T) {
+		pool := &fakePool{}
+		d := New(pool, []Backend{{URL: "http://localhost:9000", Weight: 2}})
+
+		d.update("dns a", []Backend{{URL: "http://10.0.0.2"}, {URL: "http://localhost:9000"}})
+		d.update("dns b", []Backend{{URL: "http://10.0.0.1"}})
+		assertion.Equal(strings.Join(pool.current(), ","), "http://10.0.0.1,http://10.0.0.2,http://localhost:9000")
+		assertion.Equal(pool.weights["http://localhost:9000"], 2)
+
+		d.update("dns b", []Backend{{URL: "http://10.0.0.1"}})
+		assertion.Equal(pool.syncs, 2)
+
+		d.SetStatic(nil)
+		assertion.Equal(strings.Join(pool.current(), ","), "http://10.0.0.1,http://10.0.0.2,http://localhost:9000")
+	})
+
+	t.Run("drains known backends and skips new draining ones", func(t *testing.T) {
+		pool := &fakePool{}
+		d := New(pool, nil)
+
+		d.update("k8s", []Backend{{URL: "http://10.0.0.1"}, {URL: "http://10.0.0.2", Draining: true}})
+		assertion.Equal(strings.Join(pool.current(), ","), "http://10.0.0.1")
+		assertion.Equal(len(pool.draining()), 0)
+
+		d.update("k8s", []Backend{{URL: "http://10.0.0.1", Draining: true}, {URL: "http://10.0.0.3"}})
+		assertion.Equal(strings.Join(pool.current(), ","), "http://10.0.0.1,http://10.0.0.3")
+		assertion.Equal(strings.Join(pool.draining(), ","), "http://10.0.0.1")
+
+		d.update("k8s", []Backend{{URL: "http://10.0.0.3"}})
+		assertion.Equal(strings.Join(pool.current(), ","), "http://10.0.0.3")
+	})
+
+	t.Run("retries a failed sync on the next update", func(t *testing.T) {
+		pool := &fakePool{err: errors.New("pool capacity exceeded")}
+		d := New(pool, nil)
+
+		d.update("dns", []Backend{{URL: "http://10.0.0.1"}})
+		assertion.Equal(pool.syncs, 0)
+
+		pool.err = nil
+		d.update("dns", []Backend{{URL: "http://10.0.0.1"}})
+		assertion.Equal(pool.syncs, 1)
+	})
+}
+
+func TestDNS(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	stub := newDNSStub(t)
+	defer stub.conn.Close()
+
+	t.Run("expands a hostname to its addresses", func(t *testing.T) {
+		stub.set(dnsmessage.TypeA, a("backend.test.", 30, "10.0.0.1"), a("backend.test.", 20, "10.0.0.2"))
+		stub.set(dnsmessage.TypeAAAA, aaaa("backend.test.", 60, "fd00::1"))
+
+		d := &DNS{Name: "backend.test", Port: 8080, Server: stub.conn.LocalAddr().String()}
+		backends, ttl, err := d.Resolve()
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 3)
+		assertion.Equal(backends[0].URL, "http://10.0.0.1:8080")
+		assertion.Equal(backends[2].URL, "http://[fd00::1]:8080")
+		assertion.Equal(ttl, 20*time.Second)
+	})
+
+	t.Run("expands srv records to the addresses of their targets", func(t *testing.T) {
+		stub.set(dnsmessage.TypeSRV,
+			srv("_http._tcp.backend.test.", 10, 1, 9001, "one.test."),
+			srv("_http._tcp.backend.test.", 10, 1, 9002, "two.test."),
+			srv("_http._tcp.backend.test.", 10, 2, 9003, "fallback.test."),
+		)
+		stub.set(dnsmessage.TypeA, a("one.test.", 30, "10.0.1.1"), a("two.test.", 0, "10.0.1.2"), a("fallback.test.", 30, "10.0.1.3"))
+
+		d := &DNS{Name: "_http._tcp.backend.test", SRV: true, Scheme: "https", Server: stub.conn.LocalAddr().String()}
+		backends, ttl, err := d.Resolve()
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 2)
+		assertion.Equal(backends[0].URL, "https://10.0.1.1:9001")
+		assertion.Equal(backends[1].URL, "https://10.0.1.2:9002")
+		assertion.Equal(ttl, minTTL)
+	})
+
+	t.Run("finds no backends without records", func(t *testing.T) {
+		d := &DNS{Name: "missing.test", Server: stub.conn.LocalAddr().String()}
+		backends, ttl, err := d.Resolve()
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 0)
+		assertion.Equal(ttl, dnsRetry)
+
+		d = &DNS{Name: "empty.test", Server: stub.conn.LocalAddr().String()}
+		backends, _, err = d.Resolve()
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 0)
+	})
+
+	t.Run("uses one address family when the other fails", func(t *testing.T) {
+		stub.set(dnsmessage.TypeA, a("backend.test.", 30, "10.0.0.1"))
+		stub.Lock()
+		stub.failing[dnsmessage.TypeAAAA] = true
+		stub.Unlock()
+		defer func() {
+			stub.Lock()
+			stub.failing[dnsmessage.TypeAAAA] = false
+			stub.Unlock()
+		}()
+
+		d := &DNS{Name: "backend.test", Server: stub.conn.LocalAddr().String()}
+		backends, _, err := d.Resolve()
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 1)
+		assertion.Equal(backends[0].URL, "http://10.0.0.1")
+
+		stub.set(dnsmessage.TypeA)
+		_, _, err = d.Resolve()
+		assertion.Equal(err.Error(), "lookup backend.test failed: RCodeServerFailure")
+	})
+
+	t.Run("completes names with the search domains", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "goaround")
+		assertion.Equal(err, nil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "resolv.conf")
+		data := "nameserver 10.96.0.10\nsearch shop.svc.cluster.local svc.cluster.local\noptions ndots:5 timeout:1\n"
+		assertion.Equal(ioutil.WriteFile(path, []byte(data), 0600), nil)
+
+		conf := readResolvConf(path)
+		assertion.Equal(conf.server, "10.96.0.10:53")
+		assertion.Equal(conf.ndots, 5)
+		assertion.Equal(strings.Join(conf.names("orders.payments"), ","), "orders.payments.shop.svc.cluster.local,orders.payments.svc.cluster.local,orders.payments")
+		assertion.Equal(strings.Join(conf.names("orders."), ","), "orders.")
+
+		conf.ndots = 1
+		assertion.Equal(strings.Join(conf.names("orders.payments"), ","), "orders.payments,orders.payments.shop.svc.cluster.local,orders.payments.svc.cluster.local")
+
+		defer func(previous string) { resolvConf = previous }(resolvConf)
+		resolvConf = path
+
+		stub.set(dnsmessage.TypeA, a("orders.svc.cluster.local.", 30, "10.0.2.1"))
+		stub.set(dnsmessage.TypeAAAA)
+
+		d := &DNS{Name: "orders", Server: stub.conn.LocalAddr().String()}
+		backends, _, err := d.Resolve()
+		assertion.Equal(err, nil)
+		assertion.Equal(backends[0].URL, "http://10.0.2.1")
+	})
+
+	t.Run("re-resolves on the interval and syncs changes", func(t *testing.T) {
+		stub.set(dnsmessage.TypeA, a("backend.test.", 30, "10.0.0.1"))
+		stub.set(dnsmessage.TypeAAAA)
+
+		pool := &fakePool{}
+		done := make(chan bool)
+		defer close(done)
+
+		New(pool, nil).Start(&DNS{Name: "backend.test", Server: stub.conn.LocalAddr().String(), Interval: 20 * time.Millisecond}, done)
+
+		wait := func(expected string) {
+			deadline := time.Now().Add(5 * time.Second)
+			for strings.Join(pool.current(), ",") != expected && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assertion.Equal(strings.Join(pool.current(), ","), expected)
+		}
+
+		wait("http://10.0.0.1")
+
+		stub.set(dnsmessage.TypeA, a("backend.test.", 30, "10.0.0.1"), a("backend.test.", 30, "10.0.0.3"))
+		wait("http://10.0.0.1,http://10.0.0.3")
+
+		stub.Lock()
+		stub.failing[dnsmessage.TypeA] = true
+		stub.failing[dnsmessage.TypeAAAA] = true
+		stub.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		wait("http://10.0.0.1,http://10.0.0.3")
+
+		stub.Lock()
+		stub.failing[dnsmessage.TypeA] = false
+		stub.failing[dnsmessage.TypeAAAA] = false
+		stub.Unlock()
+		stub.set(dnsmessage.TypeA)
+		wait("")
+	})
+}
+
+func TestFile(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		assertion.Equal(ioutil.WriteFile(path, []byte(content), 0600), nil)
+		return path
+	}
+
+	t.Run("reads backends with weights and metadata", func(t *testing.T) {
+		path := write("backends.yaml", "backends:\n  - http://10.0.0.1\n  - url: http://10.0.0.2\n    weight: 3\n    metadata:\n      zone: a\n")
+
+		backends, err := (&File{Path: path}).Read()
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 2)
+		assertion.Equal(backends[1].Weight, 3)
+		assertion.Equal(backends[1].Metadata["zone"], "a")
+	})
+
+	t.Run("merges the files of a directory", func(t *testing.T) {
+		write("web.json", `["http://10.0.0.3", {"url": "http://10.0.0.4", "weight": 2}]`)
+		write(".web.json.swp", "not json")
+		write("README", "not backends")
+
+		backends, err := (&File{Path: dir}).Read()
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 4)
+		assertion.Equal(backends[3].URL, "http://10.0.0.4")
+	})
+
+	t.Run("rejects invalid files", func(t *testing.T) {
+		path := write("web.json", `["http://10.0.0.1"]`)
+		_, err := (&File{Path: dir}).Read()
+		assertion.StringContains(err.Error(), "backends[0].url: duplicate backend http://10.0.0.1, also in")
+
+		write("web.json", `[{"url": "10.0.0.5", "weight": 1}]`)
+		_, err = (&File{Path: path}).Read()
+		assertion.StringContains(err.Error(), `backends[0].url: invalid backend url "10.0.0.5"`)
+
+		write("web.json", `{"backend": []}`)
+		_, err = (&File{Path: path}).Read()
+		assertion.StringContains(err.Error(), `unknown field "backend"`)
+	})
+
+	t.Run("reads files without backends as an empty set", func(t *testing.T) {
+		empty, err := ioutil.TempDir(dir, "empty")
+		assertion.Equal(err, nil)
+
+		backends, err := (&File{Path: empty}).Read()
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 0)
+
+		path := filepath.Join(empty, "web.json")
+		assertion.Equal(ioutil.WriteFile(path, []byte(`[]`), 0600), nil)
+		backends, err = (&File{Path: path}).Read()
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 0)
+
+		assertion.Equal(ioutil.WriteFile(path, []byte(`{"backends": []}`), 0600), nil)
+		backends, err = (&File{Path: path}).Read()
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 0)
+	})
+
+	t.Run("syncs changes once the file settles", func(t *testing.T) {
+		path := write("watched.json", `["http://10.0.1.1"]`)
+
+		pool := &fakePool{}
+		done := make(chan bool)
+		defer close(done)
+
+		New(pool, nil).Start(&File{Path: path, Interval: 10 * time.Millisecond, Debounce: 50 * time.Millisecond}, done)
+
+		wait := func(expected string) {
+			deadline := time.Now().Add(5 * time.Second)
+			for strings.Join(pool.current(), ",") != expected && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assertion.Equal(strings.Join(pool.current(), ","), expected)
+		}
+
+		wait("http://10.0.1.1")
+
+		write("watched.json", `["http://10.0.1.1", "http://10.0.1.2"]`)
+		wait("http://10.0.1.1,http://10.0.1.2")
+
+		write("watched.json", `["http://10.0.1.1", "http://10.0.1.2",`)
+		time.Sleep(200 * time.Millisecond)
+		wait("http://10.0.1.1,http://10.0.1.2")
+		write("watched.json", `[]`)
+		wait("")
+	})
+}
+
+// consulStub answers health queries for the web service, blocking queries
+// wait until the instances change.
+type consulStub struct {
+	sync.Mutex
+	index     uint64
+	instances []map[string]interface{}
+	changed   chan bool
+	queries   []*http.Request
+}
+
+func (c *consulStub) set(instances ...map[string]interface{}) {
+	c.Lock()
+	c.index++
+	c.instances = instances
+	close(c.changed)
+	c.changed = make(chan bool)
+	c.Unlock()
+}
+
+func (c *consulStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/web" || r.URL.Query().Get("passing") != "true" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	c.Lock()
+	c.queries = append(c.queries, r)
+	changed := c.changed
+	index := c.index
+	c.Unlock()
+
+	if r.URL.Query().Get("index") == strconv.FormatUint(index, 10) {
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	var instances []map[string]interface{}
+	for _, instance := range c.instances {
+		tags := instance["Service"].(map[string]interface{})["Tags"].([]string)
+		if tag := r.URL.Query().Get("tag"); tag == "" || strings.Contains(strings.Join(tags, ","), tag) {
+			instances = append(instances, instance)
+		}
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	_ = json.NewEncoder(w).Encode(instances)
+}
+
+func instance(node, address string, port int, tags ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"Node":    map[string]interface{}{"Node": node, "Address": "10.1.0.1"},
+		"Service": map[string]interface{}{"Address": address, "Port": port, "Tags": tags, "Meta": map[string]string{"version": "2"}},
+	}
+}
+
+func TestConsul(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	stub := &consulStub{changed: make(chan bool)}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	t.Run("returns passing instances with the tags", func(t *testing.T) {
+		stub.set(
+			instance("one", "10.0.0.1", 9000, "primary", "v2"),
+			instance("two", "", 9001, "primary"),
+			instance("three", "10.0.0.3", 9002, "secondary"),
+		)
+
+		c := &Consul{Addr: server.URL, Service: "web", Tags: []string{"primary"}, Token: "secret"}
+		backends, index, err := c.Query(context.Background(), 0)
+		assertion.Equal(err, nil)
+		assertion.Equal(index, stub.index)
+		assertion.Equal(len(backends), 2)
+		assertion.Equal(backends[0].URL, "http://10.0.0.1:9000")
+		assertion.Equal(backends[0].Metadata["node"], "one")
+		assertion.Equal(backends[0].Metadata["version"], "2")
+		assertion.Equal(backends[1].URL, "http://10.1.0.1:9001")
+		assertion.Equal(stub.queries[len(stub.queries)-1].Header.Get("X-Consul-Token"), "secret")
+
+		c.Tags = []string{"primary", "v2"}
+		backends, _, err = c.Query(context.Background(), 0)
+		assertion.Equal(err, nil)
+		assertion.Equal(len(backends), 1)
+	})
+
+	t.Run("fails on errors from consul", func(t *testing.T) {
+		c := &Consul{Addr: server.URL, Service: "api"}
+		_, _, err := c.Query(context.Background(), 0)
+		assertion.Equal(err.Error(), "unexpected status 404 Not Found")
+	})
+
+	t.Run("follows changes with blocking queries", func(t *testing.T) {
+		stub.set(instance("one", "10.0.0.1", 9000))
+
+		pool := &fakePool{}
+		done := make(chan bool)
+		defer close(done)
+
+		New(pool, nil).Start(&Consul{Addr: server.URL, Service: "web", Wait: time.Minute}, done)
+
+		wait := func(expected string) {
+			deadline := time.Now().Add(5 * time.Second)
+			for strings.Join(pool.current(), ",") != expected && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assertion.Equal(strings.Join(pool.current(), ","), expected)
+		}
+
+		wait("http://10.0.0.1:9000")
+
+		stub.set(instance("one", "10.0.0.1", 9000), instance("two", "10.0.0.2", 9000))
+		wait("http://10.0.0.1:9000,http://10.0.0.2:9000")
+
+		stub.Lock()
+		last := stub.queries[len(stub.queries)-1].URL.Query()
+		stub.Unlock()
+		assertion.Equal(last.Get("wait"), "1m0s")
+		assertion.NotEqual(last.Get("index"), "")
+
+		stub.set()
+		wait("")
+	})
+}
+
+// kubernetesStub serves the EndpointSlices of the web service, watches
+// stream the events sent on events.
+type kubernetesStub struct {
+	sync.Mutex
+	list    string
+	events  chan string
+	queries []string
+}
+
+func (k *kubernetesStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.Lock()
+	k.queries = append(k.queries, r.URL.RawQuery)
+	list := k.list
+	k.Unlock()
+
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/shop/endpointslices" ||
+		r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=web" ||
+		r.Header.Get("Authorization") != "Bearer token-1" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Query().Get("watch") != "true" {
+		fmt.Fprint(w, list)
+		return
+	}
+
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case event := <-k.events:
+			fmt.Fprintln(w, event)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func slice(name, version string, endpoints ...string) string {
+	return fmt.Sprintf(`{"metadata": {"name": %q, "resourceVersion": %q}, "addressType": "IPv4", "ports": [{"name": "metrics", "port": 9090}, {"name": "http", "port": 8080}], "endpoints": [%s]}`,
+		name, version, strings.Join(endpoints, ","))
+}
+
+func endpoint(address string, ready, terminating bool) string {
+	return fmt.Sprintf(`{"addresses": [%q], "conditions": {"ready": %t, "terminating": %t}, "nodeName": "node-1", "targetRef": {"kind": "Pod", "name": "web-%s"}}`,
+		address, ready, terminating, address)
+}
+
+func TestKubernetes(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	stub := &kubernetesStub{events: make(chan string)}
+	server := httptest.NewTLSServer(stub)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	t.Run("maps ready and terminating endpoints", func(t *testing.T) {
+		slices := make(map[string]*endpointSlice)
+		for _, s := range []string{
+			slice("web-a", "1", endpoint("10.0.0.1", true, false), endpoint("10.0.0.2", false, false), endpoint("10.0.0.3", false, true)),
+			`{"metadata": {"name": "web-b"}, "addressType": "FQDN", "ports": [{"name": "http", "port": 80}], "endpoints": [{"addresses": ["web.test"]}]}`,
+			`{"metadata": {"name": "web-c"}, "addressType": "IPv4", "ports": [{"name": "grpc", "port": 9000}], "endpoints": [{"addresses": ["10.0.0.4"]}]}`,
+		} {
+			parsed := &endpointSlice{}
+			assertion.Equal(json.Unmarshal([]byte(s), parsed), nil)
+			slices[parsed.Metadata.Name] = parsed
+		}
+
+		backends := (&Kubernetes{Service: "web", Port: "http"}).backends(slices)
+		assertion.Equal(len(backends), 2)
+		assertion.Equal(backends[0].URL, "http://10.0.0.1:8080")
+		assertion.Equal(backends[0].Metadata["pod"], "web-10.0.0.1")
+		assertion.False(backends[0].Draining)
+		assertion.Equal(backends[1].URL, "http://10.0.0.3:8080")
+		assertion.True(backends[1].Draining)
+
+		backends = (&Kubernetes{Service: "web", Port: "9000"}).backends(slices)
+		assertion.Equal(len(backends), 1)
+		assertion.Equal(backends[0].URL, "http://10.0.0.4:9000")
+	})
+
+	t.Run("uses in-cluster credentials", func(t *testing.T) {
+		accountDir := filepath.Join(dir, "serviceaccount")
+		assertion.Equal(os.Mkdir(accountDir, 0700), nil)
+		assertion.Equal(ioutil.WriteFile(filepath.Join(accountDir, "ca.crt"), ca, 0600), nil)
+		assertion.Equal(ioutil.WriteFile(filepath.Join(accountDir, "token"), []byte("token-1\n"), 0600), nil)
+		assertion.Equal(ioutil.WriteFile(filepath.Join(accountDir, "namespace"), []byte("shop"), 0600), nil)
+
+		defer func(original string) { serviceAccountDir = original }(serviceAccountDir)
+		serviceAccountDir = accountDir
+
+		apiServer, _ := url.Parse(server.URL)
+		defer os.Unsetenv("KUBERNETES_SERVICE_HOST")
+		defer os.Unsetenv("KUBERNETES_SERVICE_PORT")
+		assertion.Equal(os.Setenv("KUBERNETES_SERVICE_HOST", apiServer.Hostname()), nil)
+		assertion.Equal(os.Setenv("KUBERNETES_SERVICE_PORT", apiServer.Port()), nil)
+
+		stub.Lock()
+		stub.list = fmt.Sprintf(`{"metadata": {"resourceVersion": "5"}, "items": [%s]}`, slice("web-a", "5", endpoint("10.0.0.1", true, false)))
+		stub.Unlock()
+
+		k := &Kubernetes{Service: "web"}
+		client, err := k.client()
+		assertion.Equal(err, nil)
+
+		slices, version, err := k.list(context.Background(), client)
+		assertion.Equal(err, nil)
+		assertion.Equal(version, "5")
+		assertion.Equal(k.backends(slices)[0].URL, "http://10.0.0.1:9090")
+	})
+
+	t.Run("watches slices with kubeconfig credentials", func(t *testing.T) {
+		kubeconfig := filepath.Join(dir, "kubeconfig")
+		assertion.Equal(ioutil.WriteFile(kubeconfig, []byte(fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+current-context: shop
+contexts:
+  - name: shop
+    context: {cluster: test, user: goaround, namespace: shop}
+clusters:
+  - name: test
+    cluster: {server: %q, certificate-authority-data: %s}
+users:
+  - name: goaround
+    user: {token: token-1}
+`, server.URL, base64.StdEncoding.EncodeToString(ca))), 0600), nil)
+
+		stub.Lock()
+		stub.list = fmt.Sprintf(`{"metadata": {"resourceVersion": "10"}, "items": [%s]}`,
+			slice("web-a", "9", endpoint("10.0.0.1", true, false), endpoint("10.0.0.2", true, false)))
+		stub.Unlock()
+
+		pool := &fakePool{}
+		done := make(chan bool)
+		defer close(done)
+
+		New(pool, nil).Start(&Kubernetes{Service: "web", Port: "http", Kubeconfig: kubeconfig}, done)
+
+		wait := func(expected string) {
+			deadline := time.Now().Add(5 * time.Second)
+			for strings.Join(pool.current(), ",") != expected && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assertion.Equal(strings.Join(pool.current(), ","), expected)
+		}
+
+		wait("http://10.0.0.1:8080,http://10.0.0.2:8080")
+
+		stub.events <- fmt.Sprintf(`{"type": "MODIFIED", "object": %s}`,
+			slice("web-a", "11", endpoint("10.0.0.1", true, false), endpoint("10.0.0.2", false, true), endpoint("10.0.0.3", true, false)))
+		wait("http://10.0.0.1:8080,http://10.0.0.2:8080,http://10.0.0.3:8080")
+		assertion.Equal(strings.Join(pool.draining(), ","), "http://10.0.0.2:8080")
+
+		stub.events <- fmt.Sprintf(`{"type": "MODIFIED", "object": %s}`, slice("web-a", "12", endpoint("10.0.0.1", false, false)))
+		wait("")
+
+		stub.Lock()
+		assertion.StringContains(stub.queries[len(stub.queries)-1], "resourceVersion=10")
+		stub.list = fmt.Sprintf(`{"metadata": {"resourceVersion": "20"}, "items": [%s]}`, slice("web-a", "20", endpoint("10.0.0.3", true, false)))
+		stub.Unlock()
+
+		stub.events <- `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "message": "too old resource version"}}`
+		wait("http://10.0.0.3:8080")
+
+	})
+}
@@ -0,0 +1,244 @@
+package forwarded
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers describing the client, X-Forwarded-For is appended to by the
+// pool's proxy.
+const (
+	For       = "X-Forwarded-For"
+	Proto     = "X-Forwarded-Proto"
+	Host      = "X-Forwarded-Host"
+	Forwarded = "Forwarded"
+)
+
+// Proxies tells backends who the client is. Requests from trusted proxies
+// keep the X-Forwarded-* and Forwarded headers they arrive with, requests
+// from anyone else have them dropped so clients can't spoof their address.
+// Missing proto and host headers are set, and an element for this hop is
+// appended to Forwarded. The client address derived from them is kept for
+// Client.
+type Proxies struct {
+	trusted []*net.IPNet
+	next    http.Handler
+}
+
+type clientKey struct{}
+
+func New(trusted []*net.IPNet, next http.Handler) *Proxies {
+	return &Proxies{trusted: trusted, next: next}
+}
+
+// Parse reads CIDRs, a plain address is a network of its own.
+func Parse(values []string) ([]*net.IPNet, error) {
+	trusted := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", value)
+		}
+		trusted = append(trusted, network)
+	}
+
+	return trusted, nil
+}
+
+func (p *Proxies) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ip := peer(req)
+
+	if !p.Trusted(ip) {
+		for _, name := range []string{For, Proto, Host, Forwarded} {
+			req.Header.Del(name)
+		}
+	}
+
+	if client := p.client(ip, req.Header); client != nil {
+		req = req.WithContext(context.WithValue(req.Context(), clientKey{}, client))
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if req.Header.Get(Proto) == "" {
+		req.Header.Set(Proto, proto)
+	}
+
+	if req.Header.Get(Host) == "" && req.Host != "" {
+		req.Header.Set(Host, req.Host)
+	}
+
+	elements := append(req.Header[Forwarded], element(ip, req.Host, proto))
+	req.Header.Set(Forwarded, strings.Join(elements, ", "))
+
+	p.next.ServeHTTP(w, req)
+}
+
+// Trusted reports whether an address belongs to a trusted proxy.
+func (p *Proxies) Trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Client returns the address of the client a request came from, as derived
+// from the headers of trusted proxies, or the peer's address when the
+// request did not pass through Proxies.
+func Client(req *http.Request) string {
+	if client, ok := req.Context().Value(clientKey{}).(net.IP); ok {
+		return client.String()
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// client walks the addresses trusted proxies appended from the right, the
+// first one not trusted is the client. An address that can't be parsed ends
+// the walk at the last trusted hop.
+func (p *Proxies) client(ip net.IP, header http.Header) net.IP {
+	if !p.Trusted(ip) {
+		return ip
+	}
+
+	hops := addresses(header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			break
+		}
+
+		if !p.Trusted(hop) {
+			return hop
+		}
+		ip = hop
+	}
+
+	return ip
+}
+
+// addresses lists the client addresses of X-Forwarded-For, or of the for
+// parameters of Forwarded when it is missing, with ports and brackets
+// removed.
+func addresses(header http.Header) []string {
+	var hops []string
+	for _, value := range header[For] {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	if len(hops) > 0 {
+		return hops
+	}
+
+	for _, value := range header[Forwarded] {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+					continue
+				}
+
+				hops = append(hops, node(strings.Trim(pair[4:], `"`)))
+			}
+		}
+	}
+
+	return hops
+}
+
+// node strips the port and brackets from a Forwarded node.
+func node(value string) string {
+	if strings.HasPrefix(value, "[") {
+		if end := strings.Index(value, "]"); end > 0 {
+			return value[1:end]
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		return host
+	}
+
+	return value
+}
+
+func peer(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// element describes this hop as RFC 7239 does, IPv6 addresses are bracketed
+// and quoted.
+func element(ip net.IP, host, proto string) string {
+	node := "unknown"
+	if ip != nil {
+		node = ip.String()
+		if ip.To4() == nil {
+			node = `"[` + node + `]"`
+		}
+	}
+
+	value := "for=" + node
+	if host != "" {
+		value += ";host=" + quote(host)
+	}
+
+	return value + ";proto=" + proto
+}
+
+// quote returns a token as is, and anything else as a quoted string.
+func quote(value string) string {
+	for _, c := range value {
+		if !token(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+
+	return value
+}
+
+func token(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	default:
+		return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+	}
+}
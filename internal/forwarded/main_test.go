@@ -0,0 +1,109 @@
+package forwarded
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/CoderCookE/goaround/internal/assert"
+)
+
+func TestProxies(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{For, Proto, Host, Forwarded} {
+			w.Header().Set("Seen-"+name, r.Header.Get(name))
+		}
+	}))
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL)
+	trusted, err := Parse([]string{"10.0.0.0/8", "2001:db8::1"})
+	assertion.Equal(err, nil)
+	proxies := New(trusted, httputil.NewSingleHostReverseProxy(target))
+
+	send := func(remote string, header http.Header) http.Header {
+		request := httptest.NewRequest("GET", "http://shop.example.com/orders", nil)
+		request.RemoteAddr = remote
+		for name, values := range header {
+			request.Header[name] = values
+		}
+
+		recorder := httptest.NewRecorder()
+		proxies.ServeHTTP(recorder, request)
+		return recorder.Header()
+	}
+
+	spoofed := http.Header{
+		For:       {"1.2.3.4"},
+		Proto:     {"https"},
+		Host:      {"evil.example.com"},
+		Forwarded: {"for=1.2.3.4"},
+	}
+
+	t.Run("drops headers from untrusted clients", func(t *testing.T) {
+		seen := send("192.0.2.7:51234", spoofed)
+		assertion.Equal(seen.Get("Seen-"+For), "192.0.2.7")
+		assertion.Equal(seen.Get("Seen-"+Proto), "http")
+		assertion.Equal(seen.Get("Seen-"+Host), "shop.example.com")
+		assertion.Equal(seen.Get("Seen-"+Forwarded), "for=192.0.2.7;host=shop.example.com;proto=http")
+	})
+
+	t.Run("keeps headers from trusted proxies", func(t *testing.T) {
+		seen := send("10.1.2.3:51234", spoofed)
+		assertion.Equal(seen.Get("Seen-"+For), "1.2.3.4, 10.1.2.3")
+		assertion.Equal(seen.Get("Seen-"+Proto), "https")
+		assertion.Equal(seen.Get("Seen-"+Host), "evil.example.com")
+		assertion.Equal(seen.Get("Seen-"+Forwarded), "for=1.2.3.4, for=10.1.2.3;host=shop.example.com;proto=http")
+	})
+
+	t.Run("quotes IPv6 addresses", func(t *testing.T) {
+		seen := send("[2001:db8::1]:51234", nil)
+		assertion.Equal(seen.Get("Seen-"+Forwarded), `for="[2001:db8::1]";host=shop.example.com;proto=http`)
+
+		seen = send("[2001:db8::2]:51234", spoofed)
+		assertion.Equal(seen.Get("Seen-"+For), "2001:db8::2")
+	})
+
+	t.Run("derives the client from trusted hops", func(t *testing.T) {
+		var client string
+		derive := New(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client = Client(r)
+		}))
+
+		check := func(remote string, header http.Header, expected string) {
+			request := httptest.NewRequest("GET", "http://shop.example.com/orders", nil)
+			request.RemoteAddr = remote
+			for name, values := range header {
+				request.Header[name] = values
+			}
+
+			derive.ServeHTTP(httptest.NewRecorder(), request)
+			assertion.Equal(client, expected)
+		}
+
+		check("192.0.2.7:51234", spoofed, "192.0.2.7")
+		check("10.1.2.3:51234", http.Header{For: {"198.51.100.4, 1.2.3.4, 10.9.9.9"}}, "1.2.3.4")
+		check("10.1.2.3:51234", http.Header{For: {"10.9.9.9"}}, "10.9.9.9")
+		check("10.1.2.3:51234", http.Header{For: {"unknown, 10.9.9.9"}}, "10.9.9.9")
+		check("10.1.2.3:51234", http.Header{Forwarded: {`for=1.2.3.4:4711, for="[2001:db8::7]:443"`}}, "2001:db8::7")
+		check("10.1.2.3:51234", nil, "10.1.2.3")
+
+		request := httptest.NewRequest("GET", "http://shop.example.com/orders", nil)
+		request.RemoteAddr = "192.0.2.9:51234"
+		assertion.Equal(Client(request), "192.0.2.9")
+	})
+
+	t.Run("parses addresses and CIDRs", func(t *testing.T) {
+		_, err := Parse([]string{"10.0.0.0/33"})
+		assertion.StringContains(err.Error(), `invalid CIDR "10.0.0.0/33"`)
+
+		_, err = Parse([]string{"proxy.local"})
+		assertion.StringContains(err.Error(), `invalid address "proxy.local"`)
+
+		assertion.Equal(quote("lb.test:8443"), `"lb.test:8443"`)
+	})
+}
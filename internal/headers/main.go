@@ -0,0 +1,312 @@
+package headers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/CoderCookE/goaround/internal/forwarded"
+)
+
+// RequestIDHeader is read for {request_id}, a new id is made when the
+// client sends none.
+const RequestIDHeader = "X-Request-Id"
+
+// Variables that header values may use.
+var Variables = []string{
+	"client_ip",
+	"request_id",
+	"backend",
+	"scheme",
+	"host",
+	"tls_version",
+	"tls_cipher",
+	"tls_server_name",
+}
+
+// Rules change headers, removes are applied first, then sets, then adds.
+// Values may use variables such as {client_ip}.
+type Rules struct {
+	Add    map[string]string `json:"add,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// Check makes sure every value only uses known variables.
+func (r *Rules) Check() error {
+	for _, values := range []map[string]string{r.Add, r.Set} {
+		for name, value := range values {
+			if name == "" || strings.ContainsAny(name, " \t:") {
+				return fmt.Errorf("invalid header %q", name)
+			}
+
+			if err := Check(value); err != nil {
+				return fmt.Errorf("%s: %s", name, err.Error())
+			}
+		}
+	}
+
+	for _, name := range r.Remove {
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			return fmt.Errorf("invalid header %q", name)
+		}
+	}
+
+	return nil
+}
+
+// Check makes sure a value only uses known variables.
+func Check(value string) error {
+	for _, name := range variables(value) {
+		if !known(name) {
+			return fmt.Errorf("unknown variable {%s}, use one of {%s}", name, strings.Join(Variables, "}, {"))
+		}
+	}
+
+	return nil
+}
+
+// names returns the canonical names of the headers the rules change.
+func (r *Rules) names() []string {
+	var names []string
+	for _, name := range r.Remove {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+
+	for _, values := range []map[string]string{r.Set, r.Add} {
+		for name := range values {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	return names
+}
+
+func (r *Rules) apply(h http.Header, x *Exchange) {
+	if r == nil {
+		return
+	}
+
+	for _, name := range r.Remove {
+		h.Del(name)
+	}
+
+	for name, value := range r.Set {
+		h.Set(name, x.Expand(value))
+	}
+
+	for name, value := range r.Add {
+		h.Add(name, x.Expand(value))
+	}
+}
+
+// Exchange carries the header rules of a request and the values of their
+// variables. The backend is filled in by the pool once one is picked.
+type Exchange struct {
+	sync.Mutex
+	Request   *Rules
+	Response  *Rules
+	clientIP  string
+	requestID string
+	scheme    string
+	host      string
+	tls       *tls.ConnectionState
+	backend   string
+	// original holds the headers the request rules change as the client
+	// sent them, retries are rewritten from it
+	original http.Header
+}
+
+func NewExchange(req *http.Request, request, response *Rules) *Exchange {
+	x := &Exchange{
+		Request:   request,
+		Response:  response,
+		clientIP:  forwarded.Client(req),
+		requestID: req.Header.Get(RequestIDHeader),
+		scheme:    "http",
+		host:      req.Host,
+		tls:       req.TLS,
+	}
+
+	if req.TLS != nil {
+		x.scheme = "https"
+	}
+
+	if x.requestID == "" {
+		x.requestID = newID()
+	}
+
+	return x
+}
+
+// SetBackend records the backend a request is proxied to, as host:port.
+func (x *Exchange) SetBackend(backend string) {
+	if u, err := url.Parse(backend); err == nil && u.Host != "" {
+		backend = u.Host
+	}
+
+	x.Lock()
+	defer x.Unlock()
+
+	x.backend = backend
+}
+
+// RewriteRequest applies the request rules to a request on its way to the
+// backend. A retry gets the headers the client sent back first, so rules
+// apply once per attempt.
+func (x *Exchange) RewriteRequest(req *http.Request) {
+	if x.Request == nil {
+		return
+	}
+
+	x.Lock()
+	if x.original == nil {
+		x.original = make(http.Header)
+		for _, name := range x.Request.names() {
+			if values, ok := req.Header[name]; ok {
+				x.original[name] = append([]string(nil), values...)
+			}
+		}
+	} else {
+		for _, name := range x.Request.names() {
+			req.Header.Del(name)
+			if values, ok := x.original[name]; ok {
+				req.Header[name] = append([]string(nil), values...)
+			}
+		}
+	}
+	x.Unlock()
+
+	x.Request.apply(req.Header, x)
+}
+
+// RewriteResponse applies the response rules before the headers are sent.
+func (x *Exchange) RewriteResponse(h http.Header) {
+	x.Response.apply(h, x)
+}
+
+// Expand replaces the variables in a value, unknown ones are kept as is.
+func (x *Exchange) Expand(value string) string {
+	return expand(value, x.variable)
+}
+
+func (x *Exchange) variable(name string) (string, bool) {
+	switch name {
+	case "client_ip":
+		return x.clientIP, true
+	case "request_id":
+		return x.requestID, true
+	case "backend":
+		x.Lock()
+		defer x.Unlock()
+		return x.backend, true
+	case "scheme":
+		return x.scheme, true
+	case "host":
+		return x.host, true
+	case "tls_version", "tls_cipher", "tls_server_name":
+		return x.tlsInfo(name), true
+	default:
+		return "", false
+	}
+}
+
+func (x *Exchange) tlsInfo(name string) string {
+	if x.tls == nil {
+		return ""
+	}
+
+	switch name {
+	case "tls_version":
+		return tlsVersions[x.tls.Version]
+	case "tls_cipher":
+		return fmt.Sprintf("0x%04x", x.tls.CipherSuite)
+	default:
+		return x.tls.ServerName
+	}
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the exchange to the pool.
+func NewContext(ctx context.Context, x *Exchange) context.Context {
+	return context.WithValue(ctx, contextKey{}, x)
+}
+
+// FromContext returns the exchange of a request, nil when its route has no
+// header rules.
+func FromContext(ctx context.Context) *Exchange {
+	x, _ := ctx.Value(contextKey{}).(*Exchange)
+	return x
+}
+
+func variables(value string) []string {
+	var names []string
+	expand(value, func(name string) (string, bool) {
+		names = append(names, name)
+		return "", true
+	})
+
+	return names
+}
+
+// expand replaces every {name} in value with its lookup, names that aren't
+// found are kept as is.
+func expand(value string, lookup func(name string) (string, bool)) string {
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "{")
+		if start < 0 {
+			break
+		}
+
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			break
+		}
+		end += start
+
+		b.WriteString(value[:start])
+		if v, ok := lookup(value[start+1 : end]); ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(value[start : end+1])
+		}
+		value = value[end+1:]
+	}
+
+	b.WriteString(value)
+	return b.String()
+}
+
+func known(name string) bool {
+	for _, v := range Variables {
+		if v == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(id)
+}
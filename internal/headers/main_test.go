@@ -0,0 +1,120 @@
+package headers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/CoderCookE/goaround/internal/assert"
+	"github.com/CoderCookE/goaround/internal/forwarded"
+)
+
+func TestRules(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	t.Run("expands variables", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://shop.example.com/orders", nil)
+		req.RemoteAddr = "10.0.0.7:51234"
+		req.Header.Set(RequestIDHeader, "abc")
+
+		x := NewExchange(req, nil, nil)
+		x.SetBackend("http://10.0.1.2:8080")
+
+		assertion.Equal(x.Expand("{client_ip} {request_id} {backend}"), "10.0.0.7 abc 10.0.1.2:8080")
+		assertion.Equal(x.Expand("{scheme}://{host}"), "http://shop.example.com")
+		assertion.Equal(x.Expand("{tls_version}"), "")
+		assertion.Equal(x.Expand("{unknown} {"), "{unknown} {")
+	})
+
+	t.Run("expands the client behind trusted proxies", func(t *testing.T) {
+		trusted, err := forwarded.Parse([]string{"10.0.0.0/8"})
+		assertion.Equal(err, nil)
+
+		var x *Exchange
+		proxies := forwarded.New(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			x = NewExchange(r, nil, nil)
+		}))
+
+		req := httptest.NewRequest("GET", "http://shop.example.com/orders", nil)
+		req.RemoteAddr = "10.0.0.7:51234"
+		req.Header.Set(forwarded.For, "198.51.100.4")
+		proxies.ServeHTTP(httptest.NewRecorder(), req)
+
+		assertion.Equal(x.Expand("{client_ip}"), "198.51.100.4")
+	})
+
+	t.Run("generates missing request ids", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://shop.example.com/", nil)
+
+		first := NewExchange(req, nil, nil).Expand("{request_id}")
+		second := NewExchange(req, nil, nil).Expand("{request_id}")
+		assertion.Equal(len(first), 32)
+		assertion.NotEqual(first, second)
+	})
+
+	t.Run("expands tls variables", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "https://shop.example.com/", nil)
+		req.TLS = &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: 0xc02f, ServerName: "shop.example.com"}
+
+		x := NewExchange(req, nil, nil)
+		assertion.Equal(x.Expand("{scheme} {tls_version} {tls_cipher} {tls_server_name}"), "https TLSv1.2 0xc02f shop.example.com")
+	})
+
+	t.Run("removes, then sets, then adds", func(t *testing.T) {
+		rules := &Rules{
+			Remove: []string{"Server", "X-Trace"},
+			Set:    map[string]string{"X-Trace": "{request_id}"},
+			Add:    map[string]string{"Via": "goaround"},
+		}
+
+		req := httptest.NewRequest("GET", "http://shop.example.com/", nil)
+		req.Header.Set(RequestIDHeader, "abc")
+		x := NewExchange(req, nil, rules)
+
+		h := http.Header{}
+		h.Set("Server", "nginx")
+		h.Set("X-Trace", "internal")
+		h.Set("Via", "1.1 cdn")
+		x.RewriteResponse(h)
+
+		assertion.Equal(h.Get("Server"), "")
+		assertion.Equal(h.Get("X-Trace"), "abc")
+		assertion.Equal(len(h["Via"]), 2)
+		assertion.Equal(h["Via"][1], "goaround")
+	})
+
+	t.Run("rewrites retries from the client's headers", func(t *testing.T) {
+		rules := &Rules{
+			Remove: []string{"X-Internal"},
+			Set:    map[string]string{"X-Backend": "{backend}"},
+			Add:    map[string]string{"via": "goaround"},
+		}
+
+		req := httptest.NewRequest("GET", "http://shop.example.com/", nil)
+		req.Header.Set("Via", "1.1 cdn")
+		req.Header.Set("X-Internal", "secret")
+		x := NewExchange(req, rules, nil)
+
+		x.SetBackend("http://10.0.1.1:8080")
+		x.RewriteRequest(req)
+		x.SetBackend("http://10.0.1.2:8080")
+		x.RewriteRequest(req)
+
+		assertion.Equal(strings.Join(req.Header["Via"], ","), "1.1 cdn,goaround")
+		assertion.Equal(req.Header.Get("X-Backend"), "10.0.1.2:8080")
+		assertion.Equal(req.Header.Get("X-Internal"), "")
+	})
+
+	t.Run("checks rules", func(t *testing.T) {
+		valid := &Rules{Set: map[string]string{"X-Forwarded-Proto": "{scheme}"}, Remove: []string{"Server"}}
+		assertion.Equal(valid.Check(), nil)
+
+		unknown := &Rules{Add: map[string]string{"X-Client": "{client}"}}
+		assertion.StringContains(unknown.Check().Error(), "X-Client: unknown variable {client}, use one of {client_ip}")
+
+		invalid := &Rules{Remove: []string{"X Trace"}}
+		assertion.StringContains(invalid.Check().Error(), `invalid header "X Trace"`)
+	})
+}
@@ -0,0 +1,32 @@
+package healthcheck
+
+import "time"
+
+const (
+	DefaultPath     = "/health"
+	DefaultInterval = 10 * time.Second
+	DefaultTimeout  = 10 * time.Second
+)
+
+type Config struct {
+	Path     string        `json:"path"`
+	Interval time.Duration `json:"interval"`
+	Timeout  time.Duration `json:"timeout"`
+}
+
+// withDefaults fills in the settings left unset.
+func (c Config) withDefaults() Config {
+	if c.Path == "" {
+		c.Path = DefaultPath
+	}
+
+	if c.Interval <= 0 {
+		c.Interval = DefaultInterval
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+
+	return c
+}
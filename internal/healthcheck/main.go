@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/CoderCookE/goaround/internal/connection"
@@ -24,39 +25,105 @@ type HealthChecker struct {
 	sync.Mutex
 	subscribers   []chan connection.Message
 	currentHealth bool
+	healthy       int32
 	client        *http.Client
 	backend       string
+	config        Config
+	shut          bool
 	done          chan bool
 	Wg            *sync.WaitGroup
 }
 
 func New(client *http.Client, subscribers []chan connection.Message, backend string, currentHealth bool) *HealthChecker {
-	return &HealthChecker{
-		client:        client,
-		subscribers:   subscribers,
-		backend:       backend,
-		done:          make(chan bool),
-		currentHealth: currentHealth,
-		Wg:            &sync.WaitGroup{},
+	hc := &HealthChecker{
+		client:      client,
+		subscribers: subscribers,
+		backend:     backend,
+		config:      Config{}.withDefaults(),
+		done:        make(chan bool),
+		Wg:          &sync.WaitGroup{},
 	}
+	hc.setHealth(currentHealth)
+
+	return hc
+}
+
+func (hc *HealthChecker) Healthy() bool {
+	return atomic.LoadInt32(&hc.healthy) == 1
+}
+
+func (hc *HealthChecker) setHealth(healthy bool) {
+	hc.currentHealth = healthy
+
+	var value int32
+	if healthy {
+		value = 1
+	}
+	atomic.StoreInt32(&hc.healthy, value)
+}
+
+// Subscribe adds connections to the health checker and tells them the
+// current health of the backend.
+func (hc *HealthChecker) Subscribe(subscribers []chan connection.Message) {
+	hc.Lock()
+	defer hc.Unlock()
+
+	hc.subscribers = append(hc.subscribers, subscribers...)
+	message := connection.Message{Health: hc.currentHealth, Backend: hc.backend, Ack: hc.Wg}
+
+	hc.Wg.Add(len(subscribers))
+	for _, c := range subscribers {
+		c <- message
+	}
+
+	hc.Wg.Wait()
+}
+
+// Unsubscribe stops notifying the given connections, they are not shut down.
+func (hc *HealthChecker) Unsubscribe(subscribers []chan connection.Message) {
+	hc.Lock()
+	defer hc.Unlock()
+
+	removed := make(map[chan connection.Message]bool)
+	for _, c := range subscribers {
+		removed[c] = true
+	}
+
+	remaining := hc.subscribers[:0]
+	for _, c := range hc.subscribers {
+		if !removed[c] {
+			remaining = append(remaining, c)
+		}
+	}
+	hc.subscribers = remaining
+}
+
+// Configure changes the health check path, interval and timeout, it takes
+// effect from the next check.
+func (hc *HealthChecker) Configure(c Config) {
+	hc.Lock()
+	hc.config = c.withDefaults()
+	hc.Unlock()
+}
+
+func (hc *HealthChecker) interval() time.Duration {
+	hc.Lock()
+	defer hc.Unlock()
+
+	return hc.config.Interval
 }
 
 func (hc *HealthChecker) Start(startup *sync.WaitGroup) {
-	bg := context.Background()
-	timeout := 10000 * time.Millisecond
 	startup.Done()
-	ctx, cancel := context.WithTimeout(bg, timeout)
-	hc.check(ctx, cancel)
+	hc.check()
 
-	ticker := time.NewTicker(timeout)
 	for {
+		timer := time.NewTimer(hc.interval())
 		select {
-		case <-ctx.Done():
-			<-ticker.C
-			ctx, cancel = context.WithTimeout(bg, timeout)
-			hc.check(ctx, cancel)
+		case <-timer.C:
+			hc.check()
 		case <-hc.done:
-			ticker.Stop()
+			timer.Stop()
 			return
 		}
 	}
@@ -65,40 +132,67 @@ func (hc *HealthChecker) Start(startup *sync.WaitGroup) {
 func (hc *HealthChecker) Reuse(newBackend string, proxy *httputil.ReverseProxy) *HealthChecker {
 	hc.Lock()
 	hc.backend = newBackend
+	if hc.currentHealth {
+		go updateStates(false)
+	}
+	hc.setHealth(false)
 	hc.notifySubscribers(false, hc.backend, proxy)
 	hc.Unlock()
 
 	return hc
 }
 
-func (hc *HealthChecker) check(ctx context.Context, cancel context.CancelFunc) {
+// check probes the backend without holding the lock, so a slow backend
+// does not block shutdown. Results for a backend that was shut down or
+// replaced in the meantime are dropped.
+func (hc *HealthChecker) check() {
+	hc.Lock()
+	backend, config := hc.backend, hc.config
+	hc.Unlock()
+
+	healthy := probe(backend, config)
+
 	hc.Lock()
 	defer hc.Unlock()
+
+	if hc.shut || hc.backend != backend {
+		return
+	}
+
+	if healthy != hc.currentHealth {
+		go updateStates(healthy)
+		hc.setHealth(healthy)
+		hc.notifySubscribers(healthy, hc.backend, nil)
+	}
+}
+
+func probe(backend string, config Config) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
 	defer cancel()
 
-	url := fmt.Sprintf("%s%s", hc.backend, "/health")
+	url := fmt.Sprintf("%s%s", backend, config.Path)
 	var healthy bool
 
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		log.Printf("Error creating request: %s, error %s", hc.backend, err.Error())
+		log.Printf("Error creating request: %s, error %s", backend, err.Error())
 		healthy = false
 	} else if resp, err := http.DefaultClient.Do(req.WithContext(ctx)); err != nil {
-		log.Printf("Error with health check, backend: %s, error %s", hc.backend, err.Error())
+		log.Printf("Error with health check, backend: %s, error %s", backend, err.Error())
 		healthy = false
 	} else {
 		body, err := ioutil.ReadAll(resp.Body)
 		defer resp.Body.Close()
 
 		if err != nil {
-			log.Printf("Error with health check, backend: %s, error %s", hc.backend, err.Error())
+			log.Printf("Error with health check, backend: %s, error %s", backend, err.Error())
 			healthy = false
 		} else {
 			healthCheck := &Reponse{}
 			err := json.Unmarshal(body, healthCheck)
 
 			if err != nil {
-				log.Printf("Error reading backend response, defaulting to Status Code, backend: %s, error %s", hc.backend, err.Error())
+				log.Printf("Error reading backend response, defaulting to Status Code, backend: %s, error %s", backend, err.Error())
 				healthy = resp.StatusCode == 200
 			} else {
 				healthy = healthCheck.State == "healthy" || (resp.StatusCode == 200 && healthCheck.State != "degraded")
@@ -106,11 +200,7 @@ func (hc *HealthChecker) check(ctx context.Context, cancel context.CancelFunc) {
 		}
 	}
 
-	if healthy != hc.currentHealth {
-		go updateStates(healthy)
-		hc.currentHealth = healthy
-		hc.notifySubscribers(healthy, hc.backend, nil)
-	}
+	return healthy
 }
 
 func updateStates(healthy bool) {
@@ -133,12 +223,17 @@ func (hc *HealthChecker) notifySubscribers(healthy bool, backend string, proxy *
 }
 
 func (hc *HealthChecker) Shutdown() {
+	hc.Lock()
+	defer hc.Unlock()
+
 	message := connection.Message{Shutdown: true}
 
 	for _, c := range hc.subscribers {
 		c <- message
 	}
 
+	hc.shut = true
+
 	updateStates(false)
 	close(hc.done)
 }
@@ -93,6 +93,7 @@ func TestHealthChecker(t *testing.T) {
 		defer hc.Shutdown()
 
 		health := <-resChan
+		health.Ack.Done()
 		assertion.True(health.Health)
 	})
 
@@ -126,6 +127,7 @@ func TestHealthChecker(t *testing.T) {
 		defer hc.Shutdown()
 
 		health := <-resChan
+		health.Ack.Done()
 		assertion.False(health.Health)
 	})
 
@@ -153,6 +155,7 @@ func TestHealthChecker(t *testing.T) {
 		defer hc.Shutdown()
 
 		health := <-resChan
+		health.Ack.Done()
 		assertion.False(health.Health)
 	})
 }
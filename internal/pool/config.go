@@ -1,8 +1,45 @@
 package pool
 
+import (
+	"time"
+
+	"github.com/CoderCookE/goaround/internal/control"
+	"github.com/CoderCookE/goaround/internal/healthcheck"
+)
+
 type Config struct {
-	Backends    []string
-	NumConns    int
-	EnableCache bool
-	MaxRetries  int
+	// Name is the virtual pool's, empty for the default pool
+	Name               string                `json:"name,omitempty"`
+	Backends           []string              `json:"backends"`
+	Weights            map[string]int        `json:"weights,omitempty"`
+	NumConns           int                   `json:"num_conns"`
+	EnableCache        bool                  `json:"cache"`
+	MaxRetries         int                   `json:"max_retries"`
+	DrainTimeout       time.Duration         `json:"drain_timeout"`
+	HealthCheck        healthcheck.Config    `json:"health_check"`
+	CacheMaxBytes      int64                 `json:"cache_max_bytes"`
+	CacheMaxObjectSize int64                 `json:"cache_max_object_size"`
+	CacheCounters      int64                 `json:"cache_counters"`
+	CacheTTL           time.Duration         `json:"cache_ttl"`
+	CacheDir           string                `json:"cache_dir"`
+	CacheDiskMaxBytes  int64                 `json:"cache_disk_max_bytes"`
+	CacheRemote        string                `json:"cache_memcached"`
+	CacheRemoteTimeout time.Duration         `json:"cache_memcached_timeout"`
+	ControlSocket      *control.SocketConfig `json:"control_socket"`
+	StateFile          string                `json:"state_file,omitempty"`
+	Sets               map[string][]string   `json:"sets,omitempty"`
+	ActiveSet          string                `json:"active_set,omitempty"`
+}
+
+// weight of a backend, backends without a configured weight get 1.
+func (c *Config) weight(backend string) int {
+	return weightOf(c.Weights, backend)
+}
+
+func weightOf(weights map[string]int, backend string) int {
+	if w := weights[backend]; w > 0 {
+		return w
+	}
+
+	return 1
 }
@@ -0,0 +1,676 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/CoderCookE/goaround/internal/connection"
+	"github.com/CoderCookE/goaround/internal/control"
+	"github.com/CoderCookE/goaround/internal/state"
+)
+
+// drainInterval is how often removed backends are checked for requests
+// still in flight.
+const drainInterval = 100 * time.Millisecond
+
+// Add starts health checks and connections for new backends, every url is
+// validated before any backend is added.
+func (p *pool) Add(backends []string, weight int) error {
+	if weight == 0 {
+		weight = 1
+	}
+
+	if weight < 0 {
+		return fmt.Errorf("invalid weight %d", weight)
+	}
+
+	if err := p.validate(backends); err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	defer p.saveState()
+
+	for _, b := range backends {
+		if _, found := p.backends[b]; found {
+			return fmt.Errorf("backend already exists: %s", b)
+		}
+	}
+
+	if err := p.checkCapacity(len(backends) * weight * p.connsPerBackend); err != nil {
+		return err
+	}
+
+	poolConnections := []*connection.Connection{}
+	wg := &sync.WaitGroup{}
+	for _, b := range backends {
+		wg.Add(1)
+		poolConnections = p.addBackend(poolConnections, b, weight, wg)
+	}
+
+	shuffle(poolConnections, p.connections)
+
+	return nil
+}
+
+// Remove stops sending new requests to backends straight away, they are
+// shut down once their requests in flight finish or the drain timeout passes.
+func (p *pool) Remove(backends []string) error {
+	p.Lock()
+	defer p.Unlock()
+	defer p.saveState()
+
+	if err := p.requireBackends(backends); err != nil {
+		return err
+	}
+
+	for _, b := range backends {
+		p.retire(p.backends[b])
+		delete(p.backends, b)
+	}
+
+	p.compact()
+
+	return nil
+}
+
+// SetWeight scales the number of connections a backend holds in the pool,
+// traffic is spread across connections so it follows the weight.
+func (p *pool) SetWeight(backendURL string, weight int) error {
+	if weight < 1 {
+		return fmt.Errorf("invalid weight %d, must be at least 1", weight)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	defer p.saveState()
+
+	if err := p.requireBackends([]string{backendURL}); err != nil {
+		return err
+	}
+
+	return p.setWeight(p.backends[backendURL], weight)
+}
+
+func (p *pool) setWeight(b *backend, weight int) error {
+	if b.draining {
+		return fmt.Errorf("backend is draining: %s", b.url)
+	}
+
+	change := (weight - b.weight) * p.connsPerBackend
+
+	if change > 0 {
+		if err := p.checkCapacity(change); err != nil {
+			return err
+		}
+
+		existing := len(b.connections)
+		wg := &sync.WaitGroup{}
+		subscriptions := p.newConnections(b, change, wg)
+		wg.Wait()
+
+		b.hc.Subscribe(subscriptions)
+		shuffle(b.connections[existing:], p.connections)
+	}
+
+	if change < 0 {
+		keep := len(b.connections) + change
+		surplus := b.connections[keep:]
+		b.connections = b.connections[:keep]
+
+		subscriptions := make([]chan connection.Message, len(surplus))
+		for i, conn := range surplus {
+			conn.Drain()
+			subscriptions[i] = conn.Messages
+		}
+
+		b.hc.Unsubscribe(subscriptions)
+		for _, c := range subscriptions {
+			c <- connection.Message{Shutdown: true}
+		}
+
+		p.compact()
+	}
+
+	b.weight = weight
+
+	return nil
+}
+
+// Drain stops sending new requests to backends, they stay listed as
+// draining until they are removed.
+func (p *pool) Drain(backends []string) error {
+	p.Lock()
+	defer p.Unlock()
+	defer p.saveState()
+
+	if err := p.requireBackends(backends); err != nil {
+		return err
+	}
+
+	for _, url := range backends {
+		b := p.backends[url]
+		if !b.draining {
+			b.draining = true
+			b.drainStart = time.Now()
+		}
+
+		for _, conn := range b.connections {
+			conn.Drain()
+		}
+	}
+
+	p.compact()
+
+	return nil
+}
+
+// Maintenance takes backends out of rotation or puts them back, health
+// checks keep running while a backend is in maintenance.
+func (p *pool) Maintenance(backends []string, enabled bool) error {
+	p.Lock()
+	defer p.Unlock()
+	defer p.saveState()
+
+	if err := p.requireBackends(backends); err != nil {
+		return err
+	}
+
+	for _, url := range backends {
+		b := p.backends[url]
+		b.maintenance = enabled
+
+		for _, conn := range b.connections {
+			conn.SetMaintenance(enabled)
+		}
+	}
+
+	return nil
+}
+
+// Replace swaps the current backends for the given set. Health checkers of
+// removed backends are reused for added ones where possible.
+func (p *pool) Replace(updated []string) error {
+	if err := p.validate(updated); err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	defer p.saveState()
+
+	var currentBackends []string
+	for k := range p.backends {
+		currentBackends = append(currentBackends, k)
+	}
+
+	added, removed := difference(currentBackends, updated)
+	log.Printf("Adding: %s", added)
+	log.Printf("Removing: %s", removed)
+
+	for _, removedBackend := range removed {
+		old := p.backends[removedBackend]
+		if len(added) > 0 && !old.draining {
+			var new string
+			new, added = added[0], added[1:]
+
+			proxy, err := p.newProxy(new)
+			if err != nil {
+				return err
+			}
+
+			old.url = new
+			old.proxy = proxy
+			old.hc = old.hc.Reuse(new, proxy)
+			p.backends[new] = old
+		} else {
+			p.retire(old)
+		}
+
+		delete(p.backends, removedBackend)
+	}
+
+	p.compact()
+
+	if err := p.checkCapacity(len(added) * p.connsPerBackend); err != nil {
+		return err
+	}
+
+	poolConnections := []*connection.Connection{}
+
+	wg := &sync.WaitGroup{}
+	for _, addedBackend := range added {
+		wg.Add(1)
+		poolConnections = p.addBackend(poolConnections, addedBackend, 1, wg)
+	}
+
+	shuffle(poolConnections, p.connections)
+
+	return nil
+}
+
+// Reload applies a new configuration to the running pool. Backends are
+// reconciled like a replace but keep their health checkers, settings that
+// size the pool, its cache or control socket only change on restart. A nil
+// backend list leaves backends to discovery.
+func (p *pool) Reload(c *Config) error {
+	if err := p.Check(c); err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	defer p.saveState()
+
+	atomic.StoreInt64(&p.maxRetries, int64(c.MaxRetries))
+	p.drainTimeout = c.DrainTimeout
+	p.healthCheck = c.HealthCheck
+
+	for _, b := range p.backends {
+		b.hc.Configure(p.healthCheck)
+	}
+
+	for _, b := range p.standby {
+		b.hc.Configure(p.healthCheck)
+	}
+
+	if c.Backends != nil {
+		p.reconcile(c.Backends, c.Weights)
+	}
+
+	return nil
+}
+
+// Check reports whether Reload would accept a configuration, without
+// changing the pool.
+func (p *pool) Check(c *Config) error {
+	if err := p.checkBackends(c.Backends, c.Weights); err != nil {
+		return err
+	}
+
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("invalid max retries %d", c.MaxRetries)
+	}
+
+	if c.Backends != nil {
+		return p.checkTotal(c.Backends, c.Weights)
+	}
+
+	return nil
+}
+
+// Sync makes the pool's backends match the given set, it is used by
+// discovery providers. Backends missing from weights get a weight of 1.
+func (p *pool) Sync(backends []string, weights map[string]int) error {
+	if err := p.checkBackends(backends, weights); err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	defer p.saveState()
+
+	if err := p.checkTotal(backends, weights); err != nil {
+		return err
+	}
+
+	p.reconcile(backends, weights)
+
+	return nil
+}
+
+func (p *pool) checkBackends(backends []string, weights map[string]int) error {
+	if err := p.validate(backends); err != nil {
+		return err
+	}
+
+	for b, w := range weights {
+		if w < 0 {
+			return fmt.Errorf("invalid weight %d for %s", w, b)
+		}
+	}
+
+	return nil
+}
+
+// checkTotal makes sure the backends fit in the pool once the current
+// ones are gone.
+func (p *pool) checkTotal(backends []string, weights map[string]int) error {
+	total := 0
+	for _, b := range backends {
+		total += weightOf(weights, b) * p.connsPerBackend
+	}
+
+	if total > cap(p.connections) {
+		return fmt.Errorf("pool capacity of %d connections exceeded", cap(p.connections))
+	}
+
+	return nil
+}
+
+// reconcile removes, reweighs and adds backends with the same diff as a
+// replace, removed backends drain.
+func (p *pool) reconcile(backends []string, weights map[string]int) {
+	var currentBackends []string
+	for k := range p.backends {
+		currentBackends = append(currentBackends, k)
+	}
+
+	added, removed := difference(currentBackends, backends)
+	if len(added) == 0 && len(removed) == 0 && !p.reweigh(weights) {
+		return
+	}
+
+	log.Printf("Adding: %s", added)
+	log.Printf("Removing: %s", removed)
+
+	for _, url := range removed {
+		p.retire(p.backends[url])
+		delete(p.backends, url)
+	}
+
+	p.compact()
+
+	for url, b := range p.backends {
+		if weight := weightOf(weights, url); weight != b.weight {
+			if err := p.setWeight(b, weight); err != nil {
+				log.Printf("Keeping weight of %s: %s", url, err.Error())
+			}
+		}
+	}
+
+	poolConnections := []*connection.Connection{}
+	wg := &sync.WaitGroup{}
+	for _, url := range added {
+		wg.Add(1)
+		poolConnections = p.addBackend(poolConnections, url, weightOf(weights, url), wg)
+	}
+
+	shuffle(poolConnections, p.connections)
+}
+
+// reweigh reports whether any current backend's weight differs.
+func (p *pool) reweigh(weights map[string]int) bool {
+	for url, b := range p.backends {
+		if weightOf(weights, url) != b.weight && !b.draining {
+			return true
+		}
+	}
+
+	return false
+}
+
+// saveState records the backends in the state file, it is called with the
+// lock held after every change so saves happen in order.
+func (p *pool) saveState() {
+	if p.stateFile == "" {
+		return
+	}
+
+	saved := &state.State{Backends: []state.Backend{}}
+	for url, b := range p.backends {
+		saved.Backends = append(saved.Backends, state.Backend{
+			URL:         url,
+			Weight:      b.weight,
+			Draining:    b.draining,
+			Maintenance: b.maintenance,
+		})
+	}
+
+	sort.Slice(saved.Backends, func(i, j int) bool {
+		return saved.Backends[i].URL < saved.Backends[j].URL
+	})
+
+	if err := state.Save(p.stateFile, saved); err != nil {
+		log.Printf("Error saving state to %s: %s", p.stateFile, err.Error())
+	}
+}
+
+// Purge removes cached responses by path, or every cached response when no
+// paths are given.
+func (p *pool) Purge(keys []string) error {
+	if p.cache == nil {
+		return errors.New("cache is not enabled")
+	}
+
+	p.cache.Purge(keys)
+
+	return nil
+}
+
+// HandleSplits lets the control socket change the percentages of the
+// route splits.
+func (p *pool) HandleSplits(s control.Splitter) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.splits = s
+}
+
+func (p *pool) SetSplit(name string, percent float64) error {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.splits == nil {
+		return errors.New("no splits configured")
+	}
+
+	return p.splits.SetSplit(name, percent)
+}
+
+func (p *pool) Splits() []control.SplitStatus {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.splits == nil {
+		return []control.SplitStatus{}
+	}
+
+	return p.splits.Splits()
+}
+
+// retire drains a removed backend's connections so they are dropped from
+// the pool straight away. Its health checker keeps running until requests in
+// flight finish or the drain timeout passes.
+func (p *pool) retire(b *backend) {
+	for _, conn := range b.connections {
+		conn.Drain()
+	}
+
+	now := time.Now()
+	if !b.draining {
+		b.draining = true
+		b.drainStart = now
+	}
+	b.removing = true
+	b.drainEnd = now.Add(p.drainTimeout)
+
+	inFlight := b.inFlight()
+	if p.drainTimeout <= 0 || inFlight == 0 {
+		b.hc.Shutdown()
+		return
+	}
+
+	log.Printf("Draining %s, %d requests in flight", b.url, inFlight)
+	p.removing[b] = true
+	go p.finishDrain(b)
+}
+
+// finishDrain shuts the backend down once it is idle or out of time.
+func (p *pool) finishDrain(b *backend) {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		inFlight := b.inFlight()
+		if inFlight > 0 && time.Now().Before(b.drainEnd) {
+			continue
+		}
+
+		p.Lock()
+		if p.removing[b] {
+			delete(p.removing, b)
+			b.hc.Shutdown()
+		}
+		p.Unlock()
+
+		if inFlight > 0 {
+			log.Printf("Drain timeout for %s, shut down with %d requests in flight", b.url, inFlight)
+		} else {
+			log.Printf("Drained %s", b.url)
+		}
+
+		return
+	}
+}
+
+func (b *backend) inFlight() int {
+	inFlight := 0
+	for _, conn := range b.connections {
+		if conn.InFlight() {
+			inFlight++
+		}
+	}
+
+	return inFlight
+}
+
+func (b *backend) status() control.BackendStatus {
+	healthy := b.hc.Healthy()
+	circuit := control.CircuitClosed
+	if !healthy {
+		circuit = control.CircuitOpen
+	}
+
+	status := control.BackendStatus{
+		Backend:     b.url,
+		Healthy:     healthy,
+		Weight:      b.weight,
+		Connections: len(b.connections),
+		InFlight:    b.inFlight(),
+		Circuit:     circuit,
+		Draining:    b.draining,
+		Maintenance: b.maintenance,
+	}
+
+	if b.draining {
+		status.Drain = &control.DrainStatus{Started: b.drainStart, Removing: b.removing}
+		if b.removing {
+			status.Drain.Remaining = math.Max(time.Until(b.drainEnd).Seconds(), 0)
+		}
+	}
+
+	return status
+}
+
+func (p *pool) List() []control.BackendStatus {
+	p.RLock()
+	defer p.RUnlock()
+
+	list := make([]control.BackendStatus, 0, len(p.backends)+len(p.removing))
+	for _, b := range p.backends {
+		list = append(list, b.status())
+	}
+
+	for b := range p.removing {
+		list = append(list, b.status())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Backend < list[j].Backend
+	})
+
+	for i := range list {
+		if contains(p.sets[p.active], list[i].Backend) && !list[i].Draining {
+			list[i].Set = p.active
+		}
+	}
+
+	return append(list, p.standbyStatus()...)
+}
+
+func (p *pool) Status() control.PoolStatus {
+	p.RLock()
+	defer p.RUnlock()
+
+	status := control.PoolStatus{
+		Backends:             len(p.backends),
+		AvailableConnections: len(p.connections),
+		CacheEnabled:         p.cache != nil,
+		ActiveSet:            p.active,
+	}
+
+	for _, b := range p.backends {
+		if b.hc.Healthy() {
+			status.HealthyBackends++
+		}
+
+		if b.draining {
+			status.DrainingBackends++
+		}
+	}
+
+	status.DrainingBackends += len(p.removing)
+
+	return status
+}
+
+func (p *pool) validate(backends []string) error {
+	var invalid []string
+	seen := make(map[string]bool)
+
+	for _, b := range backends {
+		if _, err := p.newProxy(b); err != nil {
+			invalid = append(invalid, b)
+		}
+
+		if seen[b] {
+			return fmt.Errorf("duplicate backend: %s", b)
+		}
+		seen[b] = true
+	}
+
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid backend urls: %s", strings.Join(invalid, ", "))
+	}
+
+	return nil
+}
+
+func (p *pool) requireBackends(backends []string) error {
+	var unknown []string
+	for _, b := range backends {
+		if _, found := p.backends[b]; !found {
+			unknown = append(unknown, b)
+		}
+	}
+
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown backends: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// checkCapacity makes sure added connections fit in the pool's channel,
+// sending to a full channel would block the control socket forever.
+func (p *pool) checkCapacity(added int) error {
+	total := added
+	for _, b := range p.backends {
+		total += len(b.connections)
+	}
+
+	if total > cap(p.connections) {
+		return fmt.Errorf("pool capacity of %d connections exceeded", cap(p.connections))
+	}
+
+	return nil
+}
@@ -1,9 +1,9 @@
 package pool
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -13,14 +13,15 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/dgraph-io/ristretto"
-
+	"github.com/CoderCookE/goaround/internal/cache"
 	"github.com/CoderCookE/goaround/internal/connection"
+	"github.com/CoderCookE/goaround/internal/control"
+	"github.com/CoderCookE/goaround/internal/headers"
 	"github.com/CoderCookE/goaround/internal/healthcheck"
 	"github.com/CoderCookE/goaround/internal/stats"
 )
@@ -29,28 +30,71 @@ type attempts int
 
 const (
 	attemptsKey attempts = iota
+	revalidationKey
 )
 
+// attempt is marked failed by the proxy's error handler, Fetch then retries
+// once the connection is back in the pool.
+type attempt struct {
+	failed bool
+}
+
+type revalidation struct {
+	entry   *cache.Entry
+	request *http.Request
+}
+
+type backend struct {
+	url         string
+	weight      int
+	proxy       *httputil.ReverseProxy
+	hc          *healthcheck.HealthChecker
+	connections []*connection.Connection
+	draining    bool
+	maintenance bool
+	removing    bool
+	drainStart  time.Time
+	drainEnd    time.Time
+}
+
 type pool struct {
 	sync.RWMutex
 	connections     chan *connection.Connection
-	healthChecks    map[string]*healthcheck.HealthChecker
+	backends        map[string]*backend
 	client          *http.Client
 	connsPerBackend int
-	cache           *ristretto.Cache
-	maxRetries      int
+	cache           *cache.Cache
+	maxRetries      int64
+	drainTimeout    time.Duration
+	healthCheck     healthcheck.Config
+	removing        map[*backend]bool
+	socket          *control.SocketConfig
+	stateFile       string
+	splits          control.Splitter
+	sets            map[string][]string
+	setWeights      map[string]int
+	active          string
+	standby         map[string]*backend
 }
 
+// Connections of backends added at runtime share the pool's channel, so it
+// is sized for more than the backends passed at startup.
+const minPoolCapacity = 1024
+
 //Exported method for creation of a connection-pool takes []string
 //ex: ['http://localhost:9000','http://localhost:9000']
 func New(c *Config) *pool {
 	backends := c.Backends
 	connsPerBackend := c.NumConns
-	cacheEnabled := c.EnableCache
 	maxRetries := c.MaxRetries
 
-	backendCount := int(math.Max(float64(len(backends)), float64(1)))
-	maxRequests := connsPerBackend * backendCount * 2
+	totalWeight := 0
+	for _, backend := range backends {
+		totalWeight += c.weight(backend)
+	}
+
+	backendCount := int(math.Max(float64(totalWeight), float64(1)))
+	maxRequests := int(math.Max(float64(connsPerBackend*backendCount*2), minPoolCapacity))
 
 	tr := &http.Transport{
 		DialContext: (&net.Dialer{
@@ -67,18 +111,27 @@ func New(c *Config) *pool {
 		Transport: tr,
 	}
 
-	cache, err := buildCache(cacheEnabled)
+	requestCache, err := buildCache(c)
 	if err != nil {
 		log.Printf("Error creating cache: %v", err)
 	}
 
 	connectionPool := &pool{
 		connections:     make(chan *connection.Connection, maxRequests),
-		healthChecks:    make(map[string]*healthcheck.HealthChecker),
+		backends:        make(map[string]*backend),
 		client:          client,
 		connsPerBackend: connsPerBackend,
-		cache:           cache,
-		maxRetries:      maxRetries,
+		cache:           requestCache,
+		maxRetries:      int64(maxRetries),
+		drainTimeout:    c.DrainTimeout,
+		healthCheck:     c.HealthCheck,
+		removing:        make(map[*backend]bool),
+		socket:          c.ControlSocket,
+		stateFile:       c.StateFile,
+		sets:            c.Sets,
+		setWeights:      c.Weights,
+		active:          c.ActiveSet,
+		standby:         make(map[string]*backend),
 	}
 
 	poolConnections := []*connection.Connection{}
@@ -86,12 +139,15 @@ func New(c *Config) *pool {
 	startup := &sync.WaitGroup{}
 	for _, backend := range backends {
 		startup.Add(1)
-		poolConnections = connectionPool.addBackend(poolConnections, backend, startup)
+		poolConnections = connectionPool.addBackend(poolConnections, backend, c.weight(backend), startup)
 	}
 
 	shuffle(poolConnections, connectionPool.connections)
+	connectionPool.addStandby()
 
-	go connectionPool.ListenForBackendChanges(startup)
+	if c.ControlSocket != nil {
+		go connectionPool.ListenForBackendChanges(startup)
+	}
 
 	return connectionPool
 }
@@ -108,35 +164,73 @@ func shuffle(conns []*connection.Connection, ch chan *connection.Connection) {
 	}
 }
 
-func buildCache(cacheEnabled bool) (*ristretto.Cache, error) {
-	if !cacheEnabled {
+func buildCache(c *Config) (*cache.Cache, error) {
+	if !c.EnableCache {
 		return nil, nil
 	}
 
-	cache, err := ristretto.NewCache(&ristretto.Config{
-		NumCounters: 1e7,     // number of keys to track frequency of (10M).
-		MaxCost:     1 << 30, // maximum cost of cache (1GB).
-		BufferItems: 64,      // number of keys per Get buffer.
+	return cache.New(&cache.Config{
+		Name:          c.Name,
+		MaxBytes:      c.CacheMaxBytes,
+		MaxObjectSize: c.CacheMaxObjectSize,
+		Counters:      c.CacheCounters,
+		TTL:           c.CacheTTL,
+		DiskDir:       c.CacheDir,
+		DiskMaxBytes:  c.CacheDiskMaxBytes,
+		RemoteAddr:    c.CacheRemote,
+		RemoteTimeout: c.CacheRemoteTimeout,
 	})
-
-	return cache, err
 }
 
 //Exported method for passing a request to a connection from the pool
-//Returns a 503 status code if request is unsuccessful
+//Returns a 503 status code when no backend is usable, and a 502 once every
+//retry failed
 func (p *pool) Fetch(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	conn := <-p.connections
 
-	ctxAttempt := r.Context().Value(attemptsKey)
-	var attempt int
+	if p.cache != nil && r.Method == "GET" {
+		key := cache.Key(r)
+		entry, found := p.cache.Get(key)
+		if found && entry.Fresh(time.Now()) {
+			stats.CacheCounter.WithLabelValues(key, "hit").Add(1)
+			err := entry.Write(w, r)
+			if err != nil {
+				log.Printf("Error writing: %s", err.Error())
+			}
+			return
+		}
 
-	if ctxAttempt != nil {
-		attempt = ctxAttempt.(int) + 1
+		if found && entry.Revalidatable() {
+			stats.CacheCounter.WithLabelValues(key, "stale").Add(1)
+			rv := &revalidation{entry: entry, request: r}
+			r = r.WithContext(context.WithValue(r.Context(), revalidationKey, rv))
+		} else {
+			stats.CacheCounter.WithLabelValues(key, "miss").Add(1)
+		}
 	}
 
-	if attempt > p.maxRetries {
-		return
+	maxRetries := int(atomic.LoadInt64(&p.maxRetries))
+	for n := 0; ; n++ {
+		current := &attempt{}
+		if !p.try(w, r.WithContext(context.WithValue(r.Context(), attemptsKey, current)), n, start) || !current.failed {
+			return
+		}
+
+		if n >= maxRetries {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+	}
+}
+
+// try proxies a request over one connection, which is back in the pool when
+// it returns. It reports false when no connection was usable.
+func (p *pool) try(w http.ResponseWriter, r *http.Request, n int, start time.Time) bool {
+	conn, usableProxy, err := p.next(r.Context())
+	if err != nil {
+		log.Printf("No usable connection: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return false
 	}
 
 	duration := time.Since(start).Seconds()
@@ -144,115 +238,131 @@ func (p *pool) Fetch(w http.ResponseWriter, r *http.Request) {
 	stats.AvailableConnectionsGauge.WithLabelValues("in_use").Add(1)
 	defer func() {
 		stats.AvailableConnectionsGauge.WithLabelValues("in_use").Sub(1)
-		stats.Attempts.WithLabelValues().Observe(float64(attempt))
+		stats.Attempts.WithLabelValues().Observe(float64(n))
 		duration = time.Since(start).Seconds()
 		stats.Durations.WithLabelValues("return_connection").Observe(duration)
 
-		if !conn.Shut {
-			p.connections <- conn
-		}
+		p.release(conn)
 	}()
 
-	if p.cache != nil && r.Method == "GET" {
-		value, found := p.cache.Get(r.URL.Path)
-		if found {
-			stats.CacheCounter.WithLabelValues(r.URL.Path, "hit").Add(1)
-			res := value.(string)
-			_, err := w.Write([]byte(res))
-			if err != nil {
-				log.Printf("Error writing: %s", err.Error())
+	usableProxy.ServeHTTP(w, r)
+
+	return true
+}
+
+// next pulls connections until one is usable, unusable connections are
+// released without counting as a retry. It gives up after trying every
+// connection that was waiting in the pool, or once ctx is done while it
+// waits for one.
+func (p *pool) next(ctx context.Context) (*connection.Connection, *httputil.ReverseProxy, error) {
+	err := errors.New("no backends available")
+
+	for tries := len(p.connections) + 1; tries > 0; tries-- {
+		var conn *connection.Connection
+
+		select {
+		case conn = <-p.connections:
+		default:
+			if !p.serving() {
+				return nil, nil, err
 			}
-			return
-		}
 
-		stats.CacheCounter.WithLabelValues(r.URL.Path, "miss").Add(1)
-	}
+			select {
+			case conn = <-p.connections:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
 
-	usableProxy, err := conn.Get()
-	ctx := context.WithValue(r.Context(), attemptsKey, attempt)
+		var usableProxy *httputil.ReverseProxy
+		usableProxy, err = conn.Get()
+		if err == nil {
+			return conn, usableProxy, nil
+		}
 
-	if err != nil {
-		log.Printf("retrying err with request: %s", err.Error())
-		p.Fetch(w, r.WithContext(ctx))
-	} else {
-		usableProxy.ServeHTTP(w, r)
+		p.release(conn)
 	}
+
+	return nil, nil, err
 }
 
-func (p *pool) Shutdown() {
+// serving reports whether any backend is taking requests, when none are
+// waiting for a connection would block forever.
+func (p *pool) serving() bool {
 	p.RLock()
-	for _, hc := range p.healthChecks {
-		hc.Shutdown()
+	defer p.RUnlock()
+
+	for _, b := range p.backends {
+		if !b.draining && !b.maintenance && len(b.connections) > 0 {
+			return true
+		}
 	}
-	p.RUnlock()
+
+	return false
 }
 
-func (p *pool) ListenForBackendChanges(startup *sync.WaitGroup) {
-	const SockAddr = "/tmp/goaround.sock"
+// release returns the connection to the pool unless its backend was
+// removed or is draining.
+func (p *pool) release(conn *connection.Connection) {
+	conn.Release()
 
-	if err := os.RemoveAll(SockAddr); err != nil {
-		log.Fatal(err)
+	if conn.Retired() {
+		return
 	}
 
-	l, err := net.Listen("unix", SockAddr)
-	if err != nil {
-		log.Fatal("listen error:", err)
-	}
-	defer l.Close()
+	p.connections <- conn
+}
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Fatal("accept error:", err)
-		}
+// compact drops retired connections waiting in the pool so they stop
+// taking up capacity.
+func (p *pool) compact() {
+	waiting := len(p.connections)
 
-		scanner := bufio.NewScanner(conn)
-		for scanner.Scan() {
-			updated := strings.Split(scanner.Text(), ",")
-			p.Lock()
-			var currentBackends []string
-			for k := range p.healthChecks {
-				currentBackends = append(currentBackends, k)
+	for i := 0; i < waiting; i++ {
+		select {
+		case conn := <-p.connections:
+			if conn.Retired() {
+				continue
 			}
+			p.connections <- conn
+		default:
+			return
+		}
+	}
+}
 
-			added, removed := difference(currentBackends, updated)
-			log.Printf("Adding: %s", added)
-			log.Printf("Removing: %s", removed)
-
-			for _, removedBackend := range removed {
-				if len(added) > 0 {
-					var new string
-					new, added = added[0], added[1:]
-					endpoint, err := url.ParseRequestURI(new)
-					if err != nil {
-						log.Printf("Error adding backend, %s", new)
-					} else {
-						proxy := httputil.NewSingleHostReverseProxy(endpoint)
-						proxy.Transport = p.client.Transport
-						proxy.ErrorHandler = p.errorHandler
-						p.setupCache(proxy)
-
-						newHC := p.healthChecks[removedBackend].Reuse(new, proxy)
-						p.healthChecks[new] = newHC
-					}
-				} else {
-					p.healthChecks[removedBackend].Shutdown()
-				}
-
-				delete(p.healthChecks, removedBackend)
-			}
+func (p *pool) Shutdown() {
+	p.Lock()
+	for _, b := range p.backends {
+		b.hc.Shutdown()
+	}
 
-			poolConnections := []*connection.Connection{}
+	for b := range p.removing {
+		b.hc.Shutdown()
+		delete(p.removing, b)
+	}
 
-			wg := &sync.WaitGroup{}
-			for _, addedBackend := range added {
-				wg.Add(1)
-				poolConnections = p.addBackend(poolConnections, addedBackend, wg)
-			}
+	for _, b := range p.standby {
+		b.hc.Shutdown()
+	}
+	p.Unlock()
 
-			shuffle(poolConnections, p.connections)
-			p.Unlock()
-		}
+	if p.cache != nil {
+		p.cache.Close()
+	}
+}
+
+func (p *pool) ListenForBackendChanges(startup *sync.WaitGroup) {
+	l, err := control.Listen(p.socket)
+	if err != nil {
+		log.Fatal("listen error:", err)
+	}
+	defer l.Close()
+
+	log.Printf("Listening for backend changes on %s", p.socket.Path)
+	err = control.Serve(l, p, p.socket)
+	if err != nil {
+		log.Fatal("accept error:", err)
 	}
 }
 
@@ -282,38 +392,94 @@ func difference(original []string, updated []string) (added []string, removed []
 	return
 }
 
-func (p *pool) addBackend(connections []*connection.Connection, backend string, startup *sync.WaitGroup) []*connection.Connection {
-	endpoint, err := url.ParseRequestURI(backend)
+func (p *pool) addBackend(connections []*connection.Connection, backendURL string, weight int, startup *sync.WaitGroup) []*connection.Connection {
+	b, err := p.newBackend(backendURL, weight, startup)
 	if err != nil {
-		log.Printf("error parsing backend url: %s", backend)
+		log.Printf("error parsing backend url: %s", backendURL)
+		startup.Done()
 	} else {
-		proxy := httputil.NewSingleHostReverseProxy(endpoint)
-		proxy.ErrorHandler = p.errorHandler
-		proxy.Transport = p.client.Transport
-		p.setupCache(proxy)
-
-		backendConnections := make([]chan connection.Message, p.connsPerBackend)
-		for i := 0; i < p.connsPerBackend; i++ {
-			startup.Add(1)
-			configuredConn := connection.NewConnection(proxy, backend, startup)
-			connections = append(connections, configuredConn)
-			backendConnections[i] = configuredConn.Messages
+		connections = append(connections, b.connections...)
+		p.backends[backendURL] = b
+	}
+
+	startup.Wait()
+	return connections
+}
+
+// newBackend opens a backend's connections and starts its health checks,
+// the connections are not in the pool yet.
+func (p *pool) newBackend(backendURL string, weight int, startup *sync.WaitGroup) (*backend, error) {
+	proxy, err := p.newProxy(backendURL)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &backend{
+		url:    backendURL,
+		weight: weight,
+		proxy:  proxy,
+	}
+
+	backendConnections := p.newConnections(b, weight*p.connsPerBackend, startup)
+
+	hc := healthcheck.New(
+		p.client,
+		backendConnections,
+		backendURL,
+		false,
+	)
+
+	hc.Configure(p.healthCheck)
+	b.hc = hc
+
+	go hc.Start(startup)
+
+	return b, nil
+}
+
+// newConnections opens count connections to the backend and returns their
+// health check subscriptions.
+func (p *pool) newConnections(b *backend, count int, startup *sync.WaitGroup) []chan connection.Message {
+	subscriptions := make([]chan connection.Message, count)
+	for i := 0; i < count; i++ {
+		startup.Add(1)
+		configuredConn := connection.NewConnection(b.proxy, b.url, startup)
+		if b.maintenance {
+			configuredConn.SetMaintenance(true)
 		}
+		b.connections = append(b.connections, configuredConn)
+		subscriptions[i] = configuredConn.Messages
+	}
 
-		hc := healthcheck.New(
-			p.client,
-			backendConnections,
-			backend,
-			false,
-		)
+	return subscriptions
+}
 
-		p.healthChecks[backend] = hc
+func (p *pool) newProxy(backendURL string) (*httputil.ReverseProxy, error) {
+	endpoint, err := url.ParseRequestURI(backendURL)
+	if err != nil {
+		return nil, err
+	}
 
-		go hc.Start(startup)
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid backend url: %s", backendURL)
 	}
 
-	startup.Wait()
-	return connections
+	proxy := httputil.NewSingleHostReverseProxy(endpoint)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+
+		// routes with header rules rewrite the request once the backend is known
+		if x := headers.FromContext(r.Context()); x != nil {
+			x.SetBackend(backendURL)
+			x.RewriteRequest(r)
+		}
+	}
+	proxy.ErrorHandler = p.errorHandler
+	proxy.Transport = p.client.Transport
+	p.setupCache(proxy)
+
+	return proxy, nil
 }
 
 func (p *pool) errorHandler(w http.ResponseWriter, r *http.Request, e error) {
@@ -321,24 +487,53 @@ func (p *pool) errorHandler(w http.ResponseWriter, r *http.Request, e error) {
 
 	stats.RequestCounter.WithLabelValues(host, "backend_error").Add(1)
 
-	p.Fetch(w, r)
+	if current, ok := r.Context().Value(attemptsKey).(*attempt); ok {
+		current.failed = true
+		return
+	}
+
+	http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 }
 
 func (p *pool) setupCache(proxy *httputil.ReverseProxy) {
 	if p.cache != nil {
-		cacheResponse := func(r *http.Response) error {
-			body, err := ioutil.ReadAll(r.Body)
-			cacheable := string(body)
-			r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-
-			path := r.Request.URL.Path
-			if err == nil {
-				p.cache.Set(path, cacheable, 1)
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+
+			if rv, ok := r.Context().Value(revalidationKey).(*revalidation); ok {
+				rv.entry.AddConditions(r)
 			}
+		}
 
-			return nil
+		proxy.ModifyResponse = p.cacheResponse
+	}
+}
+
+func (p *pool) cacheResponse(r *http.Response) error {
+	rv, revalidating := r.Request.Context().Value(revalidationKey).(*revalidation)
+	if revalidating && r.StatusCode == http.StatusNotModified {
+		entry := p.cache.Renew(rv.entry, r.Header)
+		p.cache.Set(entry)
+		stats.CacheCounter.WithLabelValues(entry.Key, "revalidated").Add(1)
+
+		if !entry.NotModified(rv.request) {
+			r.StatusCode = entry.StatusCode
+			r.Status = http.StatusText(entry.StatusCode)
+			r.Header = entry.Header.Clone()
+			r.Body = ioutil.NopCloser(bytes.NewReader(entry.Body))
+			r.ContentLength = int64(len(entry.Body))
+			r.Header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
 		}
 
-		proxy.ModifyResponse = cacheResponse
+		return nil
 	}
+
+	if !cache.Cacheable(r) {
+		return nil
+	}
+
+	p.cache.Fill(cache.Key(r.Request), r)
+
+	return nil
 }
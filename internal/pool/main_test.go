@@ -2,6 +2,7 @@ package pool
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,25 +12,38 @@ import (
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/CoderCookE/goaround/internal/assert"
+	"github.com/CoderCookE/goaround/internal/control"
+	"github.com/CoderCookE/goaround/internal/headers"
 	"github.com/CoderCookE/goaround/internal/healthcheck"
+	"github.com/CoderCookE/goaround/internal/state"
 )
 
-func waitForHealthCheck(connectionPool *pool, server string) {
+func healthCheckFor(connectionPool *pool, server string) *healthcheck.HealthChecker {
 	connectionPool.RLock()
-	hc := connectionPool.healthChecks[server]
-	connectionPool.RUnlock()
+	defer connectionPool.RUnlock()
+
+	if b, ok := connectionPool.backends[server]; ok {
+		return b.hc
+	}
+
+	return nil
+}
+
+func waitForHealthCheck(connectionPool *pool, server string) {
+	hc := healthCheckFor(connectionPool, server)
 
 	for hc == nil {
 		time.Sleep(1 * time.Second)
 
-		connectionPool.RLock()
-		hc = connectionPool.healthChecks[server]
-		connectionPool.RUnlock()
+		hc = healthCheckFor(connectionPool, server)
 	}
 
 	hc.Wg.Wait()
@@ -54,10 +68,19 @@ func TestSetupCache(t *testing.T) {
 		connectionPool.setupCache(proxy)
 
 		req, _ := http.NewRequest("GET", "http://example.com/foo", nil)
-		res := &http.Response{Request: req, Body: ioutil.NopCloser(bytes.NewBufferString("bar"))}
+		res := &http.Response{
+			Request:    req,
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(bytes.NewBufferString("bar")),
+		}
 		err = proxy.ModifyResponse(res)
 		assertion.Equal(err, nil)
 
+		body, err := ioutil.ReadAll(res.Body)
+		assertion.Equal(err, nil)
+		assertion.Equal(string(body), "bar")
+
 		value, found := connectionPool.cache.Get("/foo")
 
 		breaker := !found
@@ -72,8 +95,8 @@ func TestSetupCache(t *testing.T) {
 			}
 		}
 
-		assertion.Equal(value, "bar")
 		assertion.Equal(found, true)
+		assertion.Equal(string(value.Body), "bar")
 	})
 }
 
@@ -150,6 +173,92 @@ func TestFetch(t *testing.T) {
 		})
 	})
 
+	t.Run("with cache revalidation", func(t *testing.T) {
+		var fullCount, notModifiedCount int
+		healthy := make(chan bool, 1)
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				healthReponse := &healthcheck.Reponse{State: "healthy", Message: ""}
+				message, _ := json.Marshal(healthReponse)
+				_, _ = w.Write(message)
+
+				select {
+				case healthy <- true:
+				default:
+				}
+				return
+			}
+
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModifiedCount += 1
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			fullCount += 1
+			_, err := w.Write([]byte("hello"))
+			if err != nil {
+				log.Printf("Error writing: %s", err.Error())
+			}
+		})
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		config := &Config{
+			Backends:    []string{server.URL},
+			NumConns:    1,
+			EnableCache: true,
+		}
+
+		connectionPool := New(config)
+		<-healthy
+		waitForHealthCheck(connectionPool, server.URL)
+		time.Sleep(500 * time.Millisecond)
+
+		fetch := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+			request := httptest.NewRequest("GET", "http://www.test.com"+path, nil)
+			if ifNoneMatch != "" {
+				request.Header.Set("If-None-Match", ifNoneMatch)
+			}
+			recorder := httptest.NewRecorder()
+			connectionPool.Fetch(recorder, request)
+			time.Sleep(100 * time.Millisecond)
+
+			return recorder
+		}
+
+		t.Run("stale entries are revalidated with the backend", func(t *testing.T) {
+			recorder := fetch("/stale?cc=max-age=0", "")
+			assertion.Equal(recorder.Code, http.StatusOK)
+			assertion.Equal(recorder.Body.String(), "hello")
+
+			recorder = fetch("/stale?cc=max-age=0", "")
+			assertion.Equal(recorder.Code, http.StatusOK)
+			assertion.Equal(recorder.Body.String(), "hello")
+			assertion.Equal(fullCount, 1)
+			assertion.Equal(notModifiedCount, 1)
+
+			recorder = fetch("/stale?cc=max-age=0", `"v1"`)
+			assertion.Equal(recorder.Code, http.StatusNotModified)
+			assertion.Equal(notModifiedCount, 2)
+		})
+
+		t.Run("conditional requests against fresh entries get 304 from the cache", func(t *testing.T) {
+			recorder := fetch("/fresh?cc=max-age=60", "")
+			assertion.Equal(recorder.Code, http.StatusOK)
+			calls := fullCount + notModifiedCount
+
+			recorder = fetch("/fresh?cc=max-age=60", `"v1"`)
+			assertion.Equal(recorder.Code, http.StatusNotModified)
+			assertion.Equal(recorder.Header().Get("ETag"), `"v1"`)
+			assertion.Equal(fullCount+notModifiedCount, calls)
+		})
+	})
+
 	t.Run("No cache", func(t *testing.T) {
 		t.Run("fetches each request from server", func(t *testing.T) {
 			var callCount int
@@ -298,20 +407,25 @@ func TestFetch(t *testing.T) {
 		availableServer := httptest.NewServer(availableHandler)
 		defer availableServer.Close()
 
+		dir, err := ioutil.TempDir("", "goaround")
+		assertion.Equal(err, nil)
+		defer os.RemoveAll(dir)
+
+		sockAddr := filepath.Join(dir, "goaround.sock")
 		config := &Config{
-			Backends: []string{},
-			NumConns: 10,
+			Backends:      []string{},
+			NumConns:      10,
+			ControlSocket: &control.SocketConfig{Path: sockAddr, Mode: 0600, UID: -1, GID: -1},
 		}
 
 		connectionPool := New(config)
 		time.Sleep(1 * time.Second)
 
-		const SockAddr = "/tmp/goaround.sock"
-		c, err := net.Dial("unix", SockAddr)
+		c, err := net.Dial("unix", sockAddr)
 		assertion.Equal(err, nil)
 		defer c.Close()
 
-		post := fmt.Sprintf("%s\n", availableServer.URL)
+		post := fmt.Sprintf("replace %s\n", availableServer.URL)
 		_, err = c.Write([]byte(post))
 		assertion.Equal(err, nil)
 
@@ -331,3 +445,584 @@ func TestFetch(t *testing.T) {
 		assertion.Equal(string(result), `bar`)
 	})
 }
+
+func TestControl(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message []byte
+		if r.URL.Path == "/health" {
+			healthReponse := &healthcheck.Reponse{State: "healthy", Message: ""}
+			message, _ = json.Marshal(healthReponse)
+		} else {
+			message = []byte("hello")
+		}
+
+		_, err := w.Write(message)
+		if err != nil {
+			log.Printf("Error writing: %s", err.Error())
+		}
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	config := &Config{
+		Backends: []string{},
+		NumConns: 2,
+	}
+
+	connectionPool := New(config)
+
+	t.Run("add validates every backend before adding any", func(t *testing.T) {
+		err := connectionPool.Add([]string{server.URL, "htp//typo"}, 1)
+		assertion.StringContains(err.Error(), "invalid backend urls: htp//typo")
+		assertion.Equal(len(connectionPool.List()), 0)
+	})
+
+	t.Run("add starts backends with a weight", func(t *testing.T) {
+		err := connectionPool.Add([]string{server.URL}, 2)
+		assertion.Equal(err, nil)
+		waitForHealthCheck(connectionPool, server.URL)
+
+		list := connectionPool.List()
+		assertion.Equal(len(list), 1)
+		assertion.Equal(list[0].Weight, 2)
+		assertion.Equal(list[0].Connections, 4)
+
+		err = connectionPool.Add([]string{server.URL}, 1)
+		assertion.StringContains(err.Error(), "backend already exists")
+	})
+
+	t.Run("set-weight scales connections", func(t *testing.T) {
+		err := connectionPool.SetWeight(server.URL, 1)
+		assertion.Equal(err, nil)
+		assertion.Equal(connectionPool.List()[0].Connections, 2)
+		assertion.Equal(len(connectionPool.connections), 2)
+
+		err = connectionPool.SetWeight(server.URL, 3)
+		assertion.Equal(err, nil)
+		assertion.Equal(connectionPool.List()[0].Connections, 6)
+		assertion.Equal(len(connectionPool.connections), 6)
+
+		err = connectionPool.SetWeight(server.URL, 0)
+		assertion.StringContains(err.Error(), "invalid weight")
+	})
+
+	t.Run("maintenance takes backends out of rotation until disabled", func(t *testing.T) {
+		fetch := func() *httptest.ResponseRecorder {
+			request := httptest.NewRequest("GET", "http://www.test.com/foo", nil)
+			recorder := httptest.NewRecorder()
+			connectionPool.Fetch(recorder, request)
+			return recorder
+		}
+
+		for !connectionPool.List()[0].Healthy {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		err := connectionPool.Maintenance([]string{server.URL}, true)
+		assertion.Equal(err, nil)
+		assertion.True(connectionPool.List()[0].Maintenance)
+		assertion.Equal(fetch().Code, http.StatusServiceUnavailable)
+
+		err = connectionPool.Maintenance([]string{server.URL}, false)
+		assertion.Equal(err, nil)
+
+		recorder := fetch()
+		assertion.Equal(recorder.Code, http.StatusOK)
+		assertion.Equal(recorder.Body.String(), "hello")
+		assertion.Equal(connectionPool.List()[0].InFlight, 0)
+		assertion.Equal(connectionPool.List()[0].Circuit, control.CircuitClosed)
+	})
+
+	t.Run("drain stops new requests", func(t *testing.T) {
+		err := connectionPool.Drain([]string{server.URL})
+		assertion.Equal(err, nil)
+		assertion.True(connectionPool.List()[0].Draining)
+
+		request := httptest.NewRequest("GET", "http://www.test.com/foo", nil)
+		recorder := httptest.NewRecorder()
+		connectionPool.Fetch(recorder, request)
+		assertion.Equal(recorder.Code, http.StatusServiceUnavailable)
+	})
+
+	t.Run("remove reports unknown backends", func(t *testing.T) {
+		err := connectionPool.Remove([]string{server.URL, "http://unknown"})
+		assertion.StringContains(err.Error(), "unknown backends: http://unknown")
+		assertion.Equal(len(connectionPool.List()), 1)
+
+		err = connectionPool.Remove([]string{server.URL})
+		assertion.Equal(err, nil)
+		assertion.Equal(len(connectionPool.List()), 0)
+		assertion.Equal(connectionPool.Status().Backends, 0)
+	})
+}
+
+func TestDrain(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	release := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message []byte
+		if r.URL.Path == "/health" {
+			healthReponse := &healthcheck.Reponse{State: "healthy", Message: ""}
+			message, _ = json.Marshal(healthReponse)
+		} else {
+			<-release
+			message = []byte("hello")
+		}
+
+		_, err := w.Write(message)
+		if err != nil {
+			log.Printf("Error writing: %s", err.Error())
+		}
+	})
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	start := func(timeout time.Duration) (*pool, chan *httptest.ResponseRecorder) {
+		connectionPool := New(&Config{Backends: []string{server.URL}, NumConns: 2, DrainTimeout: timeout})
+		for !connectionPool.List()[0].Healthy {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			request := httptest.NewRequest("GET", "http://www.test.com/foo", nil)
+			recorder := httptest.NewRecorder()
+			connectionPool.Fetch(recorder, request)
+			done <- recorder
+		}()
+
+		for connectionPool.List()[0].InFlight == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		return connectionPool, done
+	}
+
+	t.Run("removed backends finish requests in flight", func(t *testing.T) {
+		connectionPool, done := start(time.Minute)
+		defer connectionPool.Shutdown()
+
+		err := connectionPool.Remove([]string{server.URL})
+		assertion.Equal(err, nil)
+		assertion.Equal(connectionPool.Status().Backends, 0)
+		assertion.Equal(connectionPool.Status().DrainingBackends, 1)
+
+		list := connectionPool.List()
+		assertion.Equal(len(list), 1)
+		assertion.Equal(list[0].InFlight, 1)
+		assertion.True(list[0].Drain.Removing)
+		assertion.LessThan(list[0].Drain.Remaining, 61)
+
+		release <- true
+		recorder := <-done
+		assertion.Equal(recorder.Code, http.StatusOK)
+		assertion.Equal(recorder.Body.String(), "hello")
+
+		for len(connectionPool.List()) > 0 {
+			time.Sleep(drainInterval)
+		}
+		assertion.Equal(connectionPool.Status().DrainingBackends, 0)
+	})
+
+	t.Run("removed backends are shut down after the drain timeout", func(t *testing.T) {
+		connectionPool, done := start(200 * time.Millisecond)
+		defer connectionPool.Shutdown()
+
+		err := connectionPool.Remove([]string{server.URL})
+		assertion.Equal(err, nil)
+
+		for len(connectionPool.List()) > 0 {
+			time.Sleep(drainInterval)
+		}
+
+		release <- true
+		<-done
+	})
+}
+
+func TestReload(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthReponse := &healthcheck.Reponse{State: "healthy", Message: ""}
+		message, _ := json.Marshal(healthReponse)
+
+		_, err := w.Write(message)
+		if err != nil {
+			log.Printf("Error writing: %s", err.Error())
+		}
+	})
+
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+	third := httptest.NewServer(handler)
+	defer third.Close()
+
+	connectionPool := New(&Config{Backends: []string{first.URL, second.URL}, NumConns: 2})
+	defer connectionPool.Shutdown()
+
+	t.Run("reconciles backends and weights", func(t *testing.T) {
+		err := connectionPool.Reload(&Config{
+			Backends:   []string{second.URL, third.URL},
+			Weights:    map[string]int{second.URL: 3},
+			NumConns:   2,
+			MaxRetries: 2,
+		})
+		assertion.Equal(err, nil)
+
+		weights := make(map[string]int)
+		for _, b := range connectionPool.List() {
+			weights[b.Backend] = b.Weight
+		}
+		assertion.Equal(len(weights), 2)
+		assertion.Equal(weights[second.URL], 3)
+		assertion.Equal(weights[third.URL], 1)
+		assertion.Equal(atomic.LoadInt64(&connectionPool.maxRetries), int64(2))
+		assertion.Equal(len(connectionPool.connections), 8)
+	})
+
+	t.Run("leaves the pool unchanged when invalid", func(t *testing.T) {
+		err := connectionPool.Reload(&Config{Backends: []string{first.URL, "localhost:9000"}, NumConns: 2})
+		assertion.StringContains(err.Error(), "invalid backend urls: localhost:9000")
+		assertion.Equal(len(connectionPool.List()), 2)
+		assertion.Equal(atomic.LoadInt64(&connectionPool.maxRetries), int64(2))
+	})
+
+	t.Run("checks without changing the pool", func(t *testing.T) {
+		assertion.Equal(connectionPool.Check(&Config{Backends: []string{first.URL}, MaxRetries: 5}), nil)
+		assertion.StringContains(connectionPool.Check(&Config{MaxRetries: -1}).Error(), "invalid max retries")
+		assertion.Equal(len(connectionPool.List()), 2)
+		assertion.Equal(atomic.LoadInt64(&connectionPool.maxRetries), int64(2))
+	})
+}
+
+func TestSwitch(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	release := make(chan bool)
+	color := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var message []byte
+			switch r.URL.Path {
+			case "/health":
+				message, _ = json.Marshal(&healthcheck.Reponse{State: "healthy", Message: ""})
+			case "/slow":
+				<-release
+				message = []byte(name)
+			default:
+				message = []byte(name)
+			}
+
+			_, err := w.Write(message)
+			if err != nil {
+				log.Printf("Error writing: %s", err.Error())
+			}
+		}))
+	}
+
+	blue := color("blue")
+	defer blue.Close()
+	green := color("green")
+	defer green.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	connectionPool := New(&Config{
+		Backends:     []string{blue.URL},
+		NumConns:     2,
+		DrainTimeout: time.Minute,
+		Sets:         map[string][]string{"blue": {blue.URL}, "green": {green.URL}, "down": {down.URL}},
+		ActiveSet:    "blue",
+	})
+	defer connectionPool.Shutdown()
+
+	healthy := func() bool {
+		for _, b := range connectionPool.List() {
+			if !b.Healthy && b.Backend != down.URL {
+				return false
+			}
+		}
+		return true
+	}
+
+	for !healthy() {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	fetch := func(path string) string {
+		request := httptest.NewRequest("GET", "http://www.test.com"+path, nil)
+		recorder := httptest.NewRecorder()
+		connectionPool.Fetch(recorder, request)
+		return recorder.Body.String()
+	}
+
+	t.Run("keeps inactive sets on standby", func(t *testing.T) {
+		assertion.Equal(fetch("/"), "blue")
+		assertion.Equal(connectionPool.Status().ActiveSet, "blue")
+		assertion.Equal(connectionPool.Status().Backends, 1)
+
+		sets := make(map[string]string)
+		for _, b := range connectionPool.List() {
+			sets[b.Backend] = b.Set
+			assertion.Equal(b.Standby, b.Backend != blue.URL)
+		}
+		assertion.Equal(sets[blue.URL], "blue")
+		assertion.Equal(sets[green.URL], "green")
+		assertion.Equal(len(connectionPool.connections), 2)
+	})
+
+	t.Run("switches new requests at once and drains the old set", func(t *testing.T) {
+		done := make(chan string)
+		go func() {
+			done <- fetch("/slow")
+		}()
+
+		for connectionPool.List()[0].InFlight == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		assertion.Equal(connectionPool.Switch("green"), nil)
+		assertion.Equal(fetch("/"), "green")
+		assertion.Equal(connectionPool.Status().ActiveSet, "green")
+		assertion.Equal(connectionPool.Status().DrainingBackends, 1)
+
+		release <- true
+		assertion.Equal(<-done, "blue")
+
+		standby := false
+		for _, b := range connectionPool.List() {
+			if b.Backend == blue.URL && b.Standby {
+				standby = true
+			}
+		}
+		assertion.True(standby)
+	})
+
+	t.Run("refuses unknown and unhealthy sets", func(t *testing.T) {
+		assertion.Equal(connectionPool.Switch("green"), nil)
+		assertion.Equal(connectionPool.Switch("red").Error(), `unknown set "red"`)
+		assertion.Equal(connectionPool.Switch("down").Error(), "no healthy backends in set down")
+		assertion.Equal(fetch("/"), "green")
+	})
+
+	t.Run("switches back", func(t *testing.T) {
+		assertion.Equal(connectionPool.Switch("blue"), nil)
+		assertion.Equal(fetch("/"), "blue")
+	})
+
+	t.Run("leaves invalid urls out of a set", func(t *testing.T) {
+		typo := New(&Config{
+			Backends:  []string{blue.URL},
+			NumConns:  1,
+			Sets:      map[string][]string{"blue": {blue.URL}, "green": {"http://%zz", green.URL}, "broken": {"http://%zz"}},
+			ActiveSet: "blue",
+		})
+		defer typo.Shutdown()
+
+		ready := func() bool {
+			for _, b := range typo.List() {
+				if !b.Healthy {
+					return false
+				}
+			}
+			return true
+		}
+
+		for !ready() {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		assertion.Equal(typo.Switch("broken").Error(), "no healthy backends in set broken")
+		assertion.Equal(typo.Switch("green"), nil)
+		assertion.Equal(typo.Status().ActiveSet, "green")
+		assertion.Equal(typo.Status().Backends, 1)
+	})
+}
+
+func TestHeaderRules(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			message, _ := json.Marshal(&healthcheck.Reponse{State: "healthy", Message: ""})
+			w.Write(message)
+			return
+		}
+
+		w.Header().Set("X-Seen-Backend", r.Header.Get("X-Backend"))
+		w.Header().Set("X-Seen-Internal", r.Header.Get("X-Internal"))
+	}))
+	defer server.Close()
+
+	connectionPool := New(&Config{Backends: []string{server.URL}, NumConns: 1})
+	defer connectionPool.Shutdown()
+
+	for !connectionPool.List()[0].Healthy {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Run("applies request rules once a backend is picked", func(t *testing.T) {
+		rules := &headers.Rules{
+			Remove: []string{"X-Internal"},
+			Set:    map[string]string{"X-Backend": "{backend}"},
+		}
+
+		request := httptest.NewRequest("GET", "http://www.test.com/foo", nil)
+		request.Header.Set("X-Internal", "secret")
+		x := headers.NewExchange(request, rules, nil)
+		request = request.WithContext(headers.NewContext(request.Context(), x))
+
+		recorder := httptest.NewRecorder()
+		connectionPool.Fetch(recorder, request)
+
+		backend, _ := url.Parse(server.URL)
+		assertion.Equal(recorder.Header().Get("X-Seen-Backend"), backend.Host)
+		assertion.Equal(recorder.Header().Get("X-Seen-Internal"), "")
+	})
+
+	t.Run("applies request rules once per retry", func(t *testing.T) {
+		var requests int32
+		flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				message, _ := json.Marshal(&healthcheck.Reponse{State: "healthy", Message: ""})
+				w.Write(message)
+				return
+			}
+
+			if atomic.AddInt32(&requests, 1) == 1 {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+
+			w.Header().Set("X-Seen-Via", strings.Join(r.Header["Via"], ","))
+		}))
+		defer flaky.Close()
+
+		retrying := New(&Config{Backends: []string{flaky.URL}, NumConns: 2, MaxRetries: 1})
+		defer retrying.Shutdown()
+
+		for !retrying.List()[0].Healthy {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		request := httptest.NewRequest("GET", "http://www.test.com/foo", nil)
+		x := headers.NewExchange(request, &headers.Rules{Add: map[string]string{"Via": "goaround"}}, nil)
+		request = request.WithContext(headers.NewContext(request.Context(), x))
+
+		recorder := httptest.NewRecorder()
+		retrying.Fetch(recorder, request)
+
+		assertion.Equal(atomic.LoadInt32(&requests), int32(2))
+		assertion.Equal(recorder.Header().Get("X-Seen-Via"), "goaround")
+	})
+}
+
+func TestRetries(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	var requests int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			message, _ := json.Marshal(&healthcheck.Reponse{State: "healthy", Message: ""})
+			w.Write(message)
+			return
+		}
+
+		atomic.AddInt32(&requests, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer failing.Close()
+
+	connectionPool := New(&Config{Backends: []string{failing.URL}, NumConns: 1, MaxRetries: 2})
+	defer connectionPool.Shutdown()
+
+	for !connectionPool.List()[0].Healthy {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Run("gives up with a bad gateway after the last retry", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		connectionPool.Fetch(recorder, httptest.NewRequest("GET", "http://www.test.com/foo", nil))
+
+		assertion.Equal(atomic.LoadInt32(&requests), int32(3))
+		assertion.Equal(recorder.Code, http.StatusBadGateway)
+		assertion.Equal(len(connectionPool.connections), 1)
+	})
+
+	t.Run("follows max retries from a reload", func(t *testing.T) {
+		assertion.Equal(connectionPool.Reload(&Config{Backends: []string{failing.URL}, NumConns: 1, MaxRetries: 0}), nil)
+		atomic.StoreInt32(&requests, 0)
+
+		recorder := httptest.NewRecorder()
+		connectionPool.Fetch(recorder, httptest.NewRequest("GET", "http://www.test.com/foo", nil))
+
+		assertion.Equal(atomic.LoadInt32(&requests), int32(1))
+		assertion.Equal(recorder.Code, http.StatusBadGateway)
+	})
+
+	t.Run("stops waiting for a connection once the request is done", func(t *testing.T) {
+		conn := <-connectionPool.connections
+		defer func() { connectionPool.connections <- conn }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		recorder := httptest.NewRecorder()
+		start := time.Now()
+		connectionPool.Fetch(recorder, httptest.NewRequest("GET", "http://www.test.com/foo", nil).WithContext(ctx))
+
+		assertion.True(time.Since(start) < time.Second)
+		assertion.Equal(recorder.Code, http.StatusServiceUnavailable)
+	})
+}
+
+func TestSaveState(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	connectionPool := New(&Config{Backends: []string{"http://localhost:9000"}, NumConns: 1, StateFile: path})
+	defer connectionPool.Shutdown()
+
+	load := func() map[string]state.Backend {
+		saved, err := state.Load(path)
+		assertion.Equal(err, nil)
+
+		backends := make(map[string]state.Backend)
+		for _, b := range saved.Backends {
+			backends[b.URL] = b
+		}
+		return backends
+	}
+
+	t.Run("saves every change", func(t *testing.T) {
+		assertion.Equal(connectionPool.Add([]string{"http://localhost:9001", "http://localhost:9002"}, 2), nil)
+		assertion.Equal(connectionPool.Maintenance([]string{"http://localhost:9000"}, true), nil)
+		assertion.Equal(connectionPool.Drain([]string{"http://localhost:9001"}), nil)
+		assertion.Equal(connectionPool.Remove([]string{"http://localhost:9002"}), nil)
+
+		saved := load()
+		assertion.Equal(len(saved), 2)
+		assertion.True(saved["http://localhost:9000"].Maintenance)
+		assertion.Equal(saved["http://localhost:9001"].Weight, 2)
+		assertion.True(saved["http://localhost:9001"].Draining)
+	})
+
+	t.Run("keeps the last state when saving fails", func(t *testing.T) {
+		connectionPool.stateFile = filepath.Join(dir, "missing", "state.json")
+		assertion.Equal(connectionPool.SetWeight("http://localhost:9000", 3), nil)
+		assertion.Equal(load()["http://localhost:9000"].Weight, 1)
+	})
+}
@@ -0,0 +1,140 @@
+package pool
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/CoderCookE/goaround/internal/control"
+)
+
+// Switch makes another backend set active. Its backends are already health
+// checked on standby, so they take new requests at once while the current
+// backends drain. The previous set goes back on standby with fresh health
+// checks, ready to switch back to. Backends that couldn't be put on standby
+// are left out.
+func (p *pool) Switch(set string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	backends, ok := p.sets[set]
+	if !ok {
+		return fmt.Errorf("unknown set %q", set)
+	}
+
+	if set == p.active {
+		return nil
+	}
+
+	healthy := false
+	total := 0
+	for _, url := range backends {
+		b, found := p.standby[url]
+		if !found {
+			log.Printf("Leaving %s out of set %s, it is not on standby", url, set)
+			continue
+		}
+
+		if b.hc.Healthy() {
+			healthy = true
+		}
+		total += len(b.connections)
+	}
+
+	if !healthy {
+		return fmt.Errorf("no healthy backends in set %s", set)
+	}
+
+	if total > cap(p.connections) {
+		return fmt.Errorf("pool capacity of %d connections exceeded", cap(p.connections))
+	}
+
+	for url, b := range p.backends {
+		p.retire(b)
+		delete(p.backends, url)
+	}
+
+	p.compact()
+
+	for _, url := range backends {
+		b, found := p.standby[url]
+		if !found {
+			continue
+		}
+		delete(p.standby, url)
+
+		p.backends[url] = b
+		shuffle(b.connections, p.connections)
+	}
+
+	log.Printf("Switched from set %s to %s", p.active, set)
+	p.active = set
+	p.addStandby()
+
+	return nil
+}
+
+// addStandby opens connections and health checks for the backends of every
+// inactive set, their connections stay out of the pool until a switch.
+func (p *pool) addStandby() {
+	startup := &sync.WaitGroup{}
+
+	for set, backends := range p.sets {
+		if set == p.active {
+			continue
+		}
+
+		for _, url := range backends {
+			if _, found := p.standby[url]; found {
+				continue
+			}
+
+			startup.Add(1)
+			b, err := p.newBackend(url, weightOf(p.setWeights, url), startup)
+			if err != nil {
+				log.Printf("error parsing backend url: %s", url)
+				startup.Done()
+				continue
+			}
+
+			p.standby[url] = b
+		}
+	}
+
+	startup.Wait()
+}
+
+// standbyStatus lists the backends of the inactive sets.
+func (p *pool) standbyStatus() []control.BackendStatus {
+	var list []control.BackendStatus
+	for set, backends := range p.sets {
+		for _, url := range backends {
+			b, found := p.standby[url]
+			if !found {
+				continue
+			}
+
+			status := b.status()
+			status.Set = set
+			status.Standby = true
+			list = append(list, status)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Backend < list[j].Backend
+	})
+
+	return list
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
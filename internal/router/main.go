@@ -0,0 +1,113 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Router picks a handler by the request's Host header. Exact hosts win over
+// wildcards, and longer wildcards over shorter ones, requests for any other
+// host go to the default handler. Routes are tried before hosts, and can be
+// replaced while serving.
+type Router struct {
+	sync.RWMutex
+	hosts     map[string]http.Handler
+	wildcards []wildcard
+	routes    []*Route
+	fallback  http.Handler
+}
+
+// wildcard matches every subdomain of suffix, at any depth, but not the
+// domain itself.
+type wildcard struct {
+	suffix  string
+	handler http.Handler
+}
+
+func New(fallback http.Handler) *Router {
+	return &Router{
+		hosts:    make(map[string]http.Handler),
+		fallback: fallback,
+	}
+}
+
+// Handle routes a host, ex: api.example.com or *.example.com, to a handler.
+func (r *Router) Handle(host string, h http.Handler) error {
+	pattern, err := Pattern(host)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		for _, w := range r.wildcards {
+			if w.suffix == suffix {
+				return fmt.Errorf("duplicate host %s", host)
+			}
+		}
+
+		r.wildcards = append(r.wildcards, wildcard{suffix: suffix, handler: h})
+		sort.SliceStable(r.wildcards, func(i, j int) bool {
+			return len(r.wildcards[i].suffix) > len(r.wildcards[j].suffix)
+		})
+		return nil
+	}
+
+	if _, found := r.hosts[pattern]; found {
+		return fmt.Errorf("duplicate host %s", host)
+	}
+
+	r.hosts[pattern] = h
+	return nil
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if route := r.route(req); route != nil {
+		route.serve(w, req)
+		return
+	}
+
+	r.Match(req.Host).ServeHTTP(w, req)
+}
+
+// Match returns the handler of a host, the port is ignored.
+func (r *Router) Match(host string) http.Handler {
+	host = normalize(host)
+
+	if h, found := r.hosts[host]; found {
+		return h
+	}
+
+	for _, w := range r.wildcards {
+		if strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			return w.handler
+		}
+	}
+
+	return r.fallback
+}
+
+// Pattern checks a host pattern and returns it in the form hosts are
+// matched in.
+func Pattern(host string) (string, error) {
+	pattern := normalize(host)
+	name := strings.TrimPrefix(pattern, "*.")
+
+	if name == "" || strings.Contains(name, "*") || strings.ContainsAny(name, "/:[] ") || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid host %q, use a name such as api.example.com or *.example.com", host)
+	}
+
+	return pattern, nil
+}
+
+func normalize(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,441 @@
+package router
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CoderCookE/goaround/internal/assert"
+	"github.com/CoderCookE/goaround/internal/headers"
+	"github.com/CoderCookE/goaround/internal/stats"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Pool", name)
+		w.Header().Set("X-Path", r.URL.Path)
+	})
+}
+
+func TestRouter(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	r := New(named("default"))
+	assertion.Equal(r.Handle("api.example.com", named("api")), nil)
+	assertion.Equal(r.Handle("*.example.com", named("example")), nil)
+	assertion.Equal(r.Handle("*.eu.example.com", named("eu")), nil)
+
+	route := func(host string) string {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		r.ServeHTTP(recorder, request)
+
+		return recorder.Header().Get("X-Pool")
+	}
+
+	t.Run("prefers exact hosts", func(t *testing.T) {
+		assertion.Equal(route("api.example.com"), "api")
+		assertion.Equal(route("API.Example.com:8443"), "api")
+		assertion.Equal(route("api.example.com."), "api")
+	})
+
+	t.Run("matches the longest wildcard", func(t *testing.T) {
+		assertion.Equal(route("www.example.com"), "example")
+		assertion.Equal(route("a.b.example.com"), "example")
+		assertion.Equal(route("www.eu.example.com"), "eu")
+	})
+
+	t.Run("falls back to the default", func(t *testing.T) {
+		assertion.Equal(route("example.com"), "default")
+		assertion.Equal(route("badexample.com"), "default")
+		assertion.Equal(route("127.0.0.1:3000"), "default")
+	})
+
+	t.Run("rejects invalid and duplicate hosts", func(t *testing.T) {
+		assertion.StringContains(r.Handle("*.Example.com", named("again")).Error(), "duplicate host *.Example.com")
+		assertion.StringContains(r.Handle("api.example.com:80", named("again")).Error(), "duplicate host")
+		assertion.StringContains(r.Handle("api.*.com", named("again")).Error(), `invalid host "api.*.com"`)
+		assertion.StringContains(r.Handle("*", named("again")).Error(), `invalid host "*"`)
+	})
+}
+
+func TestRoutes(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	r := New(named("default"))
+	assertion.Equal(r.Handle("api.example.com", named("api")), nil)
+
+	routes := []Route{
+		{PathPrefix: "/api", Handler: named("api-any")},
+		{PathPrefix: "/api/users", StripPrefix: true, Handler: named("users")},
+		{PathPrefix: "/api/orders/", ReplacePrefix: "/v2/", Handler: named("orders")},
+		{PathRegex: regexp.MustCompile(`^/api/users/[0-9]+/avatar`), Handler: named("avatars")},
+		{Host: "*.example.com", PathPrefix: "/api", Handler: named("example-api")},
+		{PathPrefix: "/admin", Methods: []string{"post"}, Headers: map[string]string{"X-Admin": ""}, Query: map[string]string{"debug": "1"}, Handler: named("admin")},
+	}
+	for _, route := range routes {
+		assertion.Equal(r.Route(route), nil)
+	}
+
+	route := func(method, target string, header http.Header) (string, string) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, target, nil)
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		r.ServeHTTP(recorder, request)
+
+		return recorder.Header().Get("X-Pool"), recorder.Header().Get("X-Path")
+	}
+
+	t.Run("prefers the longest match", func(t *testing.T) {
+		pool, path := route("GET", "http://lb.test/api/users/42", nil)
+		assertion.Equal(pool, "users")
+		assertion.Equal(path, "/42")
+
+		pool, _ = route("GET", "http://lb.test/api/users/42/avatar.png", nil)
+		assertion.Equal(pool, "avatars")
+
+		pool, path = route("GET", "http://lb.test/api/status", nil)
+		assertion.Equal(pool, "api-any")
+		assertion.Equal(path, "/api/status")
+	})
+
+	t.Run("matches prefixes on segments", func(t *testing.T) {
+		pool, path := route("GET", "http://lb.test/api/users", nil)
+		assertion.Equal(pool, "users")
+		assertion.Equal(path, "/")
+
+		pool, _ = route("GET", "http://lb.test/api/usersettings", nil)
+		assertion.Equal(pool, "api-any")
+
+		pool, _ = route("GET", "http://lb.test/apiary", nil)
+		assertion.Equal(pool, "default")
+	})
+
+	t.Run("replaces prefixes", func(t *testing.T) {
+		pool, path := route("GET", "http://lb.test/api/orders/7", nil)
+		assertion.Equal(pool, "orders")
+		assertion.Equal(path, "/v2/7")
+	})
+
+	t.Run("prefers routes with a host on ties", func(t *testing.T) {
+		pool, _ := route("GET", "http://www.example.com/api/status", nil)
+		assertion.Equal(pool, "example-api")
+
+		pool, _ = route("GET", "http://api.example.com/other", nil)
+		assertion.Equal(pool, "api")
+	})
+
+	t.Run("matches methods, headers and query", func(t *testing.T) {
+		pool, _ := route("POST", "http://lb.test/admin?debug=1", http.Header{"X-Admin": {"yes"}})
+		assertion.Equal(pool, "admin")
+
+		pool, _ = route("GET", "http://lb.test/admin?debug=1", http.Header{"X-Admin": {"yes"}})
+		assertion.Equal(pool, "default")
+
+		pool, _ = route("POST", "http://lb.test/admin?debug=0", http.Header{"X-Admin": {"yes"}})
+		assertion.Equal(pool, "default")
+
+		pool, _ = route("POST", "http://lb.test/admin?debug=1", nil)
+		assertion.Equal(pool, "default")
+	})
+
+	t.Run("applies response header rules", func(t *testing.T) {
+		backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			x := headers.FromContext(r.Context())
+			x.SetBackend("http://10.0.1.2:8080")
+
+			w.Header().Set("Server", "nginx")
+			w.Header().Set("X-Request", x.Expand("{request_id}"))
+			w.Write([]byte("ok"))
+		})
+
+		rules := &headers.Rules{
+			Remove: []string{"Server"},
+			Set:    map[string]string{"X-Backend": "{backend}"},
+		}
+
+		r := New(named("default"))
+		assertion.Equal(r.Route(Route{PathPrefix: "/shop", ResponseHeaders: rules, Handler: backend}), nil)
+
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://lb.test/shop", nil)
+		request.Header.Set(headers.RequestIDHeader, "abc")
+		r.ServeHTTP(recorder, request)
+
+		assertion.Equal(recorder.Header().Get("Server"), "")
+		assertion.Equal(recorder.Header().Get("X-Backend"), "10.0.1.2:8080")
+		assertion.Equal(recorder.Header().Get("X-Request"), "abc")
+		assertion.Equal(recorder.Body.String(), "ok")
+	})
+
+	t.Run("rejects invalid routes", func(t *testing.T) {
+		err := r.Route(Route{PathPrefix: "api"})
+		assertion.StringContains(err.Error(), "must start with /")
+
+		err = r.Route(Route{PathRegex: regexp.MustCompile("^/api"), StripPrefix: true})
+		assertion.Equal(err.Error(), "strip and replace prefix require a path prefix")
+	})
+
+	t.Run("replaces every route at once", func(t *testing.T) {
+		r := New(named("default"))
+		assertion.Equal(r.Route(Route{PathPrefix: "/api", Handler: named("api")}), nil)
+
+		err := r.SetRoutes([]Route{{PathPrefix: "/v2", Handler: named("v2")}, {PathPrefix: "v3"}})
+		assertion.Equal(err.Error(), `routes[1]: invalid path prefix "v3", must start with /`)
+
+		serve := func(target string) string {
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+			return recorder.Header().Get("X-Pool")
+		}
+		assertion.Equal(serve("http://lb.test/api/users"), "api")
+
+		assertion.Equal(r.SetRoutes([]Route{{PathPrefix: "/v2", Handler: named("v2")}}), nil)
+		assertion.Equal(serve("http://lb.test/api/users"), "default")
+		assertion.Equal(serve("http://lb.test/v2/users"), "v2")
+	})
+}
+
+func TestRules(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	r := New(named("default"))
+	routes := []Route{
+		{Host: "www.example.com", Rules: []Rule{
+			{Redirect: "{scheme}://example.com{path}", Status: http.StatusMovedPermanently},
+		}},
+		{Host: "example.com", Rules: []Rule{
+			{Scheme: "http", Redirect: "https://{host}{path}", Status: http.StatusPermanentRedirect},
+		}, Handler: named("shop")},
+		{PathPrefix: "/blog", Rules: []Rule{
+			{Path: regexp.MustCompile(`^/blog/(\d+)$`), Redirect: "/posts/$1"},
+			{Path: regexp.MustCompile(`^/blog/(?P<slug>[a-z-]+)$`), Rewrite: "/articles/${slug}"},
+			{Path: regexp.MustCompile(`^/articles/(.+)$`), Rewrite: "/v2/articles/$1"},
+		}, Handler: named("blog")},
+	}
+	for _, route := range routes {
+		assertion.Equal(r.Route(route), nil)
+	}
+
+	serve := func(target string, header http.Header) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", target, nil)
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		r.ServeHTTP(recorder, request)
+
+		return recorder
+	}
+
+	t.Run("redirects www to the apex", func(t *testing.T) {
+		recorder := serve("http://www.example.com/cart?item=7", nil)
+		assertion.Equal(recorder.Code, http.StatusMovedPermanently)
+		assertion.Equal(recorder.Header().Get("Location"), "http://example.com/cart?item=7")
+	})
+
+	t.Run("redirects http to https", func(t *testing.T) {
+		recorder := serve("http://example.com/cart", nil)
+		assertion.Equal(recorder.Code, http.StatusPermanentRedirect)
+		assertion.Equal(recorder.Header().Get("Location"), "https://example.com/cart")
+
+		recorder = serve("http://example.com/cart", http.Header{"X-Forwarded-Proto": {"https"}})
+		assertion.Equal(recorder.Code, http.StatusOK)
+		assertion.Equal(recorder.Header().Get("X-Pool"), "shop")
+	})
+
+	t.Run("redirects old paths with capture groups", func(t *testing.T) {
+		recorder := serve("http://lb.test/blog/42", nil)
+		assertion.Equal(recorder.Code, http.StatusFound)
+		assertion.Equal(recorder.Header().Get("Location"), "/posts/42")
+	})
+
+	t.Run("rewrites paths in order", func(t *testing.T) {
+		recorder := serve("http://lb.test/blog/hello-world", nil)
+		assertion.Equal(recorder.Header().Get("X-Pool"), "blog")
+		assertion.Equal(recorder.Header().Get("X-Path"), "/v2/articles/hello-world")
+
+		recorder = serve("http://lb.test/blog", nil)
+		assertion.Equal(recorder.Header().Get("X-Path"), "/blog")
+	})
+
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		err := r.Route(Route{Rules: []Rule{{Redirect: "/new", Rewrite: "/new"}}})
+		assertion.Equal(err.Error(), "rules[0]: must either redirect or rewrite")
+
+		err = r.Route(Route{Rules: []Rule{{Redirect: "/new", Status: http.StatusOK}}})
+		assertion.StringContains(err.Error(), "invalid status 200")
+
+		err = r.Route(Route{PathPrefix: "/api", StripPrefix: true, Rules: []Rule{{Rewrite: "/v2"}}})
+		assertion.StringContains(err.Error(), "can't be used with strip or replace prefix")
+	})
+}
+
+func TestSplit(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Pool", "canary")
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	split := &Split{Name: "checkout", CanaryPool: "canary", Stable: named("stable"), Canary: failing, Header: "X-Canary", Cookie: "canary"}
+
+	serve := func(header, cookie string) string {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://lb.test/checkout", nil)
+		if header != "" {
+			request.Header.Set("X-Canary", header)
+		}
+		if cookie != "" {
+			request.AddCookie(&http.Cookie{Name: "canary", Value: cookie})
+		}
+		split.ServeHTTP(recorder, request)
+
+		return recorder.Header().Get("X-Pool")
+	}
+
+	t.Run("sends the percentage to the canary", func(t *testing.T) {
+		assertion.Equal(split.SetPercent(0), nil)
+		assertion.Equal(serve("", ""), "stable")
+
+		assertion.Equal(split.SetPercent(100), nil)
+		assertion.Equal(serve("", ""), "canary")
+
+		assertion.Equal(split.SetPercent(25), nil)
+		canary := 0
+		for i := 0; i < 4000; i++ {
+			if serve("", "") == "canary" {
+				canary++
+			}
+		}
+		assertion.True(canary > 800 && canary < 1200)
+	})
+
+	t.Run("forces a pool by header or cookie", func(t *testing.T) {
+		assertion.Equal(split.SetPercent(0), nil)
+		assertion.Equal(serve("1", ""), "canary")
+		assertion.Equal(serve("", "canary"), "canary")
+		assertion.Equal(serve("nope", ""), "stable")
+
+		assertion.Equal(split.SetPercent(100), nil)
+		assertion.Equal(serve("stable", ""), "stable")
+		assertion.Equal(serve("", "false"), "stable")
+	})
+
+	t.Run("counts requests and errors per target", func(t *testing.T) {
+		failures := testutil.ToFloat64(stats.SplitErrorCounter.WithLabelValues("checkout", TargetCanary))
+		requests := testutil.ToFloat64(stats.SplitRequestCounter.WithLabelValues("checkout", TargetStable, "200"))
+
+		serve("1", "")
+		serve("0", "")
+
+		assertion.Equal(testutil.ToFloat64(stats.SplitErrorCounter.WithLabelValues("checkout", TargetCanary)), failures+1)
+		assertion.Equal(testutil.ToFloat64(stats.SplitRequestCounter.WithLabelValues("checkout", TargetStable, "200")), requests+1)
+	})
+
+	t.Run("rejects invalid percentages", func(t *testing.T) {
+		assertion.StringContains(split.SetPercent(101).Error(), "invalid percent")
+		assertion.StringContains(split.SetPercent(-1).Error(), "invalid percent")
+
+		splits := Splits{"checkout": split}
+		assertion.Equal(splits.SetSplit("checkout", 5), nil)
+		assertion.Equal(splits.Splits()[0].Percent, 5.0)
+		assertion.Equal(splits.Splits()[0].Canary, "canary")
+		assertion.StringContains(splits.SetSplit("search", 5).Error(), `unknown split "search"`)
+	})
+}
+
+func TestMirror(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	release := make(chan bool)
+	shadowed := make(chan string, 10)
+	shadow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		shadowed <- string(body)
+		if r.Header.Get("X-Slow") != "" {
+			<-release
+		}
+		if r.Header.Get("X-Panic") != "" {
+			panic("shadow failed")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	mirror := &Mirror{Pool: "shadow", Handler: echo, Shadow: shadow, Percent: 100, MaxBody: 8, MaxInFlight: 1}
+
+	send := func(body string, header string) string {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "http://lb.test/orders", strings.NewReader(body))
+		if header != "" {
+			request.Header.Set(header, "1")
+		}
+		mirror.ServeHTTP(recorder, request)
+
+		return recorder.Body.String()
+	}
+
+	outcome := func(outcome string) float64 {
+		return testutil.ToFloat64(stats.MirrorCounter.WithLabelValues("shadow", outcome))
+	}
+
+	wait := func(outcome string, want float64) {
+		deadline := time.Now().Add(time.Second)
+		for testutil.ToFloat64(stats.MirrorCounter.WithLabelValues("shadow", outcome)) < want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("copies requests with their bodies", func(t *testing.T) {
+		teapots := outcome("418")
+
+		assertion.Equal(send("order", ""), "order")
+		assertion.Equal(<-shadowed, "order")
+
+		wait("418", teapots+1)
+		assertion.Equal(outcome("418"), teapots+1)
+	})
+
+	t.Run("doesn't wait for a slow shadow", func(t *testing.T) {
+		dropped, teapots := outcome("dropped"), outcome("418")
+
+		assertion.Equal(send("slow", "X-Slow"), "slow")
+		assertion.Equal(<-shadowed, "slow")
+
+		assertion.Equal(send("fast", ""), "fast")
+		assertion.Equal(outcome("dropped"), dropped+1)
+
+		release <- true
+		wait("418", teapots+1)
+	})
+
+	t.Run("skips bodies that are too large", func(t *testing.T) {
+		tooLarge := outcome("too_large")
+
+		assertion.Equal(send("a large order", ""), "a large order")
+		assertion.Equal(outcome("too_large"), tooLarge+1)
+		assertion.Equal(len(shadowed), 0)
+	})
+
+	t.Run("recovers from a failing shadow", func(t *testing.T) {
+		failures := outcome("error")
+
+		assertion.Equal(send("panic", "X-Panic"), "panic")
+		assertion.Equal(<-shadowed, "panic")
+
+		wait("error", failures+1)
+		assertion.Equal(outcome("error"), failures+1)
+	})
+}
@@ -0,0 +1,184 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/CoderCookE/goaround/internal/stats"
+)
+
+// Defaults of mirrors that leave a setting at zero.
+const (
+	DefaultMirrorMaxBody     = 1 << 20
+	DefaultMirrorTimeout     = 10 * time.Second
+	DefaultMirrorMaxInFlight = 100
+)
+
+// Mirror serves requests from its handler and copies Percent of them,
+// bodies included, to a shadow whose responses are discarded. Copies run in
+// the background with their own timeout, they are skipped when the body is
+// larger than MaxBody or MaxInFlight copies are already running, so a slow
+// shadow never holds up the primary.
+type Mirror struct {
+	// Pool names the shadow pool in metrics, the default pool is empty
+	Pool        string
+	Handler     http.Handler
+	Shadow      http.Handler
+	Percent     float64
+	MaxBody     int64
+	Timeout     time.Duration
+	MaxInFlight int64
+	inFlight    int64
+}
+
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if m.Percent <= 0 || rand.Float64()*100 >= m.Percent {
+		m.Handler.ServeHTTP(w, req)
+		return
+	}
+
+	if atomic.AddInt64(&m.inFlight, 1) > m.maxInFlight() {
+		atomic.AddInt64(&m.inFlight, -1)
+		stats.MirrorCounter.WithLabelValues(m.Pool, "dropped").Add(1)
+		m.Handler.ServeHTTP(w, req)
+		return
+	}
+
+	body, ok := m.readBody(req)
+	if !ok {
+		atomic.AddInt64(&m.inFlight, -1)
+		stats.MirrorCounter.WithLabelValues(m.Pool, "too_large").Add(1)
+		m.Handler.ServeHTTP(w, req)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout())
+	shadow := req.Clone(ctx)
+	shadow.Body = http.NoBody
+	shadow.ContentLength = int64(len(body))
+	if body != nil {
+		shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	go m.mirror(shadow, cancel)
+
+	m.Handler.ServeHTTP(w, req)
+}
+
+// mirror sends the copy to the shadow and records how it went, a panic in
+// the shadow is logged and counted as an error.
+func (m *Mirror) mirror(req *http.Request, cancel context.CancelFunc) {
+	start := time.Now()
+	writer := &discardWriter{header: make(http.Header), status: http.StatusOK}
+
+	defer func() {
+		cancel()
+		atomic.AddInt64(&m.inFlight, -1)
+
+		outcome := strconv.Itoa(writer.status)
+		if err := recover(); err != nil {
+			log.Printf("Error mirroring %s %s: %v", req.Method, req.URL.Path, err)
+			outcome = "error"
+		}
+
+		stats.MirrorCounter.WithLabelValues(m.Pool, outcome).Add(1)
+		stats.MirrorDurations.WithLabelValues(m.Pool).Observe(time.Since(start).Seconds())
+	}()
+
+	m.Shadow.ServeHTTP(writer, req)
+}
+
+// readBody buffers the request body so it can be sent twice, ok is false
+// when it is too large or can't be read, the primary then gets the body
+// as it was.
+func (m *Mirror) readBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+
+	limit := m.maxBody()
+	if req.ContentLength > limit {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	rest := io.Reader(req.Body)
+	if err != nil {
+		rest = &errorReader{err: err}
+	}
+	req.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), rest), Closer: req.Body}
+
+	if err != nil || int64(len(body)) > limit {
+		return nil, false
+	}
+
+	return body, true
+}
+
+func (m *Mirror) maxBody() int64 {
+	if m.MaxBody > 0 {
+		return m.MaxBody
+	}
+
+	return DefaultMirrorMaxBody
+}
+
+func (m *Mirror) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+
+	return DefaultMirrorTimeout
+}
+
+func (m *Mirror) maxInFlight() int64 {
+	if m.MaxInFlight > 0 {
+		return m.MaxInFlight
+	}
+
+	return DefaultMirrorMaxInFlight
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// discardWriter takes the shadow's response and keeps only its status.
+type discardWriter struct {
+	header http.Header
+	status int
+	wrote  bool
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.status = status
+		w.wrote = true
+	}
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return len(b), nil
+}
@@ -0,0 +1,268 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/CoderCookE/goaround/internal/headers"
+)
+
+// Route sends the requests it matches to its handler. The path is matched
+// by prefix, on segment boundaries unless the prefix ends with a slash, or
+// by a regex. Methods, headers and query parameters must all match, an
+// empty header or query value only requires it to be present.
+type Route struct {
+	// Host is an exact or wildcard host, any host when empty
+	Host       string
+	PathPrefix string
+	PathRegex  *regexp.Regexp
+	Methods    []string
+	Headers    map[string]string
+	Query      map[string]string
+	// StripPrefix removes PathPrefix before the request is proxied,
+	// ReplacePrefix swaps it for another
+	StripPrefix   bool
+	ReplacePrefix string
+	// RequestHeaders are applied once the pool picks a backend,
+	// ResponseHeaders before the response headers are sent
+	RequestHeaders  *headers.Rules
+	ResponseHeaders *headers.Rules
+	// Rules redirect or rewrite requests before they are proxied
+	Rules   []Rule
+	Handler http.Handler
+}
+
+// Route adds a route. When several match the one matching the longest part
+// of the path wins, then one with a host, then the first added.
+func (r *Router) Route(route Route) error {
+	prepared, err := prepare(route)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.routes = append(r.routes, prepared)
+
+	return nil
+}
+
+// SetRoutes replaces every route at once, the current routes are kept when
+// any of the new ones is invalid.
+func (r *Router) SetRoutes(routes []Route) error {
+	prepared := make([]*Route, 0, len(routes))
+	for i, route := range routes {
+		p, err := prepare(route)
+		if err != nil {
+			return fmt.Errorf("routes[%d]: %s", i, err.Error())
+		}
+		prepared = append(prepared, p)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.routes = prepared
+
+	return nil
+}
+
+// prepare checks a route and returns it in the form requests are matched
+// against.
+func prepare(route Route) (*Route, error) {
+	if route.Host != "" {
+		pattern, err := Pattern(route.Host)
+		if err != nil {
+			return nil, err
+		}
+		route.Host = pattern
+	}
+
+	if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+		return nil, fmt.Errorf("invalid path prefix %q, must start with /", route.PathPrefix)
+	}
+
+	if route.PathPrefix != "" && route.PathRegex != nil {
+		return nil, errors.New("path prefix and regex can't be used together")
+	}
+
+	if (route.StripPrefix || route.ReplacePrefix != "") && route.PathPrefix == "" {
+		return nil, errors.New("strip and replace prefix require a path prefix")
+	}
+
+	if route.StripPrefix && route.ReplacePrefix != "" {
+		return nil, errors.New("strip and replace prefix can't be used together")
+	}
+
+	for i, method := range route.Methods {
+		route.Methods[i] = strings.ToUpper(method)
+	}
+
+	rules := make([]Rule, len(route.Rules))
+	for i, rule := range route.Rules {
+		if err := rule.check(); err != nil {
+			return nil, fmt.Errorf("rules[%d]: %s", i, err.Error())
+		}
+
+		if rule.Rewrite != "" && (route.StripPrefix || route.ReplacePrefix != "") {
+			return nil, fmt.Errorf("rules[%d]: rewrites can't be used with strip or replace prefix", i)
+		}
+
+		if rule.Host != "" {
+			pattern, err := Pattern(rule.Host)
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d]: %s", i, err.Error())
+			}
+			rule.Host = pattern
+		}
+
+		rules[i] = rule
+	}
+	route.Rules = rules
+
+	return &route, nil
+}
+
+// route returns the best route for a request, nil when none matches.
+func (r *Router) route(req *http.Request) *Route {
+	r.RLock()
+	defer r.RUnlock()
+
+	var best *Route
+	bestLength := -1
+
+	host := normalize(req.Host)
+	for _, route := range r.routes {
+		length, ok := route.match(req, host)
+		if !ok {
+			continue
+		}
+
+		if length > bestLength || (length == bestLength && route.Host != "" && best.Host == "") {
+			best, bestLength = route, length
+		}
+	}
+
+	return best
+}
+
+// match reports whether the route matches and how much of the path it
+// matched.
+func (route *Route) match(req *http.Request, host string) (int, bool) {
+	if route.Host != "" && !hostMatches(route.Host, host) {
+		return 0, false
+	}
+
+	if len(route.Methods) > 0 && !contains(route.Methods, req.Method) {
+		return 0, false
+	}
+
+	for name, value := range route.Headers {
+		values, ok := req.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "" && !contains(values, value)) {
+			return 0, false
+		}
+	}
+
+	if len(route.Query) > 0 {
+		query := req.URL.Query()
+		for name, value := range route.Query {
+			values, ok := query[name]
+			if !ok || (value != "" && !contains(values, value)) {
+				return 0, false
+			}
+		}
+	}
+
+	path := req.URL.Path
+	switch {
+	case route.PathPrefix != "":
+		if !hasPathPrefix(path, route.PathPrefix) {
+			return 0, false
+		}
+		return len(route.PathPrefix), true
+	case route.PathRegex != nil:
+		loc := route.PathRegex.FindStringIndex(path)
+		if loc == nil {
+			return 0, false
+		}
+		return loc[1] - loc[0], true
+	default:
+		return 0, true
+	}
+}
+
+// serve redirects or rewrites the request by the route's rules, then
+// proxies a copy with its prefix stripped or replaced and its header rules
+// attached.
+func (route *Route) serve(w http.ResponseWriter, req *http.Request) {
+	if route.RequestHeaders != nil || route.ResponseHeaders != nil {
+		x := headers.NewExchange(req, route.RequestHeaders, route.ResponseHeaders)
+		req = req.WithContext(headers.NewContext(req.Context(), x))
+		w = &headerWriter{ResponseWriter: w, exchange: x}
+	}
+
+	if len(route.Rules) > 0 {
+		var done bool
+		if req, done = route.applyRules(w, req); done {
+			return
+		}
+	}
+
+	if !route.StripPrefix && route.ReplacePrefix == "" {
+		route.Handler.ServeHTTP(w, req)
+		return
+	}
+
+	rewritten := req.Clone(req.Context())
+	rewritten.URL.Path = route.rewrite(req.URL.Path)
+	if req.URL.RawPath != "" {
+		rewritten.URL.RawPath = route.rewrite(req.URL.RawPath)
+	}
+
+	route.Handler.ServeHTTP(w, rewritten)
+}
+
+func (route *Route) rewrite(path string) string {
+	rest := strings.TrimPrefix(path, strings.TrimSuffix(route.PathPrefix, "/"))
+	if route.ReplacePrefix != "" {
+		rest = strings.TrimSuffix(route.ReplacePrefix, "/") + rest
+	}
+
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+
+	return rest
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return strings.HasSuffix(prefix, "/") || len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+func hostMatches(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+
+	return pattern == host
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,122 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/CoderCookE/goaround/internal/forwarded"
+)
+
+// Rule redirects or rewrites the requests of a route. Scheme and Host must
+// match when set, and Path is matched against the request path. Redirect
+// and Rewrite may use the path's capture groups as $1 or ${name}, and
+// {scheme}, {host}, {path} and {query}. The query is kept unless a redirect
+// sets its own.
+type Rule struct {
+	Scheme string
+	Host   string
+	Path   *regexp.Regexp
+	// Redirect is the location sent back with Status, 302 when zero
+	Redirect string
+	Status   int
+	// Rewrite is the path the request is proxied with
+	Rewrite string
+}
+
+func (rule *Rule) check() error {
+	if (rule.Redirect == "") == (rule.Rewrite == "") {
+		return errors.New("must either redirect or rewrite")
+	}
+
+	if rule.Rewrite != "" && !strings.HasPrefix(rule.Rewrite, "/") {
+		return fmt.Errorf("invalid rewrite %q, must start with /", rule.Rewrite)
+	}
+
+	switch rule.Status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid status %d, must be 301, 302, 307 or 308", rule.Status)
+	}
+
+	if rule.Status != 0 && rule.Rewrite != "" {
+		return errors.New("status only applies to redirects")
+	}
+
+	return nil
+}
+
+// applyRules applies the route's rules in order, a rewritten path is
+// matched by the rules after it. The first redirect that matches is sent,
+// done is then true.
+func (route *Route) applyRules(w http.ResponseWriter, req *http.Request) (rewritten *http.Request, done bool) {
+	scheme := strings.ToLower(req.Header.Get(forwarded.Proto))
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+	}
+	host := normalize(req.Host)
+	path := req.URL.Path
+
+	for _, rule := range route.Rules {
+		if rule.Scheme != "" && !strings.EqualFold(rule.Scheme, scheme) {
+			continue
+		}
+
+		if rule.Host != "" && !hostMatches(rule.Host, host) {
+			continue
+		}
+
+		var match []int
+		if rule.Path != nil {
+			if match = rule.Path.FindStringSubmatchIndex(path); match == nil {
+				continue
+			}
+		}
+
+		expand := func(template string) string {
+			if rule.Path != nil {
+				template = string(rule.Path.ExpandString(nil, template, path, match))
+			}
+
+			return strings.NewReplacer(
+				"{scheme}", scheme,
+				"{host}", req.Host,
+				"{path}", path,
+				"{query}", req.URL.RawQuery,
+			).Replace(template)
+		}
+
+		if rule.Rewrite != "" {
+			path = expand(rule.Rewrite)
+			continue
+		}
+
+		location := expand(rule.Redirect)
+		if !strings.Contains(location, "?") && req.URL.RawQuery != "" {
+			location += "?" + req.URL.RawQuery
+		}
+
+		status := rule.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+
+		http.Redirect(w, req, location, status)
+		return req, true
+	}
+
+	if path == req.URL.Path {
+		return req, false
+	}
+
+	rewritten = req.Clone(req.Context())
+	rewritten.URL.Path = path
+	rewritten.URL.RawPath = ""
+
+	return rewritten, false
+}
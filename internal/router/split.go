@@ -0,0 +1,135 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/CoderCookE/goaround/internal/control"
+	"github.com/CoderCookE/goaround/internal/stats"
+)
+
+// Targets of a split, used as the target label of its metrics.
+const (
+	TargetStable = "stable"
+	TargetCanary = "canary"
+)
+
+// Split sends a percentage of requests to the canary and the rest to
+// stable. A request whose header or cookie is true, 1 or canary always goes
+// to the canary, false, 0 or stable always to stable.
+type Split struct {
+	Name string
+	// StablePool and CanaryPool name the pools behind the handlers, the
+	// default pool is empty
+	StablePool string
+	CanaryPool string
+	Stable     http.Handler
+	Canary     http.Handler
+	Header     string
+	Cookie     string
+	percent    uint64
+}
+
+// Percent of requests sent to the canary.
+func (s *Split) Percent() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.percent))
+}
+
+func (s *Split) SetPercent(percent float64) error {
+	if math.IsNaN(percent) || percent < 0 || percent > 100 {
+		return fmt.Errorf("invalid percent %v, must be between 0 and 100", percent)
+	}
+
+	atomic.StoreUint64(&s.percent, math.Float64bits(percent))
+	return nil
+}
+
+func (s *Split) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	target, handler := TargetStable, s.Stable
+	if s.canary(req) {
+		target, handler = TargetCanary, s.Canary
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	handler.ServeHTTP(recorder, req)
+
+	stats.SplitRequestCounter.WithLabelValues(s.Name, target, strconv.Itoa(recorder.status)).Add(1)
+	if recorder.status >= http.StatusInternalServerError {
+		stats.SplitErrorCounter.WithLabelValues(s.Name, target).Add(1)
+	}
+}
+
+func (s *Split) canary(req *http.Request) bool {
+	if s.Header != "" {
+		if canary, ok := forced(req.Header.Get(s.Header)); ok {
+			return canary
+		}
+	}
+
+	if s.Cookie != "" {
+		if cookie, err := req.Cookie(s.Cookie); err == nil {
+			if canary, ok := forced(cookie.Value); ok {
+				return canary
+			}
+		}
+	}
+
+	percent := s.Percent()
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// forced reports whether a header or cookie value picks the canary, ok is
+// false for values that pick nothing.
+func forced(value string) (canary bool, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", TargetCanary:
+		return true, true
+	case "0", "false", TargetStable:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func (s *Split) status() control.SplitStatus {
+	return control.SplitStatus{
+		Split:   s.Name,
+		Stable:  s.StablePool,
+		Canary:  s.CanaryPool,
+		Percent: s.Percent(),
+		Header:  s.Header,
+		Cookie:  s.Cookie,
+	}
+}
+
+// Splits are the named splits of the routes, their percentages are changed
+// through the control socket.
+type Splits map[string]*Split
+
+func (s Splits) SetSplit(name string, percent float64) error {
+	split, ok := s[name]
+	if !ok {
+		return fmt.Errorf("unknown split %q", name)
+	}
+
+	return split.SetPercent(percent)
+}
+
+func (s Splits) Splits() []control.SplitStatus {
+	list := make([]control.SplitStatus, 0, len(s))
+	for _, split := range s {
+		list = append(list, split.status())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Split < list[j].Split
+	})
+
+	return list
+}
@@ -0,0 +1,121 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const Version = 1
+
+// Precedence picks what wins at startup when both flags and a state file
+// list backends.
+const (
+	// PreferState restores the saved backend set in place of the flags'
+	PreferState = "state"
+	// PreferFlags keeps the flags' backends and only restores the weights,
+	// drain and maintenance of those that were saved
+	PreferFlags = "flags"
+)
+
+// State is the runtime backend set of the pool, saved after every change so
+// it survives restarts.
+type State struct {
+	Version  int       `json:"version"`
+	Saved    time.Time `json:"saved"`
+	Backends []Backend `json:"backends"`
+}
+
+type Backend struct {
+	URL         string `json:"url"`
+	Weight      int    `json:"weight"`
+	Draining    bool   `json:"draining,omitempty"`
+	Maintenance bool   `json:"maintenance,omitempty"`
+}
+
+// Load reads a state file, a missing file is no state.
+func Load(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	if s.Version != Version {
+		return nil, fmt.Errorf("%s: unsupported version %d, expected %d", path, s.Version, Version)
+	}
+
+	return s, nil
+}
+
+// Save writes the state to a temporary file renamed over path, so a crash
+// never leaves a partial file behind.
+func Save(path string, s *State) error {
+	s.Version = Version
+	s.Saved = time.Now().UTC()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restore returns the backends to start with and the saved backends among
+// them, whose weights, drain and maintenance are applied.
+func (s *State) Restore(flags []string, precedence string) ([]string, []Backend) {
+	if precedence == PreferState {
+		backends := make([]string, len(s.Backends))
+		for i, b := range s.Backends {
+			backends[i] = b.URL
+		}
+
+		return backends, s.Backends
+	}
+
+	saved := make(map[string]Backend)
+	for _, b := range s.Backends {
+		saved[b.URL] = b
+	}
+
+	var restored []Backend
+	for _, url := range flags {
+		if b, ok := saved[url]; ok {
+			restored = append(restored, b)
+		}
+	}
+
+	return flags, restored
+}
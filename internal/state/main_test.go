@@ -0,0 +1,70 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/CoderCookE/goaround/internal/assert"
+)
+
+func TestLoad(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+
+	t.Run("is empty without a file", func(t *testing.T) {
+		s, err := Load(path)
+		assertion.Equal(err, nil)
+		assertion.True(s == nil)
+	})
+
+	t.Run("reads what was saved", func(t *testing.T) {
+		err := Save(path, &State{Backends: []Backend{{URL: "http://localhost:9000", Weight: 2, Draining: true}}})
+		assertion.Equal(err, nil)
+
+		s, err := Load(path)
+		assertion.Equal(err, nil)
+		assertion.Equal(s.Version, Version)
+		assertion.Equal(s.Backends[0], Backend{URL: "http://localhost:9000", Weight: 2, Draining: true})
+
+		files, _ := ioutil.ReadDir(dir)
+		assertion.Equal(len(files), 1)
+	})
+
+	t.Run("rejects other versions", func(t *testing.T) {
+		assertion.Equal(ioutil.WriteFile(path, []byte(`{"version": 2}`), 0600), nil)
+
+		_, err := Load(path)
+		assertion.StringContains(err.Error(), "unsupported version 2, expected 1")
+	})
+}
+
+func TestRestore(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	s := &State{Backends: []Backend{
+		{URL: "http://localhost:9000", Weight: 3},
+		{URL: "http://localhost:9001", Weight: 1, Maintenance: true},
+	}}
+	flags := []string{"http://localhost:9001", "http://localhost:9002"}
+
+	t.Run("prefers the saved backends", func(t *testing.T) {
+		backends, restored := s.Restore(flags, PreferState)
+		assertion.Equal(strings.Join(backends, ","), "http://localhost:9000,http://localhost:9001")
+		assertion.Equal(len(restored), 2)
+	})
+
+	t.Run("prefers the flags' backends", func(t *testing.T) {
+		backends, restored := s.Restore(flags, PreferFlags)
+		assertion.Equal(strings.Join(backends, ","), "http://localhost:9001,http://localhost:9002")
+		assertion.Equal(len(restored), 1)
+		assertion.True(restored[0].Maintenance)
+	})
+}
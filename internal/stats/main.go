@@ -37,6 +37,22 @@ var (
 		[]string{"path", "cache"},
 	)
 
+	CacheUsageGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cache_usage",
+			Help: "cache memory usage in bytes and entry count",
+		},
+		[]string{"pool", "usage"},
+	)
+
+	CacheEvictionCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_evictions",
+			Help: "entries evicted from or rejected by the memory cache",
+		},
+		[]string{"pool", "reason"},
+	)
+
 	RequestCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "request",
@@ -60,15 +76,54 @@ var (
 		},
 		[]string{"connections"},
 	)
+
+	SplitRequestCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "split_requests",
+			Help: "requests of a canary split by target and status",
+		},
+		[]string{"split", "target", "status"},
+	)
+
+	SplitErrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "split_errors",
+			Help: "5xx responses of a canary split by target",
+		},
+		[]string{"split", "target"},
+	)
+
+	MirrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mirror_requests",
+			Help: "requests copied to a shadow pool by status, or dropped, too_large and error",
+		},
+		[]string{"pool", "outcome"},
+	)
+
+	MirrorDurations = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "mirror_durations_seconds",
+			Help:       "latency distributions of requests copied to a shadow pool.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001, 1.0: 0.0},
+		},
+		[]string{"pool"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(Attempts)
 	prometheus.MustRegister(Durations)
 	prometheus.MustRegister(CacheCounter)
+	prometheus.MustRegister(CacheUsageGauge)
+	prometheus.MustRegister(CacheEvictionCounter)
 	prometheus.MustRegister(HealthGauge)
 	prometheus.MustRegister(AvailableConnectionsGauge)
 	prometheus.MustRegister(RequestCounter)
+	prometheus.MustRegister(SplitRequestCounter)
+	prometheus.MustRegister(SplitErrorCounter)
+	prometheus.MustRegister(MirrorCounter)
+	prometheus.MustRegister(MirrorDurations)
 }
 
 func StartUp(addr string) {
@@ -1,47 +1,112 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/CoderCookE/goaround/internal/config"
+	"github.com/CoderCookE/goaround/internal/control"
 	"github.com/CoderCookE/goaround/internal/customflags"
+	"github.com/CoderCookE/goaround/internal/discovery"
+	"github.com/CoderCookE/goaround/internal/forwarded"
 	"github.com/CoderCookE/goaround/internal/gracefulserver"
+	"github.com/CoderCookE/goaround/internal/healthcheck"
 	"github.com/CoderCookE/goaround/internal/pool"
+	"github.com/CoderCookE/goaround/internal/router"
+	"github.com/CoderCookE/goaround/internal/state"
 	"github.com/CoderCookE/goaround/internal/stats"
 )
 
 func main() {
-	portString, metricPortString, backends, numConns, cacert, privkey, enableCache := parseFlags()
+	base, configPath := parseFlags()
 
-	config := &pool.Config{
-		Backends:    backends,
-		NumConns:    *numConns,
-		EnableCache: *enableCache,
+	if flag.Arg(0) == "validate" {
+		os.Exit(validate(base, configPath, flag.Args()[1:], os.Stdout, os.Stderr))
 	}
 
-	log.Printf("Starting with conf, %s %s %d", portString, backends, *numConns)
+	file := base
+	if configPath != "" {
+		var err error
+		file, err = config.Load(configPath, base)
+		if err != nil {
+			log.Fatalf("Error loading config %s: %s", configPath, err.Error())
+		}
+	}
+
+	configured := file
+	file, restored := restoreState(file)
 
-	connectionPool := pool.New(config)
+	log.Printf("Starting with conf, %s %v %d", file.Listen, file.Backends, file.NumConns)
+
+	connectionPool := pool.New(file.Pool())
 	defer connectionPool.Shutdown()
+	applyState(connectionPool, restored)
 
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		defer r.Body.Close()
+	var discoverer *discovery.Discoverer
+	if providers := file.Providers(); len(providers) > 0 {
+		discoverer = discovery.New(connectionPool, file.Backends)
+		for _, provider := range providers {
+			log.Printf("Discovering backends with %s", provider)
+			discoverer.Start(provider, nil)
+		}
+	}
 
-		connectionPool.Fetch(w, r)
+	handler := router.New(serve(connectionPool))
+	handlers := map[string]http.Handler{"": serve(connectionPool)}
+	shadows := map[string]http.Handler{"": http.HandlerFunc(connectionPool.Fetch)}
+	virtual := make(map[string]reloadable)
+	for _, name := range file.PoolNames() {
+		log.Printf("Starting pool %s for %v with %v", name, file.Pools[name].Hosts, file.Pools[name].Backends)
 
-		duration := time.Since(start).Seconds()
-		stats.Durations.WithLabelValues("handle").Observe(duration)
-	})
+		virtualPool := pool.New(file.VirtualPool(name))
+		defer virtualPool.Shutdown()
+		virtual[name] = virtualPool
+		handlers[name] = serve(virtualPool)
+		shadows[name] = http.HandlerFunc(virtualPool.Fetch)
+
+		for _, host := range file.Pools[name].Hosts {
+			if err := handler.Handle(host, handlers[name]); err != nil {
+				log.Fatalf("Error routing pool %s: %s", name, err.Error())
+			}
+		}
+	}
+
+	splits := make(router.Splits)
+	for _, name := range file.SplitNames() {
+		split := file.Splits[name]
+		log.Printf("Splitting %s, %v%% to pool %s", name, split.Percent, split.Canary)
+		splits[name] = split.Router(name, handlers[split.Stable], handlers[split.Canary])
+	}
+	connectionPool.HandleSplits(splits)
+
+	routes := &routing{router: handler, handlers: handlers, shadows: shadows, splits: splits}
+	if err := routes.Apply(file); err != nil {
+		log.Fatalf("Error adding routes: %s", err.Error())
+	}
+
+	trusted, err := forwarded.Parse(file.Forwarded.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Error parsing trusted proxies: %s", err.Error())
+	}
+
+	live, err := newReloader(configPath, base, configured, connectionPool, discoverer, virtual, splits, routes)
+	if err != nil {
+		log.Fatalf("Error loading certificate: %s", err.Error())
+	}
+	go live.watch()
 
-	go stats.StartUp(metricPortString)
+	go stats.StartUp(file.Metrics)
+
+	go control.StartAdmin(file.AdminConfig(), connectionPool, live)
 
 	server := &http.Server{
-		Addr:         portString,
-		Handler:      handler,
+		Addr:         file.Listen,
+		Handler:      forwarded.New(trusted, handler),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
@@ -49,9 +114,9 @@ func main() {
 	defer server.Close()
 
 	graceful := gracefulserver.New(server)
-	var err error
-	if *cacert != "" && *privkey != "" {
-		err = graceful.ListenAndServeTLS(*cacert, *privkey)
+	if file.TLS.Enabled() {
+		server.TLSConfig = &tls.Config{GetCertificate: live.certificate}
+		err = graceful.ListenAndServeTLS("", "")
 	} else {
 		err = graceful.ListenAndServe()
 	}
@@ -61,21 +126,204 @@ func main() {
 	}
 }
 
-func parseFlags() (portString, metricPortString string, backends customflags.Backend, numConns *int, cacert *string, privkey *string, enableCache *bool) {
+type fetcher interface {
+	Fetch(w http.ResponseWriter, r *http.Request)
+}
+
+func serve(p fetcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer r.Body.Close()
+
+		p.Fetch(w, r)
+
+		duration := time.Since(start).Seconds()
+		stats.Durations.WithLabelValues("handle").Observe(duration)
+	})
+}
+
+// routing sends the file's routes to the running pools and splits.
+type routing struct {
+	router   *router.Router
+	handlers map[string]http.Handler
+	shadows  map[string]http.Handler
+	splits   router.Splits
+}
+
+// Apply replaces the router's routes with the file's.
+func (rt *routing) Apply(file *config.File) error {
+	routes := make([]router.Route, 0, len(file.Routes))
+	for _, route := range file.Routes {
+		target := rt.handlers[route.Pool]
+		if route.Split != "" {
+			target = rt.splits[route.Split]
+		}
+
+		if route.Mirror != nil {
+			target = route.Mirror.Router(target, rt.shadows[route.Mirror.Pool])
+		}
+
+		routes = append(routes, route.Router(target))
+	}
+
+	return rt.router.SetRoutes(routes)
+}
+
+// parseFlags returns the settings passed as flags and the path of the config
+// file, settings in the file take precedence over flags.
+func parseFlags() (*config.File, string) {
+	configPath := flag.String("config", "", "Path of a JSON, YAML or TOML config file, reloaded on SIGHUP or when it changes")
 	port := flag.Int("p", 3000, "Load Balancer Listen Port (default: 3000)")
-	numConns = flag.Int("n", 3, "Max number of connections per backend")
+	numConns := flag.Int("n", 3, "Max number of connections per backend")
 
-	backends = make(customflags.Backend, 0)
+	backends := make(customflags.Backend, 0)
 	flag.Var(&backends, "b", "Backend location ex: http://localhost:9000")
 
-	cacert = flag.String("cacert", "", "cacert location")
-	privkey = flag.String("privkey", "", "privkey location")
+	cacert := flag.String("cacert", "", "cacert location")
+	privkey := flag.String("privkey", "", "privkey location")
 
 	metricPort := flag.Int("prometheus-port", 8080, "The address to listen on for HTTP requests.")
-	enableCache = flag.Bool("cache", false, "Enable request cache")
+	maxRetries := flag.Int("max-retries", 0, "Number of times a failed request is retried on another backend")
+	healthPath := flag.String("health-path", healthcheck.DefaultPath, "Path requested on backends to check their health")
+	healthInterval := flag.Duration("health-interval", healthcheck.DefaultInterval, "Time between health checks")
+	healthTimeout := flag.Duration("health-timeout", healthcheck.DefaultTimeout, "Timeout of a health check")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "How long removed backends may finish requests in flight before they are shut down")
+	enableCache := flag.Bool("cache", false, "Enable request cache")
+	cacheMaxBytes := flag.Int64("cache-max-bytes", 1<<30, "Maximum size of the request cache in bytes")
+	cacheMaxObjectSize := flag.Int64("cache-max-object-size", 0, "Maximum size in bytes of a single cached response, 0 for the size of the cache or of its disk tier when larger")
+	cacheCounters := flag.Int64("cache-counters", 1e7, "Number of keys to track access frequency of for cache admission")
+	cacheTTL := flag.Duration("cache-ttl", 5*time.Minute, "How long responses without Cache-Control or Expires headers stay fresh")
+	cacheDir := flag.String("cache-dir", "", "Directory for the on-disk cache tier, disabled when empty")
+	cacheDiskMaxBytes := flag.Int64("cache-disk-max-bytes", 10<<30, "Maximum size of the on-disk cache tier in bytes")
+	cacheRemote := flag.String("cache-memcached", "", "Address of a memcached compatible server shared as a cache tier, ex: localhost:11211")
+	cacheRemoteTimeout := flag.Duration("cache-memcached-timeout", 250*time.Millisecond, "Timeout of a request to the memcached server")
+	controlSocket := flag.String("control-socket", control.DefaultSocketPath, "Path of the unix socket used to change backends")
+	controlSocketMode := customflags.FileMode(0600)
+	flag.Var(&controlSocketMode, "control-socket-mode", "File mode of the control socket")
+	controlSocketUID := flag.Int("control-socket-uid", -1, "Owner uid of the control socket, -1 to keep the current user")
+	controlSocketGID := flag.Int("control-socket-gid", -1, "Owner gid of the control socket, -1 to keep the current group")
+	controlAllowUIDs := make(customflags.IDs, 0)
+	flag.Var(&controlAllowUIDs, "control-allow-uid", "Only accept control commands from these peer uids, may be passed multiple times")
+	controlAllowGIDs := make(customflags.IDs, 0)
+	flag.Var(&controlAllowGIDs, "control-allow-gid", "Only accept control commands from these peer gids, may be passed multiple times")
+	dnsName := flag.String("discovery-dns", "", "Hostname, or SRV name with -discovery-dns-srv, whose records are added as backends")
+	dnsSRV := flag.Bool("discovery-dns-srv", false, "Look up SRV records for -discovery-dns")
+	dnsScheme := flag.String("discovery-dns-scheme", "http", "Scheme of backends found by DNS")
+	dnsPort := flag.Int("discovery-dns-port", 0, "Port of backends found by A and AAAA records")
+	dnsServer := flag.String("discovery-dns-server", "", "DNS server to query, ex: 127.0.0.1:8600, defaults to the first nameserver in /etc/resolv.conf")
+	dnsInterval := flag.Duration("discovery-dns-interval", 0, "Time between DNS lookups, 0 to follow the records' TTL")
+	discoveryFile := flag.String("discovery-file", "", "JSON or YAML file, or directory of files, listing backends to watch")
+	discoveryDebounce := flag.Duration("discovery-file-debounce", time.Second, "How long discovery files must stay unchanged before they are read")
+	consulService := flag.String("discovery-consul", "", "Consul service whose passing instances are added as backends")
+	consulAddr := flag.String("discovery-consul-addr", "http://127.0.0.1:8500", "Address of the Consul HTTP API")
+	consulTags := make(customflags.Backend, 0)
+	flag.Var(&consulTags, "discovery-consul-tag", "Only add instances with this tag, may be passed multiple times")
+	consulDatacenter := flag.String("discovery-consul-dc", "", "Consul datacenter to query, defaults to the agent's")
+	consulScheme := flag.String("discovery-consul-scheme", "http", "Scheme of backends found in Consul")
+	k8sService := flag.String("discovery-k8s-service", "", "Kubernetes service whose EndpointSlices are watched for backends")
+	k8sNamespace := flag.String("discovery-k8s-namespace", "", "Namespace of the Kubernetes service, defaults to the namespace of the credentials")
+	k8sPort := flag.String("discovery-k8s-port", "", "Name or number of the EndpointSlice port, defaults to the first")
+	k8sScheme := flag.String("discovery-k8s-scheme", "http", "Scheme of backends found in Kubernetes")
+	k8sKubeconfig := flag.String("discovery-k8s-kubeconfig", "", "Kubeconfig to read credentials from, in-cluster credentials are used when empty")
+	stateFile := flag.String("state-file", "", "File the runtime backends, weights, drain and maintenance are saved to and restored from")
+	statePrecedence := flag.String("state-precedence", state.PreferState, "Which backends win at startup, state or flags")
+	adminAddr := flag.String("admin-addr", control.DefaultAdminAddr, "Address of the admin API")
+	trustedProxies := make(customflags.Backend, 0)
+	flag.Var(&trustedProxies, "trusted-proxy", "CIDR or address of a proxy whose X-Forwarded-* and Forwarded headers are kept, may be passed multiple times")
+	adminToken := flag.String("admin-token", "", "Bearer token required by the admin API, read from GOAROUND_ADMIN_TOKEN when empty. The admin API is disabled without a token")
 	flag.Parse()
-	portString = fmt.Sprintf(":%d", *port)
-	metricPortString = fmt.Sprintf(":%d", *metricPort)
 
-	return
+	file := &config.File{
+		Listen:       fmt.Sprintf(":%d", *port),
+		Metrics:      fmt.Sprintf(":%d", *metricPort),
+		TLS:          config.TLS{Cert: *cacert, Key: *privkey},
+		Backends:     []config.Backend{},
+		NumConns:     *numConns,
+		MaxRetries:   *maxRetries,
+		DrainTimeout: config.Duration(*drainTimeout),
+		HealthCheck: config.HealthCheck{
+			Path:     *healthPath,
+			Interval: config.Duration(*healthInterval),
+			Timeout:  config.Duration(*healthTimeout),
+		},
+		Cache: config.Cache{
+			Enabled:          *enableCache,
+			MaxBytes:         *cacheMaxBytes,
+			MaxObjectSize:    *cacheMaxObjectSize,
+			Counters:         *cacheCounters,
+			TTL:              config.Duration(*cacheTTL),
+			Dir:              *cacheDir,
+			DiskMaxBytes:     *cacheDiskMaxBytes,
+			Memcached:        *cacheRemote,
+			MemcachedTimeout: config.Duration(*cacheRemoteTimeout),
+		},
+		Control: config.Control{
+			Path:      *controlSocket,
+			Mode:      config.FileMode(controlSocketMode),
+			UID:       *controlSocketUID,
+			GID:       *controlSocketGID,
+			AllowUIDs: controlAllowUIDs,
+			AllowGIDs: controlAllowGIDs,
+		},
+		Admin: config.Admin{
+			Addr:  *adminAddr,
+			Token: *adminToken,
+		},
+		Forwarded: config.Forwarded{
+			TrustedProxies: trustedProxies,
+		},
+		State: config.State{
+			Path:       *stateFile,
+			Precedence: *statePrecedence,
+		},
+	}
+
+	for _, b := range backends {
+		file.Backends = append(file.Backends, config.Backend{URL: b})
+	}
+
+	if *dnsName != "" {
+		file.Discovery.DNS = &config.DNS{
+			Name:     *dnsName,
+			SRV:      *dnsSRV,
+			Scheme:   *dnsScheme,
+			Port:     *dnsPort,
+			Server:   *dnsServer,
+			Interval: config.Duration(*dnsInterval),
+		}
+	}
+
+	if *discoveryFile != "" {
+		file.Discovery.File = &config.DiscoveryFile{
+			Path:     *discoveryFile,
+			Debounce: config.Duration(*discoveryDebounce),
+		}
+	}
+
+	if *consulService != "" {
+		file.Discovery.Consul = &config.Consul{
+			Addr:       *consulAddr,
+			Service:    *consulService,
+			Tags:       consulTags,
+			Datacenter: *consulDatacenter,
+			Token:      os.Getenv("CONSUL_HTTP_TOKEN"),
+			Scheme:     *consulScheme,
+		}
+	}
+
+	if *k8sService != "" {
+		file.Discovery.Kubernetes = &config.Kubernetes{
+			Namespace:  *k8sNamespace,
+			Service:    *k8sService,
+			Port:       *k8sPort,
+			Scheme:     *k8sScheme,
+			Kubeconfig: *k8sKubeconfig,
+		}
+	}
+
+	if file.Admin.Token == "" {
+		file.Admin.Token = os.Getenv("GOAROUND_ADMIN_TOKEN")
+	}
+
+	return file, *configPath
 }
@@ -1,21 +1,441 @@
 package main
 
 import (
-	"github.com/CoderCookE/goaround/internal/assert"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/CoderCookE/goaround/internal/assert"
+	"github.com/CoderCookE/goaround/internal/config"
+	"github.com/CoderCookE/goaround/internal/pool"
+	"github.com/CoderCookE/goaround/internal/router"
+	"github.com/CoderCookE/goaround/internal/state"
 )
 
+type fakePool struct {
+	applied     []*pool.Config
+	drained     []string
+	maintenance []string
+	switched    []string
+	err         error
+}
+
+func (f *fakePool) Switch(set string) error {
+	f.switched = append(f.switched, set)
+	return nil
+}
+
+func (f *fakePool) Drain(backends []string) error {
+	f.drained = backends
+	return nil
+}
+
+func (f *fakePool) Maintenance(backends []string, enabled bool) error {
+	f.maintenance = backends
+	return nil
+}
+
+func (f *fakePool) Check(c *pool.Config) error {
+	return f.err
+}
+
+func (f *fakePool) Reload(c *pool.Config) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	f.applied = append(f.applied, c)
+	return nil
+}
+
 func TestParseFlags(t *testing.T) {
 	assertion := &assert.Asserter{T: t}
 
 	t.Run("Returns defaults", func(t *testing.T) {
-		portString, metricPortString, backends, numConns, cacert, privkey, cache := parseFlags()
-		assertion.Equal(":3000", portString)
-		assertion.Equal(":8080", metricPortString)
-		assertion.Equal(backends.String(), "[]")
-		assertion.Equal(*numConns, 3)
-		assertion.Equal(*cacert, "")
-		assertion.Equal(*privkey, "")
-		assertion.Equal(*cache, false)
+		file, configPath := parseFlags()
+		assertion.Equal(configPath, "")
+		assertion.Equal(":3000", file.Listen)
+		assertion.Equal(":8080", file.Metrics)
+		assertion.Equal(len(file.Backends), 0)
+		assertion.Equal(file.NumConns, 3)
+		assertion.Equal(file.TLS.Cert, "")
+		assertion.Equal(file.TLS.Key, "")
+		assertion.Equal(file.Cache.Enabled, false)
+		assertion.Equal(file.Cache.MaxBytes, int64(1<<30))
+		assertion.Equal(file.Cache.MaxObjectSize, int64(0))
+		assertion.Equal(file.Cache.Counters, int64(1e7))
+		assertion.Equal(file.Cache.TTL, config.Duration(5*time.Minute))
+		assertion.Equal(file.Cache.Dir, "")
+		assertion.Equal(file.Cache.DiskMaxBytes, int64(10<<30))
+		assertion.Equal(file.Cache.Memcached, "")
+		assertion.Equal(file.Cache.MemcachedTimeout, config.Duration(250*time.Millisecond))
+		assertion.Equal(file.Control.Path, "/tmp/goaround.sock")
+		assertion.Equal(file.Control.Mode, config.FileMode(0600))
+		assertion.Equal(file.Control.UID, -1)
+		assertion.Equal(len(file.Control.AllowUIDs), 0)
+		assertion.Equal(file.Admin.Addr, "127.0.0.1:8081")
+		assertion.Equal(file.HealthCheck.Path, "/health")
+		assertion.Equal(file.Validate(), nil)
+	})
+}
+
+func TestReloader(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "goaround.yaml")
+	write := func(data string) {
+		assertion.Equal(ioutil.WriteFile(path, []byte(data), 0600), nil)
+	}
+
+	base := &config.File{
+		Listen:   ":3000",
+		Metrics:  ":8080",
+		NumConns: 3,
+		Control:  config.Control{Path: "/tmp/goaround.sock", Mode: 0600, UID: -1, GID: -1},
+		Admin:    config.Admin{Addr: "127.0.0.1:8081", Token: "secret"},
+		State:    config.State{Precedence: "state"},
+	}
+	write("backends:\n  - http://localhost:9000\n")
+	running, err := config.Load(path, base)
+	assertion.Equal(err, nil)
+
+	fake := &fakePool{}
+	live, err := newReloader(path, base, running, fake, nil, nil, nil, nil)
+	assertion.Equal(err, nil)
+
+	t.Run("applies a changed file", func(t *testing.T) {
+		write("listen: \":4000\"\nmax_retries: 2\nbackends:\n  - http://localhost:9001\n")
+		live.reload()
+
+		assertion.Equal(len(fake.applied), 1)
+		assertion.Equal(fake.applied[0].Backends[0], "http://localhost:9001")
+		assertion.Equal(live.config().MaxRetries, 2)
+		assertion.Equal(live.config().Listen, ":3000")
+	})
+
+	t.Run("keeps the running config when the file is invalid", func(t *testing.T) {
+		write("backends:\n  - localhost:9002\n")
+		live.reload()
+
+		write("max_retries: [")
+		live.reload()
+
+		fake.err = errors.New("pool capacity exceeded")
+		write("backends:\n  - http://localhost:9003\n")
+		live.reload()
+
+		assertion.Equal(len(fake.applied), 1)
+		assertion.Equal(live.config().Backends[0].URL, "http://localhost:9001")
+	})
+
+	t.Run("hides the admin token", func(t *testing.T) {
+		data, err := json.Marshal(live)
+		assertion.Equal(err, nil)
+		assertion.False(strings.Contains(string(data), "secret"))
+		assertion.StringContains(string(data), `"backends":[{"url":"http://localhost:9001"}]`)
+	})
+
+	t.Run("reloads virtual host pools", func(t *testing.T) {
+		write("pools:\n  api:\n    hosts: [api.example.com]\n    backends: [http://localhost:9100]\n")
+		running, err := config.Load(path, base)
+		assertion.Equal(err, nil)
+
+		api := &fakePool{}
+		live, err := newReloader(path, base, running, &fakePool{}, nil, map[string]reloadable{"api": api}, nil, nil)
+		assertion.Equal(err, nil)
+
+		write("pools:\n  api:\n    hosts: [api.example.com]\n    max_retries: 1\n    backends: [http://localhost:9101]\n")
+		live.reload()
+
+		assertion.Equal(len(api.applied), 1)
+		assertion.Equal(api.applied[0].Backends[0], "http://localhost:9101")
+		assertion.Equal(api.applied[0].MaxRetries, 1)
+		assertion.True(api.applied[0].ControlSocket == nil)
+	})
+
+	t.Run("changes no pool when one refuses the file", func(t *testing.T) {
+		write("backends: [http://localhost:9000]\npools:\n  api:\n    hosts: [api.example.com]\n    backends: [http://localhost:9100]\n")
+		running, err := config.Load(path, base)
+		assertion.Equal(err, nil)
+
+		primary := &fakePool{}
+		api := &fakePool{err: errors.New("pool capacity exceeded")}
+		live, err := newReloader(path, base, running, primary, nil, map[string]reloadable{"api": api}, nil, nil)
+		assertion.Equal(err, nil)
+
+		write("max_retries: 2\nbackends: [http://localhost:9001]\npools:\n  api:\n    hosts: [api.example.com]\n    backends: [http://localhost:9101]\n")
+		live.reload()
+
+		assertion.Equal(len(primary.applied), 0)
+		assertion.Equal(len(api.applied), 0)
+		assertion.Equal(live.config().MaxRetries, 0)
+	})
+
+	t.Run("switches the active set the file changes", func(t *testing.T) {
+		sets := "blue_green:\n  sets:\n    blue: [http://localhost:9001]\n    green: [http://localhost:9002]\n"
+		write(sets + "  active: blue\n")
+		running, err := config.Load(path, base)
+		assertion.Equal(err, nil)
+
+		fake := &fakePool{}
+		live, err := newReloader(path, base, running, fake, nil, nil, nil, nil)
+		assertion.Equal(err, nil)
+
+		write(sets + "  active: blue\nmax_retries: 1\n")
+		live.reload()
+		assertion.Equal(len(fake.switched), 0)
+		assertion.Equal(len(fake.applied[0].Backends), 0)
+
+		write(sets + "  active: green\n")
+		live.reload()
+		assertion.Equal(strings.Join(fake.switched, ","), "green")
+		assertion.Equal(live.config().BlueGreen.Active, "green")
+	})
+
+	t.Run("sets split percentages the file changes", func(t *testing.T) {
+		splitFile := func(percent string) string {
+			return "pools:\n  canary:\n    backends: [http://localhost:9100]\n" +
+				"splits:\n  checkout:\n    canary: canary\n    percent: " + percent + "\n" +
+				"routes:\n  - path_prefix: /checkout\n    split: checkout\n"
+		}
+
+		write(splitFile("10"))
+		running, err := config.Load(path, base)
+		assertion.Equal(err, nil)
+
+		split := running.Splits["checkout"].Router("checkout", nil, nil)
+		splits := router.Splits{"checkout": split}
+		live, err := newReloader(path, base, running, &fakePool{}, nil, map[string]reloadable{"canary": &fakePool{}}, splits, nil)
+		assertion.Equal(err, nil)
+
+		assertion.Equal(splits.SetSplit("checkout", 50), nil)
+		write(splitFile("10") + "max_retries: 1\n")
+		live.reload()
+		assertion.Equal(split.Percent(), 50.0)
+
+		write(splitFile("20"))
+		live.reload()
+		assertion.Equal(split.Percent(), 20.0)
+	})
+
+	t.Run("replaces routes the file changes", func(t *testing.T) {
+		routeFile := func(prefix string) string {
+			return "pools:\n  api:\n    backends: [http://localhost:9100]\n" +
+				"routes:\n  - path_prefix: " + prefix + "\n    pool: api\n"
+		}
+
+		write(routeFile("/api"))
+		running, err := config.Load(path, base)
+		assertion.Equal(err, nil)
+
+		named := func(name string) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, name)
+			})
+		}
+		handler := router.New(named("default"))
+		routes := &routing{router: handler, handlers: map[string]http.Handler{"": named("default"), "api": named("api")}}
+		assertion.Equal(routes.Apply(running), nil)
+
+		live, err := newReloader(path, base, running, &fakePool{}, nil, map[string]reloadable{"api": &fakePool{}}, nil, routes)
+		assertion.Equal(err, nil)
+
+		get := func(target string) string {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+			return recorder.Body.String()
+		}
+		assertion.Equal(get("http://shop.example.com/api/orders"), "api")
+
+		write(routeFile("/v2"))
+		live.reload()
+		assertion.Equal(get("http://shop.example.com/api/orders"), "default")
+		assertion.Equal(get("http://shop.example.com/v2/orders"), "api")
+	})
+}
+
+func TestValidate(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	base := &config.File{
+		Listen:   ":3000",
+		Metrics:  ":8080",
+		NumConns: 3,
+		Control:  config.Control{Path: "/tmp/goaround.sock", Mode: 0600, UID: -1, GID: -1},
+		Admin:    config.Admin{Addr: "127.0.0.1:8081"},
+		State:    config.State{Precedence: "state"},
+	}
+
+	run := func(base *config.File, args ...string) (int, string, string) {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := validate(base, "", args, stdout, stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	t.Run("prints the effective config", func(t *testing.T) {
+		path := filepath.Join(dir, "valid.yaml")
+		assertion.Equal(ioutil.WriteFile(path, []byte("backends:\n  - http://localhost:9000\n"), 0600), nil)
+
+		code, stdout, _ := run(base, path)
+		assertion.Equal(code, 0)
+
+		effective := &config.File{}
+		assertion.Equal(json.Unmarshal([]byte(stdout), effective), nil)
+		assertion.Equal(effective.Backends[0].URL, "http://localhost:9000")
+		assertion.Equal(effective.NumConns, 3)
+	})
+
+	t.Run("reports problems with their location", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.yaml")
+		data := "listen: \":8080\"\nbackends:\n  - http://localhost:9000\n  - url: localhost:9001\n"
+		assertion.Equal(ioutil.WriteFile(path, []byte(data), 0600), nil)
+
+		code, _, stderr := run(base, path)
+		assertion.Equal(code, 1)
+		assertion.StringContains(stderr, path+`:4:10: backends[1].url: invalid backend url "localhost:9001"`)
+		assertion.StringContains(stderr, path+": metrics: port 8080 is already used by listen")
+	})
+
+	t.Run("reports syntax errors with their location", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.json")
+		assertion.Equal(ioutil.WriteFile(path, []byte("{\n  \"num_conns\": \"three\"\n}\n"), 0600), nil)
+
+		code, _, stderr := run(base, path)
+		assertion.Equal(code, 1)
+		assertion.StringContains(stderr, path+":2:16: num_conns: cannot use string as int")
+	})
+
+	t.Run("checks flags without a config file", func(t *testing.T) {
+		flags := *base
+		flags.Backends = []config.Backend{{URL: "htp://localhost:9000"}}
+
+		code, _, stderr := run(&flags)
+		assertion.Equal(code, 1)
+		assertion.Equal(stderr, "flags: backends[0].url: invalid backend url \"htp://localhost:9000\"\n")
+
+		code, _, _ = run(base, "one", "two")
+		assertion.Equal(code, 2)
+	})
+
+	t.Run("checks certificates", func(t *testing.T) {
+		flags := *base
+		flags.TLS = config.TLS{Cert: filepath.Join(dir, "missing.pem"), Key: filepath.Join(dir, "missing.key")}
+
+		code, _, stderr := run(&flags)
+		assertion.Equal(code, 1)
+		assertion.StringContains(stderr, "flags: tls.cert: open ")
+	})
+}
+
+func TestRestoreState(t *testing.T) {
+	assertion := &assert.Asserter{T: t}
+
+	dir, err := ioutil.TempDir("", "goaround")
+	assertion.Equal(err, nil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	err = state.Save(path, &state.State{Backends: []state.Backend{
+		{URL: "http://localhost:9000", Weight: 2, Draining: true},
+		{URL: "http://localhost:9001", Weight: 1, Maintenance: true},
+	}})
+	assertion.Equal(err, nil)
+
+	flags := func(precedence string) *config.File {
+		return &config.File{
+			Backends: []config.Backend{{URL: "http://localhost:9000"}, {URL: "http://localhost:9002", Weight: 4}},
+			State:    config.State{Path: path, Precedence: precedence},
+		}
+	}
+
+	t.Run("restores the saved backends", func(t *testing.T) {
+		file, restored := restoreState(flags(state.PreferState))
+		assertion.Equal(len(file.Backends), 2)
+		assertion.Equal(file.Backends[0].URL, "http://localhost:9000")
+		assertion.Equal(file.Backends[0].Weight, 2)
+		assertion.Equal(file.Backends[1].URL, "http://localhost:9001")
+
+		fake := &fakePool{}
+		applyState(fake, restored)
+		assertion.Equal(strings.Join(fake.drained, ","), "http://localhost:9000")
+		assertion.Equal(strings.Join(fake.maintenance, ","), "http://localhost:9001")
+	})
+
+	t.Run("keeps the flags' backends", func(t *testing.T) {
+		original := flags(state.PreferFlags)
+		file, restored := restoreState(original)
+		assertion.Equal(len(file.Backends), 2)
+		assertion.Equal(file.Backends[0].Weight, 2)
+		assertion.Equal(file.Backends[1].URL, "http://localhost:9002")
+		assertion.Equal(file.Backends[1].Weight, 4)
+		assertion.Equal(len(restored), 1)
+		assertion.Equal(original.Backends[0].Weight, 0)
+	})
+
+	t.Run("keeps discovered backends out of the static set", func(t *testing.T) {
+		original := flags(state.PreferState)
+		original.Discovery.DNS = &config.DNS{Name: "backend.test"}
+
+		file, _ := restoreState(original)
+		assertion.Equal(file.Backends[1].URL, "http://localhost:9002")
+	})
+
+	t.Run("keeps backends added at runtime on reload", func(t *testing.T) {
+		configPath := filepath.Join(dir, "goaround.yaml")
+		write := func(data string) {
+			assertion.Equal(ioutil.WriteFile(configPath, []byte(data), 0600), nil)
+		}
+
+		base := &config.File{
+			Listen:   ":3000",
+			Metrics:  ":8080",
+			NumConns: 3,
+			Control:  config.Control{Path: "/tmp/goaround.sock", Mode: 0600, UID: -1, GID: -1},
+			Admin:    config.Admin{Addr: "127.0.0.1:8081"},
+			State:    config.State{Path: path, Precedence: state.PreferState},
+		}
+		write("backends:\n  - http://localhost:9000\n  - http://localhost:9002\n")
+		running, err := config.Load(configPath, base)
+		assertion.Equal(err, nil)
+
+		fake := &fakePool{}
+		live, err := newReloader(configPath, base, running, fake, nil, nil, nil, nil)
+		assertion.Equal(err, nil)
+
+		write("backends:\n  - http://localhost:9002\n  - http://localhost:9003\n")
+		live.reload()
+		assertion.Equal(len(fake.applied), 1)
+		assertion.Equal(strings.Join(fake.applied[0].Backends, ","), "http://localhost:9002,http://localhost:9003,http://localhost:9001")
+		assertion.Equal(fake.applied[0].Weights["http://localhost:9001"], 1)
+
+		base.State.Precedence = state.PreferFlags
+		running, err = config.Load(configPath, base)
+		assertion.Equal(err, nil)
+
+		fake = &fakePool{}
+		live, err = newReloader(configPath, base, running, fake, nil, nil, nil, nil)
+		assertion.Equal(err, nil)
+
+		write("backends:\n  - http://localhost:9003\n")
+		live.reload()
+		assertion.Equal(len(fake.applied), 1)
+		assertion.Equal(strings.Join(fake.applied[0].Backends, ","), "http://localhost:9003")
 	})
 }
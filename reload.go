@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/CoderCookE/goaround/internal/config"
+	"github.com/CoderCookE/goaround/internal/control"
+	"github.com/CoderCookE/goaround/internal/discovery"
+	"github.com/CoderCookE/goaround/internal/pool"
+)
+
+type reloadable interface {
+	Check(c *pool.Config) error
+	Reload(c *pool.Config) error
+}
+
+type switcher interface {
+	Switch(set string) error
+}
+
+type rerouter interface {
+	Apply(file *config.File) error
+}
+
+type discoverer interface {
+	SetStatic(static []discovery.Backend)
+}
+
+// reloader applies the config file again on SIGHUP or when it changes. A
+// file that fails to load, or that any pool refuses, leaves the running
+// config untouched, every pool is checked before any of them changes. With
+// discovery the file's backends are handed to the discoverer, which merges
+// them with the discovered ones, otherwise backends added at runtime are kept
+// when the state file takes precedence. Routes are replaced when they change.
+// The blue/green active set and split percentages are only changed when the
+// file changes them, so changes made through the control socket survive
+// reloads of other settings.
+type reloader struct {
+	sync.Mutex
+	path      string
+	base      *config.File
+	pool      reloadable
+	pools     map[string]reloadable
+	discovery discoverer
+	splits    control.Splitter
+	routes    rerouter
+	current   atomic.Value
+	cert      atomic.Value
+}
+
+func newReloader(path string, base, running *config.File, p reloadable, d *discovery.Discoverer, pools map[string]reloadable, splits control.Splitter, routes rerouter) (*reloader, error) {
+	r := &reloader{path: path, base: base, pool: p, pools: pools, splits: splits, routes: routes}
+	if d != nil {
+		r.discovery = d
+	}
+	r.current.Store(running)
+
+	if running.TLS.Enabled() {
+		cert, err := tls.LoadX509KeyPair(running.TLS.Cert, running.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		r.cert.Store(&cert)
+	}
+
+	return r, nil
+}
+
+func (r *reloader) watch() {
+	if r.path == "" {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go config.Watch(r.path, config.WatchInterval, nil, r.reload)
+
+	for range hup {
+		r.reload()
+	}
+}
+
+func (r *reloader) reload() {
+	r.Lock()
+	defer r.Unlock()
+
+	file, err := config.Load(r.path, r.base)
+	if err != nil {
+		log.Printf("Keeping current config, error loading %s: %s", r.path, err.Error())
+		return
+	}
+
+	running := r.config()
+	for _, setting := range file.RestartOnly(running) {
+		log.Printf("Change to %s in %s takes effect on restart", setting, r.path)
+	}
+
+	var cert *tls.Certificate
+	if file.TLS.Enabled() {
+		loaded, err := tls.LoadX509KeyPair(file.TLS.Cert, file.TLS.Key)
+		if err != nil {
+			log.Printf("Keeping current config, error loading certificate: %s", err.Error())
+			return
+		}
+		cert = &loaded
+	}
+
+	poolConfig := file.Pool()
+	if r.discovery != nil || file.BlueGreen != nil {
+		poolConfig.Backends = nil
+		poolConfig.Weights = nil
+	}
+
+	keepRuntime(running, file, poolConfig)
+
+	pools := make(map[string]*pool.Config)
+	for _, name := range file.PoolNames() {
+		pools[name] = file.VirtualPool(name)
+	}
+
+	if err := r.pool.Check(poolConfig); err != nil {
+		log.Printf("Keeping current config, error applying %s: %s", r.path, err.Error())
+		return
+	}
+
+	for name, c := range pools {
+		if err := r.pools[name].Check(c); err != nil {
+			log.Printf("Keeping current config, error applying %s to pool %s: %s", r.path, name, err.Error())
+			return
+		}
+	}
+
+	if r.routes != nil && !reflect.DeepEqual(file.Routes, running.Routes) {
+		if err := r.routes.Apply(file); err != nil {
+			log.Printf("Keeping current config, error applying routes in %s: %s", r.path, err.Error())
+			return
+		}
+	}
+
+	if err := r.pool.Reload(poolConfig); err != nil {
+		log.Printf("Error applying %s: %s", r.path, err.Error())
+	}
+
+	if r.discovery != nil {
+		r.discovery.SetStatic(file.Backends)
+	}
+
+	if bg := file.BlueGreen; bg != nil && bg.Active != running.BlueGreen.Active {
+		if err := r.pool.(switcher).Switch(bg.Active); err != nil {
+			log.Printf("Keeping active set %s, error applying %s: %s", running.BlueGreen.Active, r.path, err.Error())
+			bg.Active = running.BlueGreen.Active
+		}
+	}
+
+	for _, name := range file.PoolNames() {
+		if err := r.pools[name].Reload(pools[name]); err != nil {
+			log.Printf("Error applying %s to pool %s: %s", r.path, name, err.Error())
+		}
+	}
+
+	for _, name := range file.SplitNames() {
+		percent := file.Splits[name].Percent
+		if percent == running.Splits[name].Percent {
+			continue
+		}
+
+		if err := r.splits.SetSplit(name, percent); err != nil {
+			log.Printf("Keeping percent of split %s, error applying %s: %s", name, r.path, err.Error())
+			continue
+		}
+		log.Printf("Split %s sends %v%% to its canary", name, percent)
+	}
+
+	if cert != nil {
+		r.cert.Store(cert)
+	}
+	r.current.Store(file)
+
+	log.Printf("Reloaded config from %s", r.path)
+}
+
+func (r *reloader) config() *config.File {
+	return r.current.Load().(*config.File)
+}
+
+func (r *reloader) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
+
+// MarshalJSON shows the running config without secrets, it is served by the
+// admin API as the effective config.
+func (r *reloader) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.config().Redacted())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+
+	"github.com/CoderCookE/goaround/internal/config"
+	"github.com/CoderCookE/goaround/internal/pool"
+	"github.com/CoderCookE/goaround/internal/state"
+)
+
+type restorable interface {
+	Drain(backends []string) error
+	Maintenance(backends []string, enabled bool) error
+}
+
+// restoreState returns a copy of file with the backends of its state file,
+// picked according to the precedence, and the saved backends to apply once
+// the pool runs. With discovery the saved set is not restored, discovered
+// backends would otherwise become static.
+func restoreState(file *config.File) (*config.File, []state.Backend) {
+	if file.State.Path == "" {
+		return file, nil
+	}
+
+	saved, err := state.Load(file.State.Path)
+	if err != nil {
+		log.Printf("Ignoring state file: %s", err.Error())
+		return file, nil
+	}
+
+	if saved == nil {
+		return file, nil
+	}
+
+	precedence := file.State.Precedence
+	if precedence == state.PreferState && len(file.Providers()) > 0 {
+		log.Printf("Backends are discovered, only restoring weights, drain and maintenance from %s", file.State.Path)
+		precedence = state.PreferFlags
+	}
+
+	configured := make(map[string]config.Backend)
+	urls := make([]string, len(file.Backends))
+	for i, b := range file.Backends {
+		urls[i] = b.URL
+		configured[b.URL] = b
+	}
+
+	backends, restored := saved.Restore(urls, precedence)
+
+	weights := make(map[string]int)
+	for _, b := range restored {
+		weights[b.URL] = b.Weight
+	}
+
+	restoredFile := *file
+	restoredFile.Backends = make([]config.Backend, len(backends))
+	for i, url := range backends {
+		b, ok := configured[url]
+		if !ok {
+			b = config.Backend{URL: url}
+		}
+
+		if weight, ok := weights[url]; ok {
+			b.Weight = weight
+		}
+		restoredFile.Backends[i] = b
+	}
+
+	log.Printf("Restored %d backends from %s", len(restored), file.State.Path)
+
+	return &restoredFile, restored
+}
+
+// applyState drains and puts in maintenance the restored backends that were.
+func applyState(p restorable, restored []state.Backend) {
+	var draining, maintenance []string
+	for _, b := range restored {
+		if b.Draining {
+			draining = append(draining, b.URL)
+		}
+
+		if b.Maintenance {
+			maintenance = append(maintenance, b.URL)
+		}
+	}
+
+	if len(maintenance) > 0 {
+		if err := p.Maintenance(maintenance, true); err != nil {
+			log.Printf("Error restoring maintenance: %s", err.Error())
+		}
+	}
+
+	if len(draining) > 0 {
+		if err := p.Drain(draining); err != nil {
+			log.Printf("Error restoring drain: %s", err.Error())
+		}
+	}
+}
+
+// keepRuntime adds to a reloaded pool config the saved backends the running
+// file did not list, those were added through the control socket or admin
+// API and a reload would otherwise drop them. Only the state precedence
+// keeps them, with flags the file's backends win as they do at startup.
+func keepRuntime(running, file *config.File, c *pool.Config) {
+	if file.State.Path == "" || file.State.Precedence != state.PreferState || c.Backends == nil {
+		return
+	}
+
+	saved, err := state.Load(file.State.Path)
+	if err != nil {
+		log.Printf("Ignoring state file: %s", err.Error())
+		return
+	}
+
+	if saved == nil {
+		return
+	}
+
+	listed := make(map[string]bool)
+	for _, b := range running.Backends {
+		listed[b.URL] = true
+	}
+
+	for _, url := range c.Backends {
+		listed[url] = true
+	}
+
+	for _, b := range saved.Backends {
+		if listed[b.URL] {
+			continue
+		}
+
+		if c.Weights == nil {
+			c.Weights = make(map[string]int)
+		}
+		c.Backends = append(c.Backends, b.URL)
+		c.Weights[b.URL] = b.Weight
+		log.Printf("Keeping backend %s added at runtime", b.URL)
+	}
+}
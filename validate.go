@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/CoderCookE/goaround/internal/config"
+)
+
+// validate checks the settings from flags and the config file, if any,
+// without starting goaround. The effective config is printed when valid.
+func validate(base *config.File, configPath string, args []string, stdout, stderr io.Writer) int {
+	if len(args) > 1 {
+		fmt.Fprintln(stderr, "Usage: goaround [flags] validate [config file]")
+		return 2
+	}
+
+	if len(args) == 1 {
+		configPath = args[0]
+	}
+
+	source := "flags"
+	file := base
+	var err error
+
+	if configPath != "" {
+		source = configPath
+		file, err = config.Load(configPath, base)
+	} else {
+		err = base.Validate()
+	}
+
+	if err != nil {
+		invalid, ok := err.(*config.Invalid)
+		if !ok {
+			fmt.Fprintf(stderr, "%s: %s\n", source, err.Error())
+			return 1
+		}
+
+		for _, p := range invalid.Problems {
+			location := source
+			if p.Line > 0 {
+				location = fmt.Sprintf("%s:%d:%d", source, p.Line, p.Column)
+			}
+
+			if p.Field != "" {
+				fmt.Fprintf(stderr, "%s: %s: %s\n", location, p.Field, p.Message)
+			} else {
+				fmt.Fprintf(stderr, "%s: %s\n", location, p.Message)
+			}
+		}
+
+		return 1
+	}
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(file.Redacted()); err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	return 0
+}